@@ -0,0 +1,31 @@
+package machinery
+
+import (
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// AuditEvent represents a single task lifecycle event
+// published to the audit exchange
+type AuditEvent struct {
+	TaskUUID  string
+	TaskName  string
+	State     string
+	Error     string
+	WorkerID  string
+	Timestamp time.Time
+}
+
+// NewAuditEvent creates AuditEvent instance
+func NewAuditEvent(signature *signatures.TaskSignature, taskState *backends.TaskState) *AuditEvent {
+	return &AuditEvent{
+		TaskUUID:  signature.UUID,
+		TaskName:  signature.Name,
+		State:     taskState.State,
+		Error:     taskState.Error,
+		WorkerID:  taskState.WorkerID,
+		Timestamp: time.Now().UTC(),
+	}
+}
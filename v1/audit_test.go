@@ -0,0 +1,38 @@
+package machinery
+
+import (
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+func TestNewAuditEvent(t *testing.T) {
+	signature := signatures.TaskSignature{
+		UUID: "taskUUID",
+		Name: "add",
+	}
+	taskState := backends.NewFailureTaskState("taskUUID", "some error")
+
+	event := NewAuditEvent(&signature, taskState)
+
+	if event.TaskUUID != "taskUUID" {
+		t.Errorf("event.TaskUUID = %v, want taskUUID", event.TaskUUID)
+	}
+
+	if event.TaskName != "add" {
+		t.Errorf("event.TaskName = %v, want add", event.TaskName)
+	}
+
+	if event.State != backends.FailureState {
+		t.Errorf("event.State = %v, want %v", event.State, backends.FailureState)
+	}
+
+	if event.Error != "some error" {
+		t.Errorf("event.Error = %v, want some error", event.Error)
+	}
+
+	if event.Timestamp.IsZero() {
+		t.Error("event.Timestamp should be set")
+	}
+}
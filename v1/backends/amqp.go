@@ -1,12 +1,12 @@
 package backends
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 
 	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/utils"
 	"github.com/streadway/amqp"
 )
 
@@ -31,7 +31,7 @@ func (amqpBackend *AMQPBackend) UpdateState(taskState *TaskState) error {
 
 	defer close(channel, conn)
 
-	message, err := json.Marshal(taskState)
+	message, err := encodeState(amqpBackend.config, taskState)
 	if err != nil {
 		return fmt.Errorf("JSON Encode Message: %v", err)
 	}
@@ -74,7 +74,7 @@ func (amqpBackend *AMQPBackend) GetState(taskUUID string) (*TaskState, error) {
 
 	d.Ack(false)
 
-	if err := json.Unmarshal([]byte(d.Body), &taskState); err != nil {
+	if err := decodeState(d.Body, &taskState); err != nil {
 		log.Printf("Failed to unmarshal task state: %v", string(d.Body))
 		log.Print(err)
 		return nil, err
@@ -94,21 +94,49 @@ func (amqpBackend *AMQPBackend) GetState(taskUUID string) (*TaskState, error) {
 
 // Connects to the message queue, opens a channel, declares a queue
 func open(taskUUID string, cnf *config.Config) (*amqp.Connection, *amqp.Channel, amqp.Queue, error) {
-	var conn *amqp.Connection
-	var channel *amqp.Channel
 	var queue amqp.Queue
-	var err error
 
-	conn, err = amqp.Dial(cnf.Broker)
+	conn, err := dial(cnf)
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Dial: %s", err)
+		return nil, nil, queue, err
 	}
 
-	channel, err = conn.Channel()
+	channel, err := conn.Channel()
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Channel: %s", err)
+		conn.Close()
+		utils.Connections.Release()
+		return nil, nil, queue, fmt.Errorf("Channel: %s", err)
+	}
+
+	queue, err = declare(taskUUID, channel, cnf)
+	if err != nil {
+		close(channel, conn)
+		return nil, nil, queue, err
+	}
+
+	return conn, channel, queue, nil
+}
+
+// Dials the broker unless the maximum number of connections is reached
+func dial(cnf *config.Config) (*amqp.Connection, error) {
+	if err := utils.Connections.Acquire(cnf.MaxConnections); err != nil {
+		return nil, fmt.Errorf("Dial: %s", err)
 	}
 
+	conn, err := utils.DialAMQP(cnf.Broker, cnf.Dialer)
+	if err != nil {
+		utils.Connections.Release()
+		return nil, fmt.Errorf("Dial: %s", err)
+	}
+
+	return conn, nil
+}
+
+// Declares the exchange and a queue for the task's states
+func declare(taskUUID string, channel *amqp.Channel, cnf *config.Config) (amqp.Queue, error) {
+	var queue amqp.Queue
+	var err error
+
 	err = channel.ExchangeDeclare(
 		cnf.Exchange,     // name of the exchange
 		cnf.ExchangeType, // type
@@ -119,7 +147,7 @@ func open(taskUUID string, cnf *config.Config) (*amqp.Connection, *amqp.Channel,
 		nil,              // arguments
 	)
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Exchange: %s", err)
+		return queue, fmt.Errorf("Exchange: %s", err)
 	}
 
 	resultsExpireIn := cnf.ResultsExpireIn * 1000
@@ -139,7 +167,7 @@ func open(taskUUID string, cnf *config.Config) (*amqp.Connection, *amqp.Channel,
 		arguments,
 	)
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Queue Declare: %s", err)
+		return queue, fmt.Errorf("Queue Declare: %s", err)
 	}
 
 	if err := channel.QueueBind(
@@ -149,15 +177,18 @@ func open(taskUUID string, cnf *config.Config) (*amqp.Connection, *amqp.Channel,
 		false,        // noWait
 		nil,          // arguments
 	); err != nil {
-		return conn, channel, queue, fmt.Errorf("Queue Bind: %s", err)
+		return queue, fmt.Errorf("Queue Bind: %s", err)
 	}
 
-	return conn, channel, queue, nil
+	return queue, nil
 }
 
 // Closes the connection
 func close(channel *amqp.Channel, conn *amqp.Connection) error {
+	defer utils.Connections.Release()
+
 	if err := channel.Close(); err != nil {
+		conn.Close()
 		return fmt.Errorf("Channel Close: %s", err)
 	}
 
@@ -0,0 +1,57 @@
+package backends
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/RichardKnop/machinery/v1/config"
+)
+
+// States smaller than this aren't worth compressing
+const compressMinBytes = 1024
+
+// Magic number of gzip, which marks compressed states. Encoded JSON never
+// starts with it, so uncompressed states stored before still decode.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Encodes the task state as JSON, gzipped if it is a large enough success
+// state and CompressResults is set
+func encodeState(cnf *config.Config, taskState *TaskState) ([]byte, error) {
+	encoded, err := json.Marshal(taskState)
+	if err != nil {
+		return nil, err
+	}
+
+	if !cnf.CompressResults || !taskState.IsSuccess() || len(encoded) < compressMinBytes {
+		return encoded, nil
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(encoded); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// Decodes a task state encoded by encodeState, compressed or not
+func decodeState(data []byte, taskState *TaskState) error {
+	if bytes.HasPrefix(data, gzipMagic) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		if data, err = ioutil.ReadAll(reader); err != nil {
+			return err
+		}
+	}
+
+	return json.Unmarshal(data, taskState)
+}
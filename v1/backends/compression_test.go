@@ -0,0 +1,60 @@
+package backends
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/config"
+)
+
+func TestEncodeState(t *testing.T) {
+	report := strings.Repeat("line of a report,", 1000)
+	large := NewSuccessTaskState("taskUUID", &TaskResult{Type: "string", Value: report})
+	small := NewSuccessTaskState("taskUUID", &TaskResult{Type: "int64", Value: float64(2)})
+	failure := NewFailureTaskState("taskUUID", report)
+
+	uncompressed, _ := json.Marshal(large)
+
+	testCases := []struct {
+		cnf        *config.Config
+		taskState  *TaskState
+		compressed bool
+	}{
+		{&config.Config{CompressResults: true}, large, true},
+		{&config.Config{CompressResults: true}, small, false},
+		{&config.Config{CompressResults: true}, failure, false},
+		{&config.Config{}, large, false},
+	}
+
+	for _, testCase := range testCases {
+		encoded, err := encodeState(testCase.cnf, testCase.taskState)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed := bytes.HasPrefix(encoded, gzipMagic); compressed != testCase.compressed {
+			t.Errorf("%s compressed = %v, want %v", testCase.taskState.State, compressed, testCase.compressed)
+		}
+		if testCase.compressed && len(encoded) >= len(uncompressed)/10 {
+			t.Errorf("len(encoded) = %d, want well below %d", len(encoded), len(uncompressed))
+		}
+
+		decoded := TaskState{}
+		if err := decodeState(encoded, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.State != testCase.taskState.State || decoded.Error != testCase.taskState.Error {
+			t.Errorf("decodeState() = %+v, want %+v", decoded, testCase.taskState)
+		}
+		if testCase.taskState.Result != nil && decoded.Result.Value != testCase.taskState.Result.Value {
+			t.Errorf("decoded result = %v, want %v", decoded.Result.Value, testCase.taskState.Result.Value)
+		}
+	}
+
+	// States stored before compression was switched on still decode
+	decoded := TaskState{}
+	if err := decodeState(uncompressed, &decoded); err != nil || decoded.Result.Value != report {
+		t.Errorf("decodeState() = %v, want the uncompressed state", err)
+	}
+}
@@ -1,7 +1,78 @@
 package backends
 
+import "io"
+
 // Backend - a common interface for all result backends
 type Backend interface {
 	UpdateState(taskState *TaskState) error
 	GetState(taskUUID string) (*TaskState, error)
 }
+
+// StatePeeker - result backends looking up task states without consuming
+// them. Unlike GetState of the AMQP backend, which takes the state message
+// off its queue, peeking leaves the state for AsyncResult and others.
+type StatePeeker interface {
+	PeekState(taskUUID string) (*TaskState, error)
+}
+
+// Deduplicator - result backends supporting deduplication of published tasks
+type Deduplicator interface {
+	// ClaimKey returns false if the key has already been claimed
+	// within the window (in seconds)
+	ClaimKey(key string, window int) (bool, error)
+	ReleaseKey(key string) error
+}
+
+// PositionStore - result backends persisting consume positions of
+// replayable logs, e.g. RabbitMQ streams, keyed by consumer group
+// and stream, so restarted consumers resume where they left off
+type PositionStore interface {
+	SavePosition(key string, position int64) error
+	// GetPosition returns false if no position has been saved
+	GetPosition(key string) (int64, bool, error)
+}
+
+// SemaphoreSlot is a slot of a distributed semaphore held by a worker,
+// identified by its key and the token of the holder
+type SemaphoreSlot struct {
+	Key   string
+	Token string
+}
+
+// Semaphore - result backends supporting distributed semaphores limiting
+// concurrent executions of a task fleet-wide. Slots are leased for a time
+// (in seconds) and must be renewed by long running holders.
+type Semaphore interface {
+	// AcquireSlot returns nil if all slots are taken
+	AcquireSlot(name string, limit, lease int) (*SemaphoreSlot, error)
+	RenewSlot(slot *SemaphoreSlot, lease int) error
+	ReleaseSlot(slot *SemaphoreSlot) error
+}
+
+// StreamStore - result backends storing large results, e.g. generated
+// reports, in chunks so they are never held in memory whole
+type StreamStore interface {
+	WriteStream(key string, reader io.Reader) error
+	// ReadStream returns ErrStreamNotFound if no complete stream is stored
+	ReadStream(key string) (io.ReadCloser, error)
+}
+
+// Committer - result backends storing a task's final state only if no
+// final state has been stored for the task yet, atomically, so of several
+// deliveries of a task only one commits its outcome
+type Committer interface {
+	// CommitState returns ErrAlreadyCommitted if the task has already
+	// completed
+	CommitState(taskState *TaskState) error
+}
+
+// RateCounter - result backends counting events in fixed windows, e.g.
+// tasks started by a tenant, to enforce rate limits fleet-wide
+type RateCounter interface {
+	// IncrementCounter counts an event in the current window of the given
+	// length (in seconds) and returns the number of events of the window
+	IncrementCounter(key string, window int) (int64, error)
+	// DecrementCounter takes back an event counted in the current window,
+	// e.g. of a task which didn't start after all
+	DecrementCounter(key string, window int) error
+}
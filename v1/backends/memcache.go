@@ -1,13 +1,25 @@
 package backends
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
 	"time"
 
+	"code.google.com/p/go-uuid/uuid"
 	"github.com/RichardKnop/machinery/v1/config"
 	"github.com/bradfitz/gomemcache/memcache"
 )
 
+// ErrAlreadyCommitted is returned when committing the final state of a task
+// which has already completed, e.g. processed by another delivery
+var ErrAlreadyCommitted = errors.New("Task state already committed")
+
+// ErrSlotLost is returned when renewing a semaphore slot whose lease
+// expired and which may have been acquired by another holder since
+var ErrSlotLost = errors.New("Semaphore slot lost")
+
 // MemcacheBackend represents a Memcache result backend
 type MemcacheBackend struct {
 	config  *config.Config
@@ -24,7 +36,7 @@ func NewMemcacheBackend(cnf *config.Config, servers []string) Backend {
 
 // UpdateState updates a task state
 func (memcacheBackend *MemcacheBackend) UpdateState(taskState *TaskState) error {
-	encoded, err := json.Marshal(&taskState)
+	encoded, err := encodeState(memcacheBackend.config, taskState)
 	if err != nil {
 		return err
 	}
@@ -66,9 +78,336 @@ func (memcacheBackend *MemcacheBackend) GetState(taskUUID string) (*TaskState, e
 		return nil, err
 	}
 
-	if err := json.Unmarshal(item.Value, &taskState); err != nil {
+	if err := decodeState(item.Value, &taskState); err != nil {
 		return nil, err
 	}
 
 	return &taskState, nil
 }
+
+// PeekState returns the latest task state, leaving it stored
+func (memcacheBackend *MemcacheBackend) PeekState(taskUUID string) (*TaskState, error) {
+	return memcacheBackend.GetState(taskUUID)
+}
+
+// CommitState stores the final state of a task unless it has already
+// completed. The stored state is compared and swapped, so a state committed
+// concurrently by another delivery is never overwritten.
+func (memcacheBackend *MemcacheBackend) CommitState(taskState *TaskState) error {
+	encoded, err := encodeState(memcacheBackend.config, taskState)
+	if err != nil {
+		return err
+	}
+
+	expiresIn := memcacheBackend.config.ResultsExpireIn
+	if expiresIn == 0 {
+		// expire results after 1 hour by default
+		expiresIn = 3600
+	}
+	expirationTimestamp := int32(time.Now().Unix() + int64(expiresIn))
+
+	client := memcache.New(memcacheBackend.servers...)
+
+	for {
+		item, err := client.Get(taskState.TaskUUID)
+		if err == memcache.ErrCacheMiss {
+			// No state stored yet, e.g. it expired, add it unless
+			// another delivery does first
+			err = client.Add(&memcache.Item{
+				Key:        taskState.TaskUUID,
+				Value:      encoded,
+				Expiration: expirationTimestamp,
+			})
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		stored := TaskState{}
+		if err := decodeState(item.Value, &stored); err != nil {
+			return err
+		}
+		if stored.IsCompleted() {
+			return ErrAlreadyCommitted
+		}
+
+		item.Value = encoded
+		item.Expiration = expirationTimestamp
+		err = client.CompareAndSwap(item)
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			continue // the state changed meanwhile, check it again
+		}
+		return err
+	}
+}
+
+// ClaimKey atomically claims a deduplication key for the window (in seconds)
+func (memcacheBackend *MemcacheBackend) ClaimKey(key string, window int) (bool, error) {
+	client := memcache.New(memcacheBackend.servers...)
+
+	err := client.Add(&memcache.Item{
+		Key:        dedupKey(key),
+		Value:      []byte{1},
+		Expiration: int32(window),
+	})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ReleaseKey releases a claimed deduplication key before its window passes
+func (memcacheBackend *MemcacheBackend) ReleaseKey(key string) error {
+	client := memcache.New(memcacheBackend.servers...)
+
+	if err := client.Delete(dedupKey(key)); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+
+	return nil
+}
+
+// SavePosition stores the consume position, it never expires
+func (memcacheBackend *MemcacheBackend) SavePosition(key string, position int64) error {
+	client := memcache.New(memcacheBackend.servers...)
+
+	return client.Set(&memcache.Item{
+		Key:   positionKey(key),
+		Value: []byte(strconv.FormatInt(position, 10)),
+	})
+}
+
+// GetPosition returns the stored consume position
+func (memcacheBackend *MemcacheBackend) GetPosition(key string) (int64, bool, error) {
+	client := memcache.New(memcacheBackend.servers...)
+
+	item, err := client.Get(positionKey(key))
+	if err == memcache.ErrCacheMiss {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	position, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+
+	return position, true, nil
+}
+
+// AcquireSlot atomically claims a free slot of the semaphore, each of
+// its limit slots being a key claimed for the lease (in seconds)
+func (memcacheBackend *MemcacheBackend) AcquireSlot(name string, limit, lease int) (*SemaphoreSlot, error) {
+	client := memcache.New(memcacheBackend.servers...)
+
+	token := uuid.New()
+	for i := 0; i < limit; i++ {
+		slot := &SemaphoreSlot{Key: semaphoreKey(name, i), Token: token}
+		err := client.Add(&memcache.Item{
+			Key:        slot.Key,
+			Value:      []byte(token),
+			Expiration: int32(lease),
+		})
+		if err == memcache.ErrNotStored {
+			continue // taken
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return slot, nil
+	}
+
+	return nil, nil
+}
+
+// RenewSlot extends the lease of a slot still held
+func (memcacheBackend *MemcacheBackend) RenewSlot(slot *SemaphoreSlot, lease int) error {
+	client := memcache.New(memcacheBackend.servers...)
+
+	item, err := client.Get(slot.Key)
+	if err == memcache.ErrCacheMiss {
+		return ErrSlotLost
+	}
+	if err != nil {
+		return err
+	}
+
+	// Compare and swap, so a slot taken over by another holder
+	// between the get and the renewal is not extended
+	if string(item.Value) != slot.Token {
+		return ErrSlotLost
+	}
+	item.Expiration = int32(lease)
+	if err := client.CompareAndSwap(item); err != nil {
+		if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			return ErrSlotLost
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ReleaseSlot frees a slot, unless it has been taken over
+func (memcacheBackend *MemcacheBackend) ReleaseSlot(slot *SemaphoreSlot) error {
+	client := memcache.New(memcacheBackend.servers...)
+
+	item, err := client.Get(slot.Key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if string(item.Value) != slot.Token {
+		return nil
+	}
+
+	if err := client.Delete(slot.Key); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+
+	return nil
+}
+
+// IncrementCounter counts an event in a key of the current window, which
+// expires once the window has passed
+func (memcacheBackend *MemcacheBackend) IncrementCounter(key string, window int) (int64, error) {
+	client := memcache.New(memcacheBackend.servers...)
+
+	windowKey := counterKey(key, time.Now().Unix()/int64(window))
+	for attempt := 0; ; attempt++ {
+		if err := client.Add(&memcache.Item{
+			Key:        windowKey,
+			Value:      []byte("0"),
+			Expiration: int32(2 * window),
+		}); err != nil && err != memcache.ErrNotStored {
+			return 0, err
+		}
+
+		count, err := client.Increment(windowKey, 1)
+		if err == memcache.ErrCacheMiss && attempt == 0 {
+			continue // evicted since it was added, add it again
+		}
+		if err != nil {
+			return 0, err
+		}
+		return int64(count), nil
+	}
+}
+
+// DecrementCounter takes back an event counted in the key of the current
+// window. Windows which have expired meanwhile are left alone.
+func (memcacheBackend *MemcacheBackend) DecrementCounter(key string, window int) error {
+	client := memcache.New(memcacheBackend.servers...)
+
+	windowKey := counterKey(key, time.Now().Unix()/int64(window))
+	if _, err := client.Decrement(windowKey, 1); err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// WriteStream stores the stream in chunks expiring along with task states,
+// its chunk count is stored last so partially written streams aren't read
+func (memcacheBackend *MemcacheBackend) WriteStream(key string, reader io.Reader) error {
+	client := memcache.New(memcacheBackend.servers...)
+
+	expiresIn := memcacheBackend.config.ResultsExpireIn
+	if expiresIn == 0 {
+		// expire results after 1 hour by default
+		expiresIn = 3600
+	}
+	expirationTimestamp := int32(time.Now().Unix() + int64(expiresIn))
+
+	count, err := writeChunks(reader, streamChunkSize, func(i int, chunk []byte) error {
+		return client.Set(&memcache.Item{
+			Key:        streamChunkKey(key, i),
+			Value:      chunk,
+			Expiration: expirationTimestamp,
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return client.Set(&memcache.Item{
+		Key:        streamKey(key),
+		Value:      []byte(strconv.Itoa(count)),
+		Expiration: expirationTimestamp,
+	})
+}
+
+// ReadStream returns a reader fetching the chunks of the stream as it's read
+func (memcacheBackend *MemcacheBackend) ReadStream(key string) (io.ReadCloser, error) {
+	client := memcache.New(memcacheBackend.servers...)
+
+	item, err := client.Get(streamKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, ErrStreamNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(string(item.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkReader{
+		count: count,
+		get: func(i int) ([]byte, error) {
+			item, err := client.Get(streamChunkKey(key, i))
+			if err == memcache.ErrCacheMiss {
+				return nil, ErrStreamNotFound
+			}
+			if err != nil {
+				return nil, err
+			}
+			return item.Value, nil
+		},
+	}, nil
+}
+
+// Namespaces semaphore slot keys so they don't clash with task UUIDs
+func semaphoreKey(name string, i int) string {
+	return fmt.Sprintf("semaphore:%s:%d", name, i)
+}
+
+// Namespaces counter keys of a window so they don't clash with task UUIDs
+func counterKey(key string, window int64) string {
+	return fmt.Sprintf("counter:%s:%d", key, window)
+}
+
+// Namespaces position keys so they don't clash with task UUIDs
+func positionKey(key string) string {
+	return "position:" + key
+}
+
+// Namespaces deduplication keys so they don't clash with task UUIDs
+func dedupKey(key string) string {
+	return "dedup:" + key
+}
+
+// Namespaces stream keys so they don't clash with task UUIDs
+func streamKey(key string) string {
+	return "stream:" + key
+}
+
+// Returns key of a chunk of a stream
+func streamChunkKey(key string, i int) string {
+	return fmt.Sprintf("stream:%s:%d", key, i)
+}
@@ -60,3 +60,28 @@ func TestGetStateMemcache(t *testing.T) {
 		}
 	}
 }
+
+func TestPositionMemcache(t *testing.T) {
+	memcacheURL := os.Getenv("MEMCACHE_URL")
+	if memcacheURL == "" {
+		return
+	}
+
+	backend := NewMemcacheBackend(&config.Config{
+		ResultBackend: memcacheURL,
+	}, []string{memcacheURL}).(PositionStore)
+
+	key := "group:stream"
+	if err := backend.SavePosition(key, 42); err != nil {
+		t.Error(err)
+	}
+
+	position, ok, err := backend.GetPosition(key)
+	if err != nil || !ok || position != 42 {
+		t.Errorf("backend.GetPosition() = %v, %v, %v, want 42", position, ok, err)
+	}
+
+	if _, ok, err := backend.GetPosition("unknown"); ok || err != nil {
+		t.Errorf("backend.GetPosition() = %v, %v, want no position", ok, err)
+	}
+}
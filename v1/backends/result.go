@@ -2,11 +2,17 @@ package backends
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"reflect"
 
 	"github.com/RichardKnop/machinery/v1/utils"
 )
 
+// ErrTaskCanceled is returned along with the partial result, if any, of a
+// canceled task, the task state's Error tells why it was canceled
+var ErrTaskCanceled = errors.New("Task canceled")
+
 // AsyncResult represents a task result
 type AsyncResult struct {
 	taskUUID  string
@@ -51,18 +57,66 @@ func (asyncResult *AsyncResult) Get() (reflect.Value, error) {
 		asyncResult.GetState()
 
 		if asyncResult.taskState.IsSuccess() {
+			if asyncResult.taskState.Result.Type == StreamResultType {
+				stream, err := asyncResult.readStream()
+				if err != nil {
+					return reflect.Value{}, err
+				}
+				return reflect.ValueOf(stream), nil
+			}
 			return utils.ReflectValue(
 				asyncResult.taskState.Result.Type,
 				asyncResult.taskState.Result.Value,
 			)
 		}
 
+		if asyncResult.taskState.IsCanceled() {
+			partial := asyncResult.taskState.Result
+			if partial == nil {
+				return reflect.Value{}, ErrTaskCanceled
+			}
+			value, err := utils.ReflectValue(partial.Type, partial.Value)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return value, ErrTaskCanceled
+		}
+
 		if asyncResult.taskState.IsFailure() {
 			return reflect.Value{}, errors.New(asyncResult.taskState.Error)
 		}
 	}
 }
 
+// Stream returns a reader of the streamed result of a task (synchronous
+// blocking call), the caller must close it
+func (asyncResult *AsyncResult) Stream() (io.ReadCloser, error) {
+	result, err := asyncResult.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, ok := result.Interface().(io.ReadCloser)
+	if !ok {
+		return nil, fmt.Errorf("Result of type %s is not streamed", result.Type())
+	}
+	return stream, nil
+}
+
+// Opens the stream the task's result was stored as
+func (asyncResult *AsyncResult) readStream() (io.ReadCloser, error) {
+	streamStore, ok := asyncResult.backend.(StreamStore)
+	if !ok {
+		return nil, errors.New("Result backend does not support streamed results")
+	}
+
+	key, ok := asyncResult.taskState.Result.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid stream key %v", asyncResult.taskState.Result.Value)
+	}
+	return streamStore.ReadStream(key)
+}
+
 // GetState returns latest task state
 func (asyncResult *AsyncResult) GetState() *TaskState {
 	if asyncResult.taskState.IsCompleted() {
@@ -1,5 +1,7 @@
 package backends
 
+import "time"
+
 const (
 	// PendingState - initial state of a task
 	PendingState = "PENDING"
@@ -9,8 +11,12 @@ const (
 	StartedState = "STARTED"
 	// SuccessState - when the task is processed successfully
 	SuccessState = "SUCCESS"
+	// RetryState - when failed task has been scheduled for retry
+	RetryState = "RETRY"
 	// FailureState - when processing of the task fails
 	FailureState = "FAILURE"
+	// CanceledState - when the task is canceled, keeping its partial result
+	CanceledState = "CANCELED"
 )
 
 // TaskResult represents an actual return value of a processed task
@@ -21,10 +27,13 @@ type TaskResult struct {
 
 // TaskState represents a state of a task
 type TaskState struct {
-	TaskUUID string
-	State    string
-	Result   *TaskResult
-	Error    string
+	TaskUUID         string
+	State            string
+	Result           *TaskResult
+	Error            string
+	WorkerID         string
+	RetriesRemaining int
+	NextRetryAt      time.Time
 }
 
 // NewPendingTaskState ...
@@ -60,6 +69,17 @@ func NewSuccessTaskState(taskUUID string, result *TaskResult) *TaskState {
 	}
 }
 
+// NewRetryTaskState ...
+func NewRetryTaskState(taskUUID string, err string, retriesRemaining int, nextRetryAt time.Time) *TaskState {
+	return &TaskState{
+		TaskUUID:         taskUUID,
+		State:            RetryState,
+		Error:            err,
+		RetriesRemaining: retriesRemaining,
+		NextRetryAt:      nextRetryAt,
+	}
+}
+
 // NewFailureTaskState ...
 func NewFailureTaskState(taskUUID string, err string) *TaskState {
 	return &TaskState{
@@ -69,10 +89,21 @@ func NewFailureTaskState(taskUUID string, err string) *TaskState {
 	}
 }
 
-// IsCompleted returns true if state is SUCCESSS or FAILURE,
-// i.e. the task has finished processing and either succeeded or failed.
+// NewCanceledTaskState ...
+func NewCanceledTaskState(taskUUID string, partial *TaskResult, reason string) *TaskState {
+	return &TaskState{
+		TaskUUID: taskUUID,
+		State:    CanceledState,
+		Result:   partial,
+		Error:    reason,
+	}
+}
+
+// IsCompleted returns true if state is SUCCESSS, FAILURE or CANCELED,
+// i.e. the task has finished processing and either succeeded, failed
+// or was canceled.
 func (taskState *TaskState) IsCompleted() bool {
-	return taskState.IsSuccess() || taskState.IsFailure()
+	return taskState.IsSuccess() || taskState.IsFailure() || taskState.IsCanceled()
 }
 
 // IsSuccess returns true if state is SUCCESSS
@@ -84,3 +115,8 @@ func (taskState *TaskState) IsSuccess() bool {
 func (taskState *TaskState) IsFailure() bool {
 	return taskState.State == FailureState
 }
+
+// IsCanceled returns true if state is CANCELED
+func (taskState *TaskState) IsCanceled() bool {
+	return taskState.State == CanceledState
+}
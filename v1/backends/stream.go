@@ -0,0 +1,75 @@
+package backends
+
+import (
+	"errors"
+	"io"
+)
+
+// StreamResultType is the result type of tasks whose result was streamed to
+// the backend, the result value is the key to read the stream with
+const StreamResultType = "stream"
+
+// ErrStreamNotFound is returned when reading a stream which was not stored,
+// has expired, or whose writing has not completed
+var ErrStreamNotFound = errors.New("Result stream not found")
+
+// Size of chunks streams are stored in, within memcache's 1MB item limit
+const streamChunkSize = 512 * 1024
+
+// Reads the stream in chunks of up to size bytes, passing each to put along
+// with its index, and returns the number of chunks
+func writeChunks(reader io.Reader, size int, put func(i int, chunk []byte) error) (int, error) {
+	buffer := make([]byte, size)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(reader, buffer)
+		if n > 0 {
+			if err := put(i, buffer[:n]); err != nil {
+				return 0, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if n > 0 {
+				i++
+			}
+			return i, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// chunkReader reads a stored stream chunk by chunk, fetching the next one
+// only once the previous one has been read
+type chunkReader struct {
+	count int
+	next  int
+	chunk []byte
+	get   func(i int) ([]byte, error)
+}
+
+// Read implements io.Reader
+func (reader *chunkReader) Read(p []byte) (int, error) {
+	for len(reader.chunk) == 0 {
+		if reader.next >= reader.count {
+			return 0, io.EOF
+		}
+		chunk, err := reader.get(reader.next)
+		if err != nil {
+			return 0, err
+		}
+		reader.chunk = chunk
+		reader.next++
+	}
+
+	n := copy(p, reader.chunk)
+	reader.chunk = reader.chunk[n:]
+	return n, nil
+}
+
+// Close implements io.Closer
+func (reader *chunkReader) Close() error {
+	reader.chunk = nil
+	reader.next = reader.count
+	return nil
+}
@@ -0,0 +1,51 @@
+package backends
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestChunks(t *testing.T) {
+	testCases := []struct {
+		data  string
+		count int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"abcd", 1},
+		{"abcdefghij", 3},
+	}
+
+	for _, testCase := range testCases {
+		var chunks [][]byte
+		count, err := writeChunks(strings.NewReader(testCase.data), 4, func(i int, chunk []byte) error {
+			chunks = append(chunks, append([]byte(nil), chunk...))
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if count != testCase.count || len(chunks) != testCase.count {
+			t.Errorf("writeChunks(%q) = %v with %d chunks, want %v", testCase.data, count, len(chunks), testCase.count)
+			continue
+		}
+
+		reader := &chunkReader{
+			count: count,
+			get: func(i int) ([]byte, error) {
+				return chunks[i], nil
+			},
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(data, []byte(testCase.data)) {
+			t.Errorf("chunkReader read %q, want %q", data, testCase.data)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package machinery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/brokers"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// Batch collects the tasks enqueued by one business operation, so they can
+// be stored in an outbox within the operation's database transaction and
+// published once it commits. Tasks are published at least once, a task
+// whose outcome is unknown is published again by the next Commit.
+type Batch struct {
+	OperationID string
+	Signatures  []*signatures.TaskSignature
+	server      *Server
+	inFlight    chan batchOutcome
+	mutex       sync.Mutex
+}
+
+// Outcome of publishing the signatures of a batch
+type batchOutcome struct {
+	signatures []*signatures.TaskSignature
+	published  []bool
+	err        error
+}
+
+// BatchError is returned from Commit when some tasks of the batch could not
+// be published, they remain in the batch to be published by the next Commit
+type BatchError struct {
+	Unpublished int
+	Total       int
+}
+
+// Error implements the error interface
+func (batchError *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d tasks not published", batchError.Unpublished, batchError.Total)
+}
+
+// Publishes signatures in confirm mode, e.g. AMQPBroker
+type batchPublisher interface {
+	PublishBatch(batch []*signatures.TaskSignature) (*brokers.BatchPublishResult, error)
+}
+
+// Batch starts collecting the tasks of a business operation, an operation
+// ID is generated if empty
+func (server *Server) Batch(operationID string) *Batch {
+	if operationID == "" {
+		operationID = uuid.New()
+	}
+	return &Batch{OperationID: operationID, server: server}
+}
+
+// UnmarshalBatch restores a batch stored in an outbox, e.g. to publish
+// batches of operations committed before the process crashed
+func (server *Server) UnmarshalBatch(data []byte) (*Batch, error) {
+	batch := &Batch{server: server}
+	if err := json.Unmarshal(data, batch); err != nil {
+		return nil, fmt.Errorf("JSON Decode Batch: %v", err)
+	}
+	return batch, nil
+}
+
+// Add adds a task to the batch. Its UUID is generated if not set already
+// and the operation ID is recorded in its headers.
+func (batch *Batch) Add(signature *signatures.TaskSignature) *Batch {
+	if signature.UUID == "" {
+		signature.UUID = uuid.New()
+	}
+	if signature.Headers == nil {
+		signature.Headers = make(map[string]interface{})
+	}
+	signature.Headers[signatures.OperationHeader] = batch.OperationID
+
+	batch.Signatures = append(batch.Signatures, signature)
+	return batch
+}
+
+// Marshal encodes the batch to be stored in an outbox within the database
+// transaction of the operation
+func (batch *Batch) Marshal() ([]byte, error) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("JSON Encode Batch: %v", err)
+	}
+	return data, nil
+}
+
+// CommitAfter runs commit, e.g. committing the database transaction the
+// batch was stored in, and publishes the batch only if it succeeded
+func (batch *Batch) CommitAfter(ctx context.Context, commit func() error) error {
+	if err := commit(); err != nil {
+		return err
+	}
+	return batch.Commit(ctx)
+}
+
+// Commit publishes the tasks of the batch, in confirm mode if the broker
+// supports it. Published tasks are removed from the batch, the rest are
+// published again by the next Commit. The outbox entry can be deleted once
+// Commit returns nil. Commits of the batch run one at a time. Once ctx is
+// done, the batch stays untouched while its tasks are still being
+// published, the next Commit waits for their outcome rather than
+// publishing them again.
+func (batch *Batch) Commit(ctx context.Context) error {
+	batch.mutex.Lock()
+	defer batch.mutex.Unlock()
+
+	if batch.inFlight == nil {
+		if len(batch.Signatures) == 0 {
+			return nil
+		}
+
+		pending := append([]*signatures.TaskSignature(nil), batch.Signatures...)
+		inFlight := make(chan batchOutcome, 1)
+		go func() {
+			published, err := batch.publish(pending)
+			inFlight <- batchOutcome{pending, published, err}
+		}()
+		batch.inFlight = inFlight
+	}
+
+	var result batchOutcome
+	select {
+	case result = <-batch.inFlight:
+		batch.inFlight = nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if result.err != nil {
+		return result.err
+	}
+
+	// Tasks added while publishing are published by the next Commit
+	added := batch.Signatures[len(result.signatures):]
+	total := len(result.signatures) + len(added)
+	var unpublished []*signatures.TaskSignature
+	for i, signature := range result.signatures {
+		if !result.published[i] {
+			unpublished = append(unpublished, signature)
+			continue
+		}
+
+		// Update task state to PENDING
+		pendingState := backends.NewPendingTaskState(signature.UUID)
+		if err := batch.server.UpdateTaskState(pendingState); err != nil {
+			log.Print(err)
+		}
+	}
+	batch.Signatures = append(unpublished, added...)
+
+	if len(batch.Signatures) > 0 {
+		return &BatchError{Unpublished: len(batch.Signatures), Total: total}
+	}
+	return nil
+}
+
+// Publishes the signatures and tells which ones were published
+func (batch *Batch) publish(pending []*signatures.TaskSignature) ([]bool, error) {
+	published := make([]bool, len(pending))
+
+	if publisher, ok := batch.server.GetBroker().(batchPublisher); ok {
+		result, err := publisher.PublishBatch(pending)
+		if err != nil {
+			return nil, fmt.Errorf("Publish Batch: %v", err)
+		}
+		for _, i := range result.Confirmed {
+			published[i] = true
+		}
+		return published, nil
+	}
+
+	for i, signature := range pending {
+		if err := batch.server.GetBroker().Publish(signature); err != nil {
+			log.Printf("Failed publishing %s of operation %s. Error = %v", signature.UUID, batch.OperationID, err)
+			continue
+		}
+		published[i] = true
+	}
+	return published, nil
+}
@@ -0,0 +1,188 @@
+package brokers
+
+import (
+	"log"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ackBatcher acknowledges deliveries of a channel in batches, with a
+// single multiple ack of the highest acked delivery tag. Deliveries are
+// processed concurrently, so only tags below which every delivery has
+// been settled (acked, nacked or rejected) are acked, a multiple ack must
+// not cover deliveries still being processed. Nacks and rejects go to the
+// channel right away. Acks are also flushed once every delivery handed out
+// has been settled, acked deliveries count against the prefetch count until
+// flushed and the broker would stop delivering more.
+type ackBatcher struct {
+	acknowledger amqp.Acknowledger
+	size         int
+	next         uint64          // lowest tag not settled yet
+	settled      map[uint64]bool // tags settled out of order, true if acked
+	ackable      uint64          // highest acked tag below next
+	pending      int             // acked tags below next not flushed yet
+	flushed      uint64          // highest tag acked on the channel
+	delivered    uint64          // highest tag handed out to be processed
+	mutex        sync.Mutex
+}
+
+// Creates ackBatcher instance flushing once size deliveries can be acked.
+// Delivery tags of a channel start at 1.
+func newAckBatcher(acknowledger amqp.Acknowledger, size int) *ackBatcher {
+	return &ackBatcher{
+		acknowledger: acknowledger,
+		size:         size,
+		next:         1,
+		settled:      make(map[uint64]bool),
+	}
+}
+
+// Ack implements the amqp.Acknowledger interface
+func (batcher *ackBatcher) Ack(tag uint64, multiple bool) error {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	if multiple {
+		if err := batcher.flush(); err != nil {
+			return err
+		}
+		batcher.settleUpTo(tag)
+		batcher.flushed = tag
+		return batcher.acknowledger.Ack(tag, true)
+	}
+
+	batcher.settle(tag, true)
+	if batcher.pending >= batcher.size || batcher.idle() {
+		return batcher.flush()
+	}
+	return nil
+}
+
+// Nack implements the amqp.Acknowledger interface
+func (batcher *ackBatcher) Nack(tag uint64, multiple bool, requeue bool) error {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	// A multiple nack would also cover deliveries acked but not flushed
+	if multiple {
+		if err := batcher.flush(); err != nil {
+			return err
+		}
+		batcher.settleUpTo(tag)
+	} else {
+		batcher.settle(tag, false)
+	}
+	if err := batcher.acknowledger.Nack(tag, multiple, requeue); err != nil {
+		return err
+	}
+	return batcher.flushIdle()
+}
+
+// Reject implements the amqp.Acknowledger interface
+func (batcher *ackBatcher) Reject(tag uint64, requeue bool) error {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	batcher.settle(tag, false)
+	if err := batcher.acknowledger.Reject(tag, requeue); err != nil {
+		return err
+	}
+	return batcher.flushIdle()
+}
+
+// Deliver records the delivery handed out to be processed
+func (batcher *ackBatcher) Deliver(tag uint64) {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	if tag > batcher.delivered {
+		batcher.delivered = tag
+	}
+}
+
+// Flush acks the deliveries which can be acked, e.g. on a timer so they
+// aren't left unacked for long while traffic is low
+func (batcher *ackBatcher) Flush() error {
+	batcher.mutex.Lock()
+	defer batcher.mutex.Unlock()
+
+	return batcher.flush()
+}
+
+func (batcher *ackBatcher) flush() error {
+	if batcher.ackable <= batcher.flushed {
+		return nil
+	}
+
+	batcher.flushed = batcher.ackable
+	batcher.pending = 0
+	return batcher.acknowledger.Ack(batcher.ackable, true)
+}
+
+// Tells whether every delivery handed out has been settled
+func (batcher *ackBatcher) idle() bool {
+	return batcher.next > batcher.delivered
+}
+
+// Flushes acks once every delivery handed out has been settled
+func (batcher *ackBatcher) flushIdle() error {
+	if batcher.idle() {
+		return batcher.flush()
+	}
+	return nil
+}
+
+// Records the delivery settled
+func (batcher *ackBatcher) settle(tag uint64, acked bool) {
+	if tag < batcher.next {
+		return
+	}
+
+	batcher.settled[tag] = acked
+	batcher.advance()
+}
+
+// Advances next past tags settled out of order
+func (batcher *ackBatcher) advance() {
+	for {
+		acked, ok := batcher.settled[batcher.next]
+		if !ok {
+			return
+		}
+		delete(batcher.settled, batcher.next)
+		if acked {
+			batcher.ackable = batcher.next
+			batcher.pending++
+		}
+		batcher.next++
+	}
+}
+
+// Records all deliveries up to the tag settled by a multiple ack or nack
+func (batcher *ackBatcher) settleUpTo(tag uint64) {
+	for ; batcher.next <= tag; batcher.next++ {
+		delete(batcher.settled, batcher.next)
+	}
+	batcher.advance()
+}
+
+// Returns ack batchers of the consumers' channels (see AckBatchSize)
+func newAckBatchers(consumers []*queueConsumer, size int) map[amqp.Acknowledger]*ackBatcher {
+	batchers := make(map[amqp.Acknowledger]*ackBatcher, len(consumers))
+	for _, consumer := range consumers {
+		if consumer.channel != nil {
+			batchers[consumer.channel] = newAckBatcher(consumer.channel, size)
+		}
+	}
+	return batchers
+}
+
+// Flushes acks of all batchers
+func flushAcks(batchers map[amqp.Acknowledger]*ackBatcher) {
+	for _, batcher := range batchers {
+		if err := batcher.Flush(); err != nil {
+			log.Printf("Failed flushing acks. Error = %v", err)
+		}
+	}
+}
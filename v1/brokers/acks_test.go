@@ -0,0 +1,96 @@
+package brokers
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// tagAcknowledger records the tags of multiple acks and of nacks
+type tagAcknowledger struct {
+	acks, nacks []uint64
+}
+
+func (a *tagAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *tagAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacks = append(a.nacks, tag)
+	return nil
+}
+
+func (a *tagAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestAckBatcher(t *testing.T) {
+	acknowledger := new(tagAcknowledger)
+	batcher := newAckBatcher(acknowledger, 3)
+	for tag := uint64(1); tag <= 6; tag++ {
+		batcher.Deliver(tag)
+	}
+
+	// Deliveries 2 and 3 finish before 1, they can't be acked yet
+	batcher.Ack(2, false)
+	batcher.Ack(3, false)
+	if err := batcher.Flush(); err != nil || len(acknowledger.acks) != 0 {
+		t.Errorf("acks = %v, want none while 1 is processed", acknowledger.acks)
+	}
+
+	// Once 1 is acked, 3 deliveries can be acked
+	batcher.Ack(1, false)
+	if want := []uint64{3}; !reflect.DeepEqual(acknowledger.acks, want) {
+		t.Errorf("acks = %v, want %v", acknowledger.acks, want)
+	}
+
+	// Nacks go to the channel right away, the batch is acked up to the
+	// highest acked tag on the next flush
+	batcher.Ack(4, false)
+	batcher.Nack(5, false, true)
+	if want := []uint64{5}; !reflect.DeepEqual(acknowledger.nacks, want) {
+		t.Errorf("nacks = %v, want %v", acknowledger.nacks, want)
+	}
+	batcher.Flush()
+	if want := []uint64{3, 4}; !reflect.DeepEqual(acknowledger.acks, want) {
+		t.Errorf("acks = %v, want %v", acknowledger.acks, want)
+	}
+
+	// Nothing left to flush
+	batcher.Reject(6, false)
+	batcher.Flush()
+	if want := []uint64{3, 4}; !reflect.DeepEqual(acknowledger.acks, want) {
+		t.Errorf("acks = %v, want %v", acknowledger.acks, want)
+	}
+}
+
+func TestAckBatcherFlush(t *testing.T) {
+	acknowledger := new(tagAcknowledger)
+	batcher := newAckBatcher(acknowledger, 10)
+	batchers := map[amqp.Acknowledger]*ackBatcher{acknowledger: batcher}
+	for tag := uint64(1); tag <= 3; tag++ {
+		batcher.Deliver(tag)
+	}
+
+	// Settled out of order while 2 is processed
+	batcher.Ack(3, false)
+	batcher.Ack(1, false)
+	if len(acknowledger.acks) != 0 {
+		t.Errorf("acks = %v, want none before the batch is full", acknowledger.acks)
+	}
+
+	// The timer flushes up to the delivery being processed
+	flushAcks(batchers)
+	if want := []uint64{1}; !reflect.DeepEqual(acknowledger.acks, want) {
+		t.Errorf("acks = %v, want %v", acknowledger.acks, want)
+	}
+
+	// Once every delivery is settled, acks are flushed right away so the
+	// prefetch window doesn't stay full of acked deliveries
+	batcher.Ack(2, false)
+	if want := []uint64{1, 3}; !reflect.DeepEqual(acknowledger.acks, want) {
+		t.Errorf("acks = %v, want %v", acknowledger.acks, want)
+	}
+}
@@ -0,0 +1,45 @@
+package brokers
+
+// Action tells the broker what to do with a delivered message
+// once its task has been processed
+type Action int
+
+const (
+	// ActionAck - acknowledge the message (default)
+	ActionAck Action = iota
+	// ActionRequeue - return the message to the queue to be delivered again
+	ActionRequeue
+	// ActionDeadLetter - reject the message so it gets dead lettered (if configured)
+	ActionDeadLetter
+	// ActionRetryLater - republish the task with retry metadata
+	ActionRetryLater
+)
+
+// String returns a human readable name of the action
+func (action Action) String() string {
+	switch action {
+	case ActionAck:
+		return "Ack"
+	case ActionRequeue:
+		return "Requeue"
+	case ActionDeadLetter:
+		return "Dead Letter"
+	case ActionRetryLater:
+		return "Retry Later"
+	}
+	return "Unknown Action"
+}
+
+// Returns the action requested by the error, ActionAck by default
+func actionFor(err error) Action {
+	if actionError, ok := err.(*ActionError); ok {
+		return actionError.Action
+	}
+	if _, ok := err.(*StateNotStoredError); ok {
+		return ActionRequeue
+	}
+	if _, ok := err.(*PanicError); ok {
+		return ActionDeadLetter
+	}
+	return ActionAck
+}
@@ -1,22 +1,80 @@
 package brokers
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/RichardKnop/machinery/v1/backends"
 	"github.com/RichardKnop/machinery/v1/config"
 	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/RichardKnop/machinery/v1/utils"
 	"github.com/streadway/amqp"
 )
 
-// AMQPBroker represents an AMQP broker
+// RabbitMQ pseudo-queue for direct replies
+const directReplyTo = "amq.rabbitmq.reply-to"
+
+// Pause before requeueing tasks which would otherwise come right back,
+// e.g. tasks not accepted (see AcceptPredicate) or held without
+// HoldingQueue, a variable so tests can shorten it
+var requeueDelay = time.Second
+
+// Binding key of affinity queues to the consistent hash exchange, workers
+// get equal shares of the hash space
+const affinityWeight = "1"
+
+// AMQPBroker represents an AMQP broker. It runs one consumer at a time,
+// pushing to a TaskProcessor or pulled with Messages, as the consume
+// connection, the reorder buffer and the progress of in-flight messages
+// are kept per broker. Run further consumers on brokers of their own.
 type AMQPBroker struct {
-	config   *config.Config
-	conn     *amqp.Connection
-	channel  *amqp.Channel
-	queue    amqp.Queue
-	stopChan chan int
+	config         *config.Config
+	conn           *amqp.Connection
+	channel        *amqp.Channel
+	queue          amqp.Queue
+	stopChan       chan int
+	onFailure      func(err *HandlerError)
+	rawHandler     RawDeliveryHandler
+	publishMutex   sync.Mutex
+	publishConn    *amqp.Connection
+	publishChannel *amqp.Channel
+	templateOnce   sync.Once
+	routingKeyTmpl *template.Template
+	templateErr    error
+	consuming      sync.WaitGroup
+	schemaRegistry SchemaRegistry
+	errorRate      errorRate
+	heartbeatOnce  sync.Once
+	heartbeat      chan time.Time
+	onSaturated    func(stats ConsumerStats)
+	positionStore  backends.PositionStore
+	onDecoded      func(decoder string)
+	sequences      map[string]int64
+	sequencesMutex sync.Mutex
+	reorder        *reorderBuffer
+	ordering       sync.WaitGroup
+	exchanges      map[string]bool
+	progress       progress
+	states         map[string]*consumerState
+	statesMutex    sync.Mutex
+	featureGate    FeatureGate
+	latencies      latencies
+	onLatency      func(queue string, latency time.Duration)
+	outcomes       OutcomeRecorder
+	workerID       string
+	confirmChannel *amqp.Channel
+	confirms       chan amqp.Confirmation
+	claimed        int32
 }
 
 // NewAMQPBroker creates new AMQPConnection instance
@@ -29,21 +87,66 @@ func NewAMQPBroker(cnf *config.Config, stopChan chan int) Broker {
 
 // StartConsuming enters a loop and waits for incoming messages
 func (amqpBroker *AMQPBroker) StartConsuming(consumerTag string, taskProcessor TaskProcessor) (bool, error) {
+	if !amqpBroker.claim() {
+		return false, ErrAlreadyConsuming
+	}
+	defer amqpBroker.unclaim()
+
+	amqpBroker.consuming.Add(1)
+	defer amqpBroker.consuming.Done()
+
 	conn, channel, queue, err := open(amqpBroker.config)
 	if err != nil {
 		return true, err // retry true
 	}
 
-	defer close(channel, conn)
+	amqpBroker.setConsumeConnection(conn, channel, queue)
+	defer amqpBroker.setConsumeConnection(nil, nil, amqp.Queue{})
 
-	if err := channel.Qos(
-		3,     // prefetch count
-		0,     // prefetch size
-		false, // global
-	); err != nil {
+	state := amqpBroker.consumerState(consumerTag)
+	state.connect()
+	defer state.disconnect()
+
+	defer closeConn(channel, conn)
+
+	prefetchCount := amqpBroker.config.PrefetchCount
+	if prefetchCount == 0 {
+		prefetchCount = 3
+	}
+
+	// Start with a small prefetch and ramp it up to smooth
+	// the load spike while the worker is warming up
+	rampDuration := time.Duration(amqpBroker.config.PrefetchRampDuration) * time.Second
+	initialPrefetchCount := prefetchCount
+	if rampDuration > 0 {
+		initialPrefetchCount = 1
+	}
+
+	prefetch := newPrefetchController(channel, prefetchCount)
+	if _, err := prefetch.setRamp(initialPrefetchCount); err != nil {
 		return false, fmt.Errorf("Channel Qos: %s", err)
 	}
 
+	if initialPrefetchCount < prefetchCount {
+		stopRamp := make(chan int, 1)
+		defer func() { stopRamp <- 1 }()
+		go rampPrefetch(prefetch, initialPrefetchCount, prefetchCount, rampDuration, stopRamp)
+	}
+
+	// Resume the stream after the last position of the consumer group
+	var consumeArgs amqp.Table
+	var positions *positionTracker
+	if amqpBroker.tracksPositions() {
+		position, ok, err := amqpBroker.positionStore.GetPosition(amqpBroker.positionKey(queue))
+		if err != nil {
+			return true, fmt.Errorf("Get Position: %s", err) // retry true
+		}
+		if ok {
+			consumeArgs = amqp.Table{streamOffsetHeader: position + 1}
+		}
+		positions = newPositionTracker()
+	}
+
 	deliveries, err := channel.Consume(
 		queue.Name,  // queue
 		consumerTag, // consumer tag
@@ -51,15 +154,86 @@ func (amqpBroker *AMQPBroker) StartConsuming(consumerTag string, taskProcessor T
 		false,       // exclusive
 		false,       // no-local
 		false,       // no-wait
-		nil,         // arguments
+		consumeArgs, // arguments
 	)
 	if err != nil {
 		return false, fmt.Errorf("Queue Consume: %s", err)
 	}
 
+	minWorkers, maxWorkers := workerLimits(amqpBroker.config.MinWorkers, amqpBroker.config.MaxWorkers)
+	consumers := []*queueConsumer{&queueConsumer{
+		channel:       channel,
+		queue:         queue,
+		deliveries:    deliveries,
+		prefetchCount: prefetchCount,
+		prefetch:      prefetch,
+		minWorkers:    minWorkers,
+		maxWorkers:    maxWorkers,
+		weight:        amqpBroker.config.DefaultQueueWeight,
+		positions:     positions,
+	}}
+
+	// Additional queues are consumed on dedicated channels so that
+	// a slow class of tasks does not block the others
+	for _, consumedQueue := range amqpBroker.config.Queues {
+		consumer, err := consumeQueue(conn, consumerTag, consumedQueue)
+		if err != nil {
+			return true, err // retry true
+		}
+		defer consumer.channel.Close()
+
+		consumers = append(consumers, consumer)
+	}
+
+	// Tasks whose affinity key hashes to this worker wait in its own queue,
+	// unbound once consuming stops so new ones go to the other workers
+	if amqpBroker.config.AffinityExchange != "" {
+		affinityQueue, err := declareAffinityQueue(channel, amqpBroker.config, consumerTag)
+		if err != nil {
+			return true, err // retry true
+		}
+		defer channel.QueueUnbind(
+			affinityQueue,                      // name of the queue
+			affinityWeight,                     // binding key
+			amqpBroker.config.AffinityExchange, // source exchange
+			nil,                                // arguments
+		)
+
+		consumer, err := consumeQueue(conn, consumerTag, config.ConsumedQueue{Name: affinityQueue})
+		if err != nil {
+			return true, err // retry true
+		}
+		defer consumer.channel.Close()
+
+		consumers = append(consumers, consumer)
+	}
+
+	// Producers not migrated yet publish to the legacy queue through the
+	// default exchange, consume it alongside until they all are
+	if legacyQueue := amqpBroker.config.LegacyQueue; legacyQueue != "" && legacyQueue != queue.Name {
+		if _, err := channel.QueueDeclare(
+			legacyQueue, // name
+			true,        // durable
+			false,       // delete when unused
+			false,       // exclusive
+			false,       // noWait
+			nil,         // arguments
+		); err != nil {
+			return true, fmt.Errorf("Legacy Queue Declare: %s", err) // retry true
+		}
+
+		consumer, err := consumeQueue(conn, consumerTag, config.ConsumedQueue{Name: legacyQueue})
+		if err != nil {
+			return true, err // retry true
+		}
+		defer consumer.channel.Close()
+
+		consumers = append(consumers, consumer)
+	}
+
 	log.Print("[*] Waiting for messages. To exit press CTRL+C")
 
-	if err := amqpBroker.consume(deliveries, taskProcessor); err != nil {
+	if err := amqpBroker.consume(consumers, consumerTag, taskProcessor); err != nil {
 		return true, err // retry true
 	}
 
@@ -68,129 +242,2331 @@ func (amqpBroker *AMQPBroker) StartConsuming(consumerTag string, taskProcessor T
 
 // StopConsuming quits the loop
 func (amqpBroker *AMQPBroker) StopConsuming() {
-	// Notifying the quit channel stops consuming of messages
-	amqpBroker.stopChan <- 1
+	// Notifying the quit channel stops consuming of messages. Never block,
+	// StartConsuming might not be running to receive. A buffered channel
+	// keeps the signal until consuming starts, otherwise it is dropped.
+	select {
+	case amqpBroker.stopChan <- 1:
+	default:
+	}
+}
+
+// SetOnFailure sets a hook called whenever processing of a delivered task fails
+func (amqpBroker *AMQPBroker) SetOnFailure(hook func(err *HandlerError)) {
+	amqpBroker.onFailure = hook
+}
+
+// SetOnSaturated sets a hook called when the consumer becomes saturated,
+// i.e. no processing slot has been idle for SaturationWindow, and again
+// when it stops being saturated, e.g. to emit an autoscaling event
+func (amqpBroker *AMQPBroker) SetOnSaturated(hook func(stats ConsumerStats)) {
+	amqpBroker.onSaturated = hook
+}
+
+// SetOnDecoded sets a hook called with the name of the decoder which
+// decoded a consumed task (see Decoders), e.g. to count messages still
+// in an old serialization format during a migration
+func (amqpBroker *AMQPBroker) SetOnDecoded(hook func(decoder string)) {
+	amqpBroker.onDecoded = hook
+}
+
+// SetOnLatency sets a hook called with the queue and latency of each
+// processed task, from the time it was published until it was processed,
+// e.g. to observe a Prometheus summary or histogram labeled by queue
+func (amqpBroker *AMQPBroker) SetOnLatency(hook func(queue string, latency time.Duration)) {
+	amqpBroker.onLatency = hook
+}
+
+// SetOutcomeRecorder sets a recorder receiving a structured record of
+// every consumed task once its message has been disposed of, stamped with
+// the worker ID
+func (amqpBroker *AMQPBroker) SetOutcomeRecorder(recorder OutcomeRecorder, workerID string) {
+	amqpBroker.outcomes = recorder
+	amqpBroker.workerID = workerID
+}
+
+// SetRawDeliveryHandler sets a handler which receives raw deliveries before
+// they are decoded. The handler is responsible for acking / nacking them.
+// It can return ErrNotHandled to let the delivery be processed as a task,
+// e.g. when foreign message formats share the queue with tasks.
+func (amqpBroker *AMQPBroker) SetRawDeliveryHandler(handler RawDeliveryHandler) {
+	amqpBroker.rawHandler = handler
+}
+
+// SetPositionStore sets a store the consume position of the default queue
+// is persisted to, if it is a stream (see StreamQueue and ConsumerGroup).
+// Consuming resumes after the stored position.
+func (amqpBroker *AMQPBroker) SetPositionStore(positionStore backends.PositionStore) {
+	amqpBroker.positionStore = positionStore
+}
+
+// SetSchemaRegistry sets a registry published tasks are validated against.
+// Consumed tasks incompatible with the registry are rejected so they get
+// dead lettered (if configured).
+func (amqpBroker *AMQPBroker) SetSchemaRegistry(schemaRegistry SchemaRegistry) {
+	amqpBroker.schemaRegistry = schemaRegistry
+}
+
+// SetFeatureGate sets a gate consulted for every consumed task. Tasks of
+// types switched off are held in HoldingQueue, or requeued if not set,
+// until switched on again.
+func (amqpBroker *AMQPBroker) SetFeatureGate(featureGate FeatureGate) {
+	amqpBroker.featureGate = featureGate
 }
 
-// Publish places a new message on the default queue
+// Publish places a new message on the default queue. Returns ErrQueueFull
+// if the queue rejected it (see OverflowBehavior).
 func (amqpBroker *AMQPBroker) Publish(signature *signatures.TaskSignature) error {
-	conn, channel, _, err := open(amqpBroker.config)
+	publishing, err := amqpBroker.prepare(signature)
 	if err != nil {
 		return err
 	}
 
-	defer close(channel, conn)
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
 
-	message, err := json.Marshal(signature)
+	// Full queues reject messages by nacking their confirmation
+	rejectsPublishes := amqpBroker.rejectsPublishes()
+	var channel *amqp.Channel
+	if rejectsPublishes {
+		channel, err = amqpBroker.getConfirmChannel()
+	} else {
+		channel, err = amqpBroker.getPublishChannel()
+	}
 	if err != nil {
-		return fmt.Errorf("JSON Encode Message: %v", err)
+		return err
 	}
 
-	signature.AdjustRoutingKey(
-		amqpBroker.config.ExchangeType,
-		amqpBroker.config.BindingKey,
-		amqpBroker.config.DefaultQueue,
-	)
-	return channel.Publish(
-		amqpBroker.config.Exchange, // exchange
-		signature.RoutingKey,       // routing key
-		false,                      // mandatory
-		false,                      // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         message,
-			DeliveryMode: amqp.Persistent,
-		},
-	)
+	exchange, routingKey := amqpBroker.route(signature)
+	if err := amqpBroker.checkExchange(exchange); err != nil {
+		return err
+	}
+
+	if err := channel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		publishing,
+	); err != nil {
+		// The channel is most likely dead, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: err}
+	}
+
+	if rejectsPublishes {
+		return amqpBroker.waitConfirm()
+	}
+	return nil
 }
 
-// Consumes messages
-func (amqpBroker *AMQPBroker) consume(deliveries <-chan amqp.Delivery, taskProcessor TaskProcessor) error {
-	consumeOne := func(d amqp.Delivery) error {
-		log.Printf("Received new message: %s", d.Body)
+// PublishWithResult publishes the signature on a dedicated channel in
+// confirm mode and waits for the broker to confirm it. The result tells
+// exactly where the message went and how big it was, e.g. to log enqueues
+// and spot routing keys resolved differently than expected. An error is
+// only returned when the signature could not be published at all.
+func (amqpBroker *AMQPBroker) PublishWithResult(signature *signatures.TaskSignature) (*PublishResult, error) {
+	if signature.UUID == "" {
+		signature.UUID = uuid.New()
+	}
 
-		signature := signatures.TaskSignature{}
-		if err := json.Unmarshal(d.Body, &signature); err != nil {
-			d.Nack(false, false) // multiple, requeue both false
-			return err
+	publishing, err := amqpBroker.prepare(signature)
+	if err != nil {
+		return nil, err
+	}
+	publishing.MessageId = signature.UUID
+
+	exchange, routingKey := amqpBroker.route(signature)
+	if err := amqpBroker.verifyExchange(exchange); err != nil {
+		return nil, err
+	}
+
+	channel, err := amqpBroker.openConfirmChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	if err := channel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		publishing,
+	); err != nil {
+		return nil, err
+	}
+
+	confirmation, ok := <-confirmations
+	return &PublishResult{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		BodySize:   len(publishing.Body),
+		MessageID:  publishing.MessageId,
+		Confirmed:  ok && confirmation.Ack,
+	}, nil
+}
+
+// PublishBatch publishes the signatures on a dedicated channel in confirm
+// mode and waits for the broker to confirm them. The result tells exactly
+// which signatures were confirmed and which were not, so only failed ones
+// need to be published again. An error is only returned when the batch
+// could not be published at all.
+func (amqpBroker *AMQPBroker) PublishBatch(batch []*signatures.TaskSignature) (*BatchPublishResult, error) {
+	channel, err := amqpBroker.openConfirmChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation, len(batch)))
+
+	// Delivery tags are assigned sequentially starting from 1
+	result := new(BatchPublishResult)
+	published := make(map[uint64]int)
+	var deliveryTag uint64
+	for i, signature := range batch {
+		publishing, err := amqpBroker.prepare(signature)
+		if err != nil {
+			log.Printf("Failed publishing batch signature %d. Error = %v", i, err)
+			result.Nacked = append(result.Nacked, i)
+			continue
 		}
 
-		d.Ack(false) // multiple false
+		exchange, routingKey := amqpBroker.route(signature)
+		if err := amqpBroker.verifyExchange(exchange); err != nil {
+			log.Printf("Failed publishing batch signature %d. Error = %v", i, err)
+			result.Nacked = append(result.Nacked, i)
+			continue
+		}
+
+		if err := channel.Publish(
+			exchange,   // exchange
+			routingKey, // routing key
+			false,      // mandatory
+			false,      // immediate
+			publishing,
+		); err != nil {
+			// The channel is dead, the rest of the batch cannot be published
+			log.Printf("Failed publishing batch signature %d. Error = %v", i, err)
+			for j := i; j < len(batch); j++ {
+				result.Nacked = append(result.Nacked, j)
+			}
+			break
+		}
 
-		taskProcessor.Process(&signature)
+		deliveryTag++
+		published[deliveryTag] = i
+	}
 
-		return nil
+	collectConfirmations(published, confirmations, result)
+	return result, nil
+}
+
+// Waits for confirmations of published messages, if the channel closes
+// first, the outcome of the remaining messages is unknown
+func collectConfirmations(published map[uint64]int, confirmations <-chan amqp.Confirmation, result *BatchPublishResult) {
+	for len(published) > 0 {
+		confirmation, ok := <-confirmations
+		if !ok {
+			break
+		}
+
+		i, ok := published[confirmation.DeliveryTag]
+		if !ok {
+			continue
+		}
+		delete(published, confirmation.DeliveryTag)
+
+		if confirmation.Ack {
+			result.Confirmed = append(result.Confirmed, i)
+		} else {
+			result.Nacked = append(result.Nacked, i)
+		}
+	}
+
+	for _, i := range published {
+		result.Unconfirmed = append(result.Unconfirmed, i)
+	}
+
+	sort.Ints(result.Confirmed)
+	sort.Ints(result.Nacked)
+	sort.Ints(result.Unconfirmed)
+}
+
+// Validates, encrypts and encodes the signature and sets its routing key
+func (amqpBroker *AMQPBroker) prepare(signature *signatures.TaskSignature) (amqp.Publishing, error) {
+	if err := transformOutbound(signature); err != nil {
+		return amqp.Publishing{}, fmt.Errorf("Transform: %v", err)
+	}
+
+	if amqpBroker.schemaRegistry != nil {
+		version, err := amqpBroker.schemaRegistry.Validate(signature)
+		if err != nil {
+			return amqp.Publishing{}, fmt.Errorf("Schema Validate: %v", err)
+		}
+
+		if signature.Headers == nil {
+			signature.Headers = make(map[string]interface{})
+		}
+		signature.Headers[signatures.SchemaVersionHeader] = version
+	}
+
+	// Declare the format version when upgraders are in use
+	if current := currentFormatVersion(); current > 1 {
+		if _, ok := signature.Headers[signatures.FormatVersionHeader]; !ok {
+			if signature.Headers == nil {
+				signature.Headers = make(map[string]interface{})
+			}
+			signature.Headers[signatures.FormatVersionHeader] = current
+		}
+	}
+
+	// Mark tasks which expire in the queue, so their dead letters can
+	// be told apart from those of tasks expired by MessageTTL
+	var expiration string
+	if signature.MaxQueueWait > 0 {
+		maxQueueWait := int64(signature.MaxQueueWait / time.Millisecond)
+		if signature.Headers == nil {
+			signature.Headers = make(map[string]interface{})
+		}
+		signature.Headers[signatures.MaxQueueWaitHeader] = maxQueueWait
+		expiration = strconv.FormatInt(maxQueueWait, 10)
 	}
 
+	// Only sensitive args are encrypted, the rest stays inspectable
+	encrypted, err := signature.EncryptArgs(amqpBroker.config.Encryptor)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("Encrypt Args: %v", err)
+	}
+
+	message, err := json.Marshal(encrypted)
+	if err != nil {
+		return amqp.Publishing{}, fmt.Errorf("JSON Encode Message: %v", err)
+	}
+
+	if err := amqpBroker.adjustRoutingKey(signature); err != nil {
+		return amqp.Publishing{}, err
+	}
+
+	// Stamp the publish order so consumers can restore it
+	if amqpBroker.config.SequencePublishes {
+		if signature.Headers == nil {
+			signature.Headers = make(map[string]interface{})
+		}
+		signature.Headers[signatures.SequenceHeader] = amqpBroker.nextSequence(signature.RoutingKey)
+	}
+
+	// Sign the body so consumers can verify who published it
+	if amqpBroker.config.Signer != nil {
+		messageSignature, err := amqpBroker.config.Signer.Sign(message)
+		if err != nil {
+			return amqp.Publishing{}, fmt.Errorf("Sign: %v", err)
+		}
+		if signature.Headers == nil {
+			signature.Headers = make(map[string]interface{})
+		}
+		signature.Headers[signatures.MessageSignatureHeader] = messageSignature
+	}
+
+	return amqp.Publishing{
+		Headers:      amqp.Table(signature.Headers),
+		ContentType:  "application/json",
+		Body:         message,
+		DeliveryMode: amqp.Persistent,
+		Priority:     signature.Priority,
+		Expiration:   expiration,
+		Timestamp:    time.Now(),
+	}, nil
+}
+
+// PublishAndWait publishes the signature and waits for the worker to reply
+// with the final task state. Replies use RabbitMQ direct reply-to, so
+// no reply queue is declared per request.
+func (amqpBroker *AMQPBroker) PublishAndWait(signature *signatures.TaskSignature, timeout time.Duration) (*backends.TaskState, error) {
+	if signature.UUID == "" {
+		signature.UUID = uuid.New()
+	}
+
+	publishing, err := amqpBroker.prepare(signature)
+	if err != nil {
+		return nil, err
+	}
+	publishing.ReplyTo = directReplyTo
+	publishing.CorrelationId = signature.UUID
+
+	exchange, routingKey := amqpBroker.route(signature)
+	if err := amqpBroker.verifyExchange(exchange); err != nil {
+		return nil, err
+	}
+
+	channel, err := amqpBroker.openChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+
+	// Must consume the pseudo-queue before publishing on the same channel
+	replies, err := channel.Consume(
+		directReplyTo, // queue
+		"",            // consumer tag
+		true,          // auto-ack
+		false,         // exclusive
+		false,         // no-local
+		false,         // no-wait
+		nil,           // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Queue Consume: %s", err)
+	}
+
+	if err := channel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		publishing,
+	); err != nil {
+		return nil, err
+	}
+
+	timeoutExceeded := time.After(timeout)
 	for {
 		select {
-		case d := <-deliveries:
-			if err := consumeOne(d); err != nil {
-				return err
+		case d, ok := <-replies:
+			if !ok {
+				return nil, errors.New("Reply channel closed")
 			}
-		case <-amqpBroker.stopChan:
-			return nil
+			if d.CorrelationId != signature.UUID {
+				continue // a late reply to a previous request
+			}
+
+			taskState := new(backends.TaskState)
+			if err := json.Unmarshal(d.Body, taskState); err != nil {
+				return nil, fmt.Errorf("JSON Decode Reply: %v", err)
+			}
+			return taskState, nil
+		case <-timeoutExceeded:
+			return nil, ErrReplyTimeout
 		}
 	}
 }
 
-// Connects to the message queue, opens a channel, declares a queue
-func open(cnf *config.Config) (*amqp.Connection, *amqp.Channel, amqp.Queue, error) {
-	var conn *amqp.Connection
-	var channel *amqp.Channel
-	var queue amqp.Queue
-	var err error
+// PublishReply sends a reply to the requester which published a task with
+// ReplyTo set. The reply is encoded to match the request's content type,
+// see RegisterReplyEncoder.
+func (amqpBroker *AMQPBroker) PublishReply(replyTo, correlationID, contentType string, reply interface{}) error {
+	contentType, encode := replyEncoder(contentType)
+	message, err := encode(reply)
+	if err != nil {
+		return fmt.Errorf("Encode Reply: %v", err)
+	}
 
-	conn, err = amqp.Dial(cnf.Broker)
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	channel, err := amqpBroker.getPublishChannel()
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Dial: %s", err)
+		return err
 	}
 
-	channel, err = conn.Channel()
+	if err := channel.Publish(
+		"",      // default exchange
+		replyTo, // routing key
+		false,   // mandatory
+		false,   // immediate
+		amqp.Publishing{
+			ContentType:   contentType,
+			CorrelationId: correlationID,
+			Body:          message,
+		},
+	); err != nil {
+		// The channel is most likely dead, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: err}
+	}
+
+	return nil
+}
+
+// PublishAuditEvent places a JSON encoded task event on the audit exchange
+func (amqpBroker *AMQPBroker) PublishAuditEvent(routingKey string, event interface{}) error {
+	message, err := json.Marshal(event)
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Channel: %s", err)
+		return fmt.Errorf("JSON Encode Event: %v", err)
 	}
 
-	if err := channel.ExchangeDeclare(
-		cnf.Exchange,     // name of the exchange
-		cnf.ExchangeType, // type
-		true,             // durable
-		false,            // delete when complete
-		false,            // internal
-		false,            // noWait
-		nil,              // arguments
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	channel, err := amqpBroker.getPublishChannel()
+	if err != nil {
+		return err
+	}
+
+	if err := channel.Publish(
+		amqpBroker.config.AuditExchange, // exchange
+		routingKey,                      // routing key
+		false,                           // mandatory
+		false,                           // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         message,
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+		},
 	); err != nil {
-		return conn, channel, queue, fmt.Errorf("Exchange: %s", err)
+		// The channel is most likely dead, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: err}
 	}
 
-	queue, err = channel.QueueDeclare(
-		cnf.DefaultQueue, // name
-		true,             // durable
-		false,            // delete when unused
-		false,            // exclusive
-		false,            // no-wait
-		nil,              // arguments
-	)
+	return nil
+}
+
+// Places a JSON encoded panic report on the panic queue
+func (amqpBroker *AMQPBroker) publishPanicReport(report *PanicReport) error {
+	message, err := json.Marshal(report)
 	if err != nil {
-		return conn, channel, queue, fmt.Errorf("Queue Declare: %s", err)
+		return fmt.Errorf("JSON Encode Panic Report: %v", err)
 	}
 
-	if err := channel.QueueBind(
-		queue.Name,     // name of the queue
-		cnf.BindingKey, // binding key
-		cnf.Exchange,   // source exchange
-		false,          // noWait
-		nil,            // arguments
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	channel, err := amqpBroker.getPublishChannel()
+	if err != nil {
+		return err
+	}
+
+	if err := channel.Publish(
+		"",                           // default exchange
+		amqpBroker.config.PanicQueue, // routing key
+		false,                        // mandatory
+		false,                        // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         message,
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+		},
 	); err != nil {
-		return conn, channel, queue, fmt.Errorf("Queue Bind: %s", err)
+		// The channel is most likely dead, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: err}
 	}
 
-	return conn, channel, queue, nil
+	return nil
 }
 
-// Closes the connection
-func close(channel *amqp.Channel, conn *amqp.Connection) error {
+// PublishRetry places a failed task on RetryQueue, where it waits for
+// the delay before it is dead lettered back to the default queue. The
+// time the retry is due is recorded in headers, so scheduled retries
+// can be inspected by browsing the retry queue.
+func (amqpBroker *AMQPBroker) PublishRetry(signature *signatures.TaskSignature, delay time.Duration) error {
+	if signature.Headers == nil {
+		signature.Headers = make(map[string]interface{})
+	}
+	signature.Headers[signatures.RetryAtHeader] = time.Now().Add(delay).UTC().Format(time.RFC3339)
+
+	publishing, err := amqpBroker.prepare(signature)
+	if err != nil {
+		return err
+	}
+
+	// The message expires in the retry queue once due, MaxQueueWait
+	// doesn't apply as the expiry is no missed deadline
+	delete(publishing.Headers, signatures.MaxQueueWaitHeader)
+	publishing.Expiration = strconv.FormatInt(int64(delay/time.Millisecond), 10)
+
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	channel, err := amqpBroker.getPublishChannel()
+	if err != nil {
+		return err
+	}
+
+	if err := channel.Publish(
+		"",                           // default exchange
+		amqpBroker.config.RetryQueue, // routing key
+		false,                        // mandatory
+		false,                        // immediate
+		publishing,
+	); err != nil {
+		// The channel is most likely dead, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: err}
+	}
+
+	return nil
+}
+
+// Returns the exchange and routing key the task is published with. Tasks
+// with an affinity key go to the affinity exchange, which hashes the key
+// to pick a worker. Tasks resolved to a queue (see QueueResolver) go
+// straight to it through the default exchange.
+func (amqpBroker *AMQPBroker) route(signature *signatures.TaskSignature) (string, string) {
+	if signature.AffinityKey != "" && amqpBroker.config.AffinityExchange != "" {
+		return amqpBroker.config.AffinityExchange, signature.AffinityKey
+	}
+	if queue := amqpBroker.resolveQueue(signature); queue != "" {
+		return "", queue // the default exchange routes to the queue by name
+	}
+	return amqpBroker.config.Exchange, signature.RoutingKey
+}
+
+// Makes sure the exchange exists before publishing to it. Publishing to
+// a missing exchange would lose the message and close the channel, only
+// failing the next operation. Exchanges are checked once per connection.
+// Must be called with publishMutex held and the publish channel open.
+func (amqpBroker *AMQPBroker) checkExchange(exchange string) error {
+	if exchange == "" || amqpBroker.exchanges[exchange] {
+		return nil // the default exchange always exists
+	}
+
+	conn := amqpBroker.publishConn
+	if conn == nil {
+		conn = amqpBroker.conn // shared connection
+	}
+
+	// A failed check closes the channel, don't use the publish channel
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("Channel: %s", err)
+	}
+	defer channel.Close()
+
+	if err := channel.ExchangeDeclarePassive(
+		exchange,                       // name of the exchange
+		amqpBroker.config.ExchangeType, // type
+		true,                           // durable
+		false,                          // delete when complete
+		false,                          // internal
+		false,                          // noWait
+		nil,                            // arguments
+	); err != nil {
+		if amqpError, ok := err.(*amqp.Error); ok && amqpError.Code == amqp.NotFound {
+			log.Printf("Exchange %s not found", exchange)
+			return ErrExchangeNotFound
+		}
+		return fmt.Errorf("Exchange Declare Passive: %s", err)
+	}
+
+	if amqpBroker.exchanges == nil {
+		amqpBroker.exchanges = make(map[string]bool)
+	}
+	amqpBroker.exchanges[exchange] = true
+	return nil
+}
+
+// Checks the exchange exists before publishing on a dedicated channel
+func (amqpBroker *AMQPBroker) verifyExchange(exchange string) error {
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	if _, err := amqpBroker.getPublishChannel(); err != nil {
+		return err
+	}
+	return amqpBroker.checkExchange(exchange)
+}
+
+// Returns the next publish sequence number of the routing key
+func (amqpBroker *AMQPBroker) nextSequence(routingKey string) int64 {
+	amqpBroker.sequencesMutex.Lock()
+	defer amqpBroker.sequencesMutex.Unlock()
+
+	if amqpBroker.sequences == nil {
+		amqpBroker.sequences = make(map[string]int64)
+	}
+	amqpBroker.sequences[routingKey]++
+	return amqpBroker.sequences[routingKey]
+}
+
+// Makes sure the routing key is set. Unless the signature specifies one,
+// it is rendered from RoutingKeyTemplate if configured.
+func (amqpBroker *AMQPBroker) adjustRoutingKey(signature *signatures.TaskSignature) error {
+	if queue := amqpBroker.resolveQueue(signature); queue != "" {
+		signature.RoutingKey = queue
+		return nil
+	}
+
+	if signature.RoutingKey != "" || amqpBroker.config.RoutingKeyTemplate == "" {
+		signature.AdjustRoutingKey(
+			amqpBroker.config.ExchangeType,
+			amqpBroker.config.BindingKey,
+			amqpBroker.config.DefaultQueue,
+		)
+		return nil
+	}
+
+	amqpBroker.templateOnce.Do(func() {
+		amqpBroker.routingKeyTmpl, amqpBroker.templateErr = template.New("routing_key").Parse(
+			amqpBroker.config.RoutingKeyTemplate,
+		)
+	})
+	if amqpBroker.templateErr != nil {
+		return fmt.Errorf("Routing Key Template: %v", amqpBroker.templateErr)
+	}
+
+	var routingKey bytes.Buffer
+	if err := amqpBroker.routingKeyTmpl.Execute(&routingKey, signature); err != nil {
+		return fmt.Errorf("Routing Key Template: %v", err)
+	}
+	signature.RoutingKey = routingKey.String()
+
+	return nil
+}
+
+// Returns the queue the task is published to according to QueueResolver,
+// or an empty string if it isn't resolved
+func (amqpBroker *AMQPBroker) resolveQueue(signature *signatures.TaskSignature) string {
+	if amqpBroker.config.QueueResolver == nil {
+		return ""
+	}
+	return amqpBroker.config.QueueResolver(signature)
+}
+
+// Close closes the cached publish connection. If the broker is consuming,
+// it first waits for in-flight messages to be processed (up to
+// FlushTimeout) so that their audit events, retries and failure hooks
+// are not lost. Call StopConsuming before closing the broker.
+func (amqpBroker *AMQPBroker) Close() error {
+	amqpBroker.waitConsuming()
+
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	return amqpBroker.closePublishConnection()
+}
+
+// Waits for the consumer to stop, at most FlushTimeout
+func (amqpBroker *AMQPBroker) waitConsuming() {
+	flushTimeout := amqpBroker.config.FlushTimeout
+	if flushTimeout == 0 {
+		flushTimeout = 10 // wait up to 10 seconds by default
+	}
+
+	if !amqpBroker.WaitConsuming(time.Duration(flushTimeout) * time.Second) {
+		log.Printf("Closing after waiting %vs for in-flight messages", flushTimeout)
+	}
+}
+
+// WaitConsuming waits for StartConsuming to return once consuming has been
+// stopped, i.e. for messages being processed to be processed, at most for
+// the timeout. Returns false if it timed out.
+func (amqpBroker *AMQPBroker) WaitConsuming(timeout time.Duration) bool {
+	stopped := make(chan int, 1)
+	go func() {
+		amqpBroker.consuming.Wait()
+		stopped <- 1
+	}()
+
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// AbortConsuming stops consuming without waiting for messages being
+// processed. The connection is closed, so the broker requeues unacked
+// messages right away, acks of messages processed meanwhile fail.
+func (amqpBroker *AMQPBroker) AbortConsuming() {
+	amqpBroker.StopConsuming()
+
+	amqpBroker.publishMutex.Lock()
+	conn := amqpBroker.conn
+	amqpBroker.publishMutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Returns the cached publish channel, opening it first if needed. Unless
+// SharedConnection is enabled, publishing uses a dedicated connection so
+// flow control or channel errors on the consuming side don't stall it.
+// Must be called with publishMutex held.
+func (amqpBroker *AMQPBroker) getPublishChannel() (*amqp.Channel, error) {
+	if amqpBroker.publishChannel != nil {
+		return amqpBroker.publishChannel, nil
+	}
+
+	if amqpBroker.config.SharedConnection && amqpBroker.conn != nil {
+		channel, err := amqpBroker.conn.Channel()
+		if err != nil {
+			return nil, &ConnectionError{Err: fmt.Errorf("Channel: %s", err)}
+		}
+		amqpBroker.publishChannel = channel
+		return channel, nil
+	}
+
+	conn, channel, _, err := open(amqpBroker.config)
+	if err != nil {
+		return nil, &ConnectionError{Err: err}
+	}
+	amqpBroker.publishConn = conn
+	amqpBroker.publishChannel = channel
+	return channel, nil
+}
+
+// Opens a new channel on the publish connection
+func (amqpBroker *AMQPBroker) openChannel() (*amqp.Channel, error) {
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	if _, err := amqpBroker.getPublishChannel(); err != nil {
+		return nil, err
+	}
+
+	conn := amqpBroker.publishConn
+	if conn == nil {
+		conn = amqpBroker.conn // shared connection
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	return channel, nil
+}
+
+// Opens a new channel in confirm mode on the publish connection
+func (amqpBroker *AMQPBroker) openConfirmChannel() (*amqp.Channel, error) {
+	channel, err := amqpBroker.openChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := channel.Confirm(
+		false, // noWait
+	); err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("Channel Confirm: %s", err)
+	}
+
+	return channel, nil
+}
+
+// Returns whether full queues reject published messages
+func (amqpBroker *AMQPBroker) rejectsPublishes() bool {
+	overflow := amqpBroker.config.OverflowBehavior
+	return amqpBroker.config.MaxQueueLength > 0 && (overflow == "reject-publish" || overflow == "reject-publish-dlx")
+}
+
+// Returns the cached channel in confirm mode Publish uses when full queues
+// reject messages, opened on the publish connection. Must be called with
+// publishMutex held.
+func (amqpBroker *AMQPBroker) getConfirmChannel() (*amqp.Channel, error) {
+	if amqpBroker.confirmChannel != nil {
+		return amqpBroker.confirmChannel, nil
+	}
+
+	if _, err := amqpBroker.getPublishChannel(); err != nil {
+		return nil, err
+	}
+
+	conn := amqpBroker.publishConn
+	if conn == nil {
+		conn = amqpBroker.conn // shared connection
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, &ConnectionError{Err: fmt.Errorf("Channel: %s", err)}
+	}
+	if err := channel.Confirm(
+		false, // noWait
+	); err != nil {
+		channel.Close()
+		return nil, &ConnectionError{Err: fmt.Errorf("Channel Confirm: %s", err)}
+	}
+
+	amqpBroker.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	amqpBroker.confirmChannel = channel
+	return channel, nil
+}
+
+// Waits for the confirmation of the message just published on the confirm
+// channel. Must be called with publishMutex held.
+func (amqpBroker *AMQPBroker) waitConfirm() error {
+	confirmation, ok := <-amqpBroker.confirms
+	if !ok {
+		// The channel died, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: errors.New("Channel closed before the message was confirmed")}
+	}
+	if !confirmation.Ack {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Must be called with publishMutex held
+func (amqpBroker *AMQPBroker) closePublishConnection() error {
+	if amqpBroker.confirmChannel != nil {
+		amqpBroker.confirmChannel.Close()
+		amqpBroker.confirmChannel = nil
+		amqpBroker.confirms = nil
+	}
+
+	if amqpBroker.publishChannel == nil {
+		return nil
+	}
+
+	var err error
+	if amqpBroker.publishConn != nil {
+		err = closeConn(amqpBroker.publishChannel, amqpBroker.publishConn)
+	} else {
+		// Channel opened on the shared consume connection
+		err = amqpBroker.publishChannel.Close()
+	}
+
+	amqpBroker.publishConn = nil
+	amqpBroker.publishChannel = nil
+	amqpBroker.exchanges = nil
+	return err
+}
+
+// Claims the broker for a consumer, false if another consumer is running
+func (amqpBroker *AMQPBroker) claim() bool {
+	return atomic.CompareAndSwapInt32(&amqpBroker.claimed, 0, 1)
+}
+
+// Releases the broker once the consumer stopped
+func (amqpBroker *AMQPBroker) unclaim() {
+	atomic.StoreInt32(&amqpBroker.claimed, 0)
+}
+
+// Keeps track of the consume connection so it can be shared with publishing
+func (amqpBroker *AMQPBroker) setConsumeConnection(conn *amqp.Connection, channel *amqp.Channel, queue amqp.Queue) {
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	// A publish channel on the shared connection dies together with it
+	if conn == nil && amqpBroker.publishConn == nil {
+		amqpBroker.publishChannel = nil
+		amqpBroker.confirmChannel = nil
+		amqpBroker.confirms = nil
+	}
+
+	amqpBroker.conn = conn
+	amqpBroker.channel = channel
+	amqpBroker.queue = queue
+}
+
+// GetQueue returns the queue as declared by the running consumer, i.e. its
+// actual name (server-assigned if DefaultQueue is empty) and message and
+// consumer counts at the time of declaration. Returns an empty queue
+// when not consuming.
+func (amqpBroker *AMQPBroker) GetQueue() amqp.Queue {
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	return amqpBroker.queue
+}
+
+// Heartbeat returns a channel receiving the time whenever the consume loop
+// completes an iteration, at least every HeartbeatInterval while it runs.
+// A watchdog can restart the process when no heartbeat arrives in time,
+// catching a wedged consumer which connection checks miss. Only the latest
+// heartbeat is kept if the channel is not read.
+func (amqpBroker *AMQPBroker) Heartbeat() <-chan time.Time {
+	return amqpBroker.heartbeatChan()
+}
+
+func (amqpBroker *AMQPBroker) heartbeatChan() chan time.Time {
+	amqpBroker.heartbeatOnce.Do(func() {
+		amqpBroker.heartbeat = make(chan time.Time, 1)
+	})
+	return amqpBroker.heartbeat
+}
+
+// Replaces an unread heartbeat with the current time, never blocks
+func (amqpBroker *AMQPBroker) beat() {
+	heartbeat := amqpBroker.heartbeatChan()
+	select {
+	case <-heartbeat:
+	default:
+	}
+	select {
+	case heartbeat <- time.Now():
+	default:
+	}
+}
+
+// DeclareTopology declares the exchanges, queue and bindings and returns
+// without consuming or publishing, so topology can be provisioned upfront
+func (amqpBroker *AMQPBroker) DeclareTopology() error {
+	conn, channel, _, err := open(amqpBroker.config)
+	if err != nil {
+		return err
+	}
+
+	return closeConn(channel, conn)
+}
+
+// Drain processes messages already waiting in the queue and returns
+// once the queue is empty. Unlike StartConsuming, it polls the queue
+// with basic.get so an empty queue is detected unambiguously.
+func (amqpBroker *AMQPBroker) Drain(taskProcessor TaskProcessor) error {
+	conn, channel, queue, err := open(amqpBroker.config)
+	if err != nil {
+		return err
+	}
+
+	defer closeConn(channel, conn)
+
+	for {
+		d, ok, err := channel.Get(
+			queue.Name, // queue name
+			false,      // auto-ack
+		)
+		if err != nil {
+			return fmt.Errorf("Queue Get: %s", err)
+		}
+
+		if !ok {
+			return nil // the queue is empty
+		}
+
+		if err := amqpBroker.consumeOne(d, taskProcessor); err != nil {
+			return err
+		}
+	}
+}
+
+// Consumes messages
+func (amqpBroker *AMQPBroker) consume(consumers []*queueConsumer, consumerTag string, taskProcessor TaskProcessor) error {
+	// Once the consumer reaches its maximum lifetime, return so it can
+	// reconnect. The consumer is cancelled first and the pools wait for
+	// in-flight messages to be processed, unacked prefetched messages
+	// get requeued when the channel is closed.
+	var lifetimeExceeded <-chan time.Time
+	if amqpBroker.config.MaxConsumerLifetime > 0 {
+		lifetime := time.Duration(amqpBroker.config.MaxConsumerLifetime) * time.Second
+		lifetimeExceeded = time.After(lifetime)
+	}
+
+	// Stats of the consumer are kept apart from other consumers'
+	state := amqpBroker.consumerState(consumerTag)
+	taskProcessor = &countingProcessor{TaskProcessor: taskProcessor, state: state}
+
+	// Ack in batches once AckBatchSize deliveries can be acked or every
+	// AckFlushInterval, flushed once the pools stopped
+	var batchers map[amqp.Acknowledger]*ackBatcher
+	var ackTicks <-chan time.Time
+	if amqpBroker.config.AckBatchSize > 0 {
+		batchers = newAckBatchers(consumers, amqpBroker.config.AckBatchSize)
+		defer flushAcks(batchers)
+
+		ackFlushInterval := amqpBroker.config.AckFlushInterval
+		if ackFlushInterval == 0 {
+			ackFlushInterval = 1 // flush acks every second by default
+		}
+		ticker := time.NewTicker(time.Duration(ackFlushInterval) * time.Second)
+		defer ticker.Stop()
+		ackTicks = ticker.C
+	}
+
+	queues := queuesByChannel(consumers)
+	handler := func(d amqp.Delivery) error {
+		state.saturation.start()
+		defer state.saturation.finish()
+		defer amqpBroker.progress.finish(amqpBroker.progress.start())
+
+		queue := queues[d.Acknowledger]
+		if batcher, ok := batchers[d.Acknowledger]; ok {
+			batcher.Deliver(d.DeliveryTag)
+			d.Acknowledger = batcher
+		}
+
+		err := amqpBroker.consumeOne(d, taskProcessor)
+		amqpBroker.observeLatency(queue, d)
+		return err
+	}
+
+	// Deferred before the pools are stopped, so the position is saved
+	// once in-flight messages have been processed
+	var positionTicks <-chan time.Time
+	if positions := consumers[0].positions; positions != nil {
+		positionInterval := amqpBroker.config.PositionInterval
+		if positionInterval == 0 {
+			positionInterval = 5 // save the position every 5 seconds by default
+		}
+		ticker := time.NewTicker(time.Duration(positionInterval) * time.Second)
+		defer ticker.Stop()
+		positionTicks = ticker.C
+
+		defer amqpBroker.savePosition(consumers[0])
+
+		// Only deliveries of the default queue move its position, also once
+		// merged with other queues by the fair-share scheduler
+		tracked, untracked := positions.track(handler), handler
+		handler = func(d amqp.Delivery) error {
+			if d.Acknowledger == consumers[0].channel {
+				return tracked(d)
+			}
+			return untracked(d)
+		}
+	}
+
+	// Hold sequenced tasks until their turn, deferred before the pools
+	// are stopped so tasks released by a timed out gap finish as well
+	var gapTicks <-chan time.Time
+	if amqpBroker.config.ReorderBufferSize > 0 {
+		gapTimeout := amqpBroker.config.ReorderGapTimeout
+		if gapTimeout == 0 {
+			gapTimeout = 5 // skip missing tasks after 5 seconds by default
+		}
+		amqpBroker.reorder = newReorderBuffer(amqpBroker.config.ReorderBufferSize, time.Duration(gapTimeout)*time.Second)
+		defer amqpBroker.ordering.Wait()
+
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		gapTicks = ticker.C
+	}
+
+	// With weights, the queues share a pool fed by the fair-share
+	// scheduler. Channel operations still apply to every queue.
+	poolConsumers := consumers
+	if weighted(consumers) {
+		stopScheduling := make(chan int)
+		defer close(stopScheduling)
+
+		poolConsumers = []*queueConsumer{fairShare(consumers, stopScheduling)}
+	}
+
+	errChan := make(chan error, 1)
+	scaling := false
+	for _, consumer := range poolConsumers {
+		consumer.pool = newConsumerPool(consumer.deliveries, handler, errChan)
+		defer consumer.pool.stop()
+
+		for consumer.pool.size() < consumer.minWorkers {
+			consumer.pool.grow()
+		}
+
+		if consumer.maxWorkers > consumer.minWorkers {
+			scaling = true
+		}
+	}
+
+	// Only poll queue depths when a pool is allowed to scale
+	var scaleTicks <-chan time.Time
+	if scaling {
+		scaleInterval := amqpBroker.config.ScaleInterval
+		if scaleInterval == 0 {
+			scaleInterval = 5 // check the queue every 5 seconds by default
+		}
+		ticker := time.NewTicker(time.Duration(scaleInterval) * time.Second)
+		defer ticker.Stop()
+		scaleTicks = ticker.C
+	}
+
+	// Measure the error rate to throttle prefetching during outages
+	var throttleTicks <-chan time.Time
+	throttled := false
+	if amqpBroker.config.ThrottleErrorRate > 0 {
+		throttleInterval := amqpBroker.config.ThrottleInterval
+		if throttleInterval == 0 {
+			throttleInterval = 10 // measure the error rate every 10 seconds by default
+		}
+		ticker := time.NewTicker(time.Duration(throttleInterval) * time.Second)
+		defer ticker.Stop()
+		throttleTicks = ticker.C
+
+		amqpBroker.errorRate.measure() // forget tasks of previous connections
+	}
+
+	// Check every second whether all slots are busy for long enough
+	saturationWindow := amqpBroker.config.SaturationWindow
+	if saturationWindow == 0 {
+		saturationWindow = 30 // saturated after 30 seconds without an idle slot by default
+	}
+	saturationTicker := time.NewTicker(time.Second)
+	defer saturationTicker.Stop()
+
+	amqpBroker.updateSlots(state, poolConsumers, throttled)
+	defer amqpBroker.resetSaturation(consumerTag, state)
+
+	// Keep the heartbeat going while idle
+	heartbeatInterval := amqpBroker.config.HeartbeatInterval
+	if heartbeatInterval == 0 {
+		heartbeatInterval = 5 // report liveness every 5 seconds by default
+	}
+	heartbeatTicker := time.NewTicker(time.Duration(heartbeatInterval) * time.Second)
+	defer heartbeatTicker.Stop()
+
+	// Tell busy from stalled while messages are processed
+	var progressTicks <-chan time.Time
+	progressInterval := time.Duration(amqpBroker.config.ProgressInterval) * time.Second
+	if progressInterval > 0 {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		progressTicks = ticker.C
+
+		amqpBroker.progress.report() // forget messages of previous connections
+	}
+
+	for {
+		amqpBroker.beat()
+
+		select {
+		case <-heartbeatTicker.C:
+		case <-ackTicks:
+			flushAcks(batchers)
+		case <-progressTicks:
+			amqpBroker.reportProgress(progressInterval)
+		case <-saturationTicker.C:
+			stats, changed := state.saturation.check(time.Duration(saturationWindow) * time.Second)
+			if changed {
+				amqpBroker.saturationChanged(consumerTag, stats)
+			}
+		case <-positionTicks:
+			amqpBroker.savePosition(consumers[0])
+		case <-gapTicks:
+			for _, key := range amqpBroker.reorder.gapped() {
+				amqpBroker.ordering.Add(1)
+				go func(key string) {
+					defer amqpBroker.ordering.Done()
+					amqpBroker.processOrdered(key, taskProcessor)
+				}(key)
+			}
+		case <-lifetimeExceeded:
+			cancelAll(consumers, consumerTag)
+			return ErrConsumerLifetimeExceeded
+		case err := <-errChan:
+			return err
+		case <-scaleTicks:
+			for _, consumer := range poolConsumers {
+				if consumer.maxWorkers > consumer.minWorkers {
+					amqpBroker.scale(consumer)
+				}
+			}
+			amqpBroker.updateSlots(state, poolConsumers, throttled)
+		case <-throttleTicks:
+			rate, processed := amqpBroker.errorRate.measure()
+			if processed > 0 && (rate > amqpBroker.config.ThrottleErrorRate) != throttled {
+				throttled = !throttled
+				amqpBroker.throttle(consumers, throttled, rate)
+				amqpBroker.updateSlots(state, poolConsumers, throttled)
+			}
+		case <-amqpBroker.stopChan:
+			cancelAll(consumers, consumerTag)
+			return nil
+		}
+	}
+}
+
+// A queue consumed on its own channel by its own pool of goroutines
+type queueConsumer struct {
+	channel       *amqp.Channel
+	queue         amqp.Queue
+	deliveries    <-chan amqp.Delivery
+	prefetchCount int
+	prefetch      *prefetchController
+	minWorkers    int
+	maxWorkers    int
+	pool          *consumerPool
+	positions     *positionTracker
+	weight        int
+}
+
+// Opens a dedicated channel with its own prefetch and starts consuming
+// an additional queue, declared together with the default queue
+func consumeQueue(conn *amqp.Connection, consumerTag string, consumedQueue config.ConsumedQueue) (*queueConsumer, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	prefetchCount := consumedQueue.PrefetchCount
+	if prefetchCount == 0 {
+		prefetchCount = 3
+	}
+
+	prefetch := newPrefetchController(channel, prefetchCount)
+	if _, err := prefetch.setRamp(prefetchCount); err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("Channel Qos: %s", err)
+	}
+
+	deliveries, err := channel.Consume(
+		consumedQueue.Name, // queue
+		consumerTag,        // consumer tag
+		false,              // auto-ack
+		false,              // exclusive
+		false,              // no-local
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		channel.Close()
+		return nil, fmt.Errorf("Queue Consume %s: %s", consumedQueue.Name, err)
+	}
+
+	minWorkers, maxWorkers := workerLimits(consumedQueue.MinWorkers, consumedQueue.MaxWorkers)
+	return &queueConsumer{
+		channel:       channel,
+		queue:         amqp.Queue{Name: consumedQueue.Name},
+		deliveries:    deliveries,
+		prefetchCount: prefetchCount,
+		prefetch:      prefetch,
+		minWorkers:    minWorkers,
+		maxWorkers:    maxWorkers,
+		weight:        consumedQueue.Weight,
+	}, nil
+}
+
+// Sends basic.cancel so the broker stops delivering messages to the
+// consumers before the channels are closed, this avoids broker side errors
+// and lets unacked messages be redistributed to other consumers promptly
+func cancelAll(consumers []*queueConsumer, consumerTag string) {
+	for _, consumer := range consumers {
+		if err := consumer.channel.Cancel(
+			consumerTag, // consumer tag
+			false,       // noWait
+		); err != nil {
+			log.Printf("Channel Cancel: %s", err)
+		}
+	}
+}
+
+// Returns minimum and maximum number of goroutines processing deliveries
+func workerLimits(minWorkers, maxWorkers int) (int, int) {
+	if minWorkers == 0 {
+		minWorkers = 1 // process messages one by one by default
+	}
+
+	if maxWorkers < minWorkers {
+		maxWorkers = minWorkers
+	}
+
+	return minWorkers, maxWorkers
+}
+
+// Grows the pool while messages pile up in the queue
+// and shrinks it back once the queue is empty
+func (amqpBroker *AMQPBroker) scale(consumer *queueConsumer) {
+	state, err := consumer.channel.QueueInspect(consumer.queue.Name)
+	if err != nil {
+		log.Printf("Queue Inspect: %s", err)
+		return
+	}
+
+	threshold := amqpBroker.config.ScaleUpThreshold
+	if threshold == 0 {
+		threshold = 10 // add a goroutine per 10 waiting messages by default
+	}
+
+	pool := consumer.pool
+	switch {
+	case state.Messages > threshold && pool.size() < consumer.maxWorkers:
+		pool.grow()
+		log.Printf("Scaled %s up to %d workers, %d messages waiting", state.Name, pool.size(), state.Messages)
+	case state.Messages == 0 && pool.size() > consumer.minWorkers:
+		pool.shrink()
+		log.Printf("Scaled %s down to %d workers", state.Name, pool.size())
+	}
+}
+
+// Processes the task, reporting a recovered panic to the panic queue
+func (amqpBroker *AMQPBroker) process(taskProcessor TaskProcessor, signature *signatures.TaskSignature) error {
+	err := safeProcess(taskProcessor, signature)
+	if panicError, ok := err.(*PanicError); ok && amqpBroker.config.PanicQueue != "" {
+		if err := amqpBroker.publishPanicReport(NewPanicReport(signature, panicError)); err != nil {
+			log.Printf("Failed publishing panic report for %s. Error = %v", signature.UUID, err)
+		}
+	}
+	return err
+}
+
+// Reduces the prefetch counts while too many tasks fail, e.g. because
+// a downstream service is down, and restores them once errors subside
+func (amqpBroker *AMQPBroker) throttle(consumers []*queueConsumer, throttled bool, rate float64) {
+	throttledPrefetchCount := amqpBroker.throttledPrefetchCount()
+	for _, consumer := range consumers {
+		prefetchCount, err := consumer.prefetch.setThrottle(throttledPrefetch(consumer.prefetchCount, throttledPrefetchCount, throttled))
+		if err != nil {
+			log.Printf("Channel Qos: %s", err)
+			continue
+		}
+		log.Printf("Set prefetch count of %s to %d, error rate %.2f", consumer.queue.Name, prefetchCount, rate)
+	}
+}
+
+// Positions are only tracked for streams consumed by a consumer group
+func (amqpBroker *AMQPBroker) tracksPositions() bool {
+	return amqpBroker.config.StreamQueue &&
+		amqpBroker.config.ConsumerGroup != "" &&
+		amqpBroker.positionStore != nil
+}
+
+// Positions are kept per consumer group and stream
+func (amqpBroker *AMQPBroker) positionKey(queue amqp.Queue) string {
+	return amqpBroker.config.ConsumerGroup + ":" + queue.Name
+}
+
+// Persists the position of the consumer, once it received a message
+func (amqpBroker *AMQPBroker) savePosition(consumer *queueConsumer) {
+	position, ok := consumer.positions.position()
+	if !ok {
+		return
+	}
+
+	if err := amqpBroker.positionStore.SavePosition(amqpBroker.positionKey(consumer.queue), position); err != nil {
+		log.Printf("Failed saving position %d of %s. Error = %v", position, consumer.queue.Name, err)
+	}
+}
+
+// Logs whether in-flight messages are being processed, i.e. the consumer is
+// busy but alive, or none finished during the interval, i.e. it is stalled
+func (amqpBroker *AMQPBroker) reportProgress(interval time.Duration) {
+	inFlight, oldest, finished := amqpBroker.progress.report()
+	if inFlight == 0 {
+		return
+	}
+
+	if finished > 0 {
+		log.Printf("Busy: %d messages in flight, %d finished in the last %v", inFlight, finished, interval)
+	} else {
+		log.Printf("Stalled: %d messages in flight, none finished in the last %v, oldest processed for %v", inFlight, interval, oldest)
+	}
+
+	// The broker closes the channel once a delivery isn't acked in time
+	consumerTimeout := time.Duration(amqpBroker.config.ConsumerTimeout) * time.Second
+	if amqpBroker.config.AckAfterResult && consumerTimeout > 0 && oldest > consumerTimeout*4/5 {
+		log.Printf("Message processed for %v is about to exceed the consumer timeout of %v", oldest, consumerTimeout)
+	}
+}
+
+// Returns the prefetch count used while throttled
+func (amqpBroker *AMQPBroker) throttledPrefetchCount() int {
+	if amqpBroker.config.ThrottledPrefetchCount == 0 {
+		return 1 // prefetch one message at a time by default
+	}
+	return amqpBroker.config.ThrottledPrefetchCount
+}
+
+// Updates the number of processing slots after pools or prefetch changed
+func (amqpBroker *AMQPBroker) updateSlots(state *consumerState, consumers []*queueConsumer, throttled bool) {
+	state.saturation.setSlots(consumerSlots(consumers, amqpBroker.throttledPrefetchCount(), throttled))
+}
+
+// Stops reporting saturation once the consumer stops, messages still
+// in flight while the pools are stopped don't occupy any slot
+func (amqpBroker *AMQPBroker) resetSaturation(consumerTag string, state *consumerState) {
+	state.saturation.setSlots(0)
+	if stats, changed := state.saturation.check(0); changed {
+		amqpBroker.saturationChanged(consumerTag, stats)
+	}
+}
+
+// Logs saturation changes and calls the saturation hook
+func (amqpBroker *AMQPBroker) saturationChanged(consumerTag string, stats ConsumerStats) {
+	if stats.Saturated {
+		log.Printf("Consumer %s saturated, %d of %d slots busy", consumerTag, stats.InFlight, stats.Slots)
+	} else {
+		log.Printf("Consumer %s no longer saturated, %d of %d slots busy", consumerTag, stats.InFlight, stats.Slots)
+	}
+
+	if amqpBroker.onSaturated != nil {
+		amqpBroker.onSaturated(stats)
+	}
+}
+
+// Consumes a single message
+func (amqpBroker *AMQPBroker) consumeOne(d amqp.Delivery, taskProcessor TaskProcessor) error {
+	start := time.Now()
+
+	// Reject oversized messages before they are logged or decoded
+	if amqpBroker.tooLarge(d.Body) {
+		d.Nack(false, false) // multiple, requeue both false
+		d.Body = nil         // keep the body out of the failure log
+		amqpBroker.handleFailure(ErrMessageTooLarge, d)
+		amqpBroker.recordOutcome(nil, start, 0, OutcomeDropped, ErrMessageTooLarge)
+		return nil
+	}
+
+	log.Printf("Received new message: %s", d.Body)
+
+	if amqpBroker.rawHandler != nil {
+		err := amqpBroker.rawHandler(d)
+		if err != ErrNotHandled {
+			outcome := OutcomeSuccess
+			if err != nil {
+				outcome = OutcomeFailure
+				amqpBroker.handleFailure(err, d)
+			}
+			amqpBroker.recordOutcome(nil, start, 0, outcome, err)
+			return nil
+		}
+	}
+
+	// Never decode messages which may be forged or tampered with
+	if err := amqpBroker.verify(d); err != nil {
+		amqpBroker.recordOutcome(nil, start, 0, OutcomeDropped, err)
+		return nil
+	}
+
+	signature, err := amqpBroker.decode(d)
+	if err != nil {
+		d.Nack(false, false) // multiple, requeue both false
+		amqpBroker.recordOutcome(nil, start, 0, OutcomeDropped, err)
+		if decodeError, ok := err.(*decodeError); ok {
+			return decodeError.Err
+		}
+		amqpBroker.handleFailure(err, d)
+		return nil
+	}
+
+	if err := amqpBroker.screen(signature); err != nil {
+		amqpBroker.drop(d, err)
+		amqpBroker.recordOutcome(signature, start, signature.GetAttempt()+1, OutcomeDropped, err)
+		return nil
+	}
+
+	// Leave tasks this worker doesn't handle to other workers, after a
+	// pause in case no other worker takes them either
+	if !amqpBroker.accepts(signature) {
+		requeueLater(d)
+		amqpBroker.recordOutcome(signature, start, signature.GetAttempt()+1, OutcomeDeferred, nil)
+		return nil
+	}
+
+	// Hold tasks of types switched off until they are switched on again
+	if amqpBroker.featureGate != nil && !amqpBroker.featureGate.Enabled(signature.Name) {
+		amqpBroker.hold(d, signature)
+		amqpBroker.recordOutcome(signature, start, signature.GetAttempt()+1, OutcomeDeferred, nil)
+		return nil
+	}
+
+	// Process sequenced tasks in publish order
+	if amqpBroker.reorder != nil {
+		if sequence, ok := signature.GetSequence(); ok {
+			amqpBroker.reorder.add(signature.RoutingKey, &orderedDelivery{
+				sequence:  sequence,
+				delivery:  d,
+				signature: signature,
+			})
+			amqpBroker.processOrdered(signature.RoutingKey, taskProcessor)
+			return nil
+		}
+	}
+
+	return amqpBroker.dispatch(d, signature, taskProcessor)
+}
+
+// Processes tasks of the routing key whose turn has come, one by one
+func (amqpBroker *AMQPBroker) processOrdered(key string, taskProcessor TaskProcessor) {
+	for {
+		ordered, ok := amqpBroker.reorder.take(key)
+		if !ok {
+			return
+		}
+		amqpBroker.dispatch(ordered.delivery, ordered.signature, taskProcessor)
+		amqpBroker.reorder.done(key)
+	}
+}
+
+// Validates and processes the decoded task and acks its message
+func (amqpBroker *AMQPBroker) dispatch(d amqp.Delivery, signature *signatures.TaskSignature, taskProcessor TaskProcessor) error {
+	start := time.Now()
+	attempt := signature.GetAttempt() + 1
+
+	// In safe mode, never ack a message which cannot be dispatched,
+	// reject it instead so it gets dead lettered (if configured)
+	if amqpBroker.config.SafeMode {
+		if err := taskProcessor.Validate(signature); err != nil {
+			d.Nack(false, false) // multiple, requeue both false
+			amqpBroker.handleFailure(err, d)
+			amqpBroker.recordOutcome(signature, start, attempt, OutcomeDropped, err)
+			return nil
+		}
+	}
+
+	// Only ack once the task's final state has been stored, requeue
+	// the message if storing it failed so the task runs again.
+	// Tasks can also explicitly requeue or dead letter the message.
+	if amqpBroker.config.AckAfterResult {
+		err := amqpBroker.process(taskProcessor, signature)
+		deferred := isDeferred(err)
+		if !deferred {
+			amqpBroker.errorRate.record(err)
+		}
+
+		action := actionFor(err)
+		switch action {
+		case ActionRequeue:
+			d.Nack(false, true) // multiple false, requeue true
+		case ActionDeadLetter:
+			d.Nack(false, false) // multiple, requeue both false
+		default:
+			d.Ack(false) // multiple false
+		}
+
+		if err != nil && !deferred {
+			amqpBroker.handleFailure(err, d)
+		}
+		amqpBroker.recordOutcome(signature, start, attempt, processedOutcome(signature, attempt, err, action == ActionRequeue), err)
+		return nil
+	}
+
+	d.Ack(false) // multiple false
+
+	err := amqpBroker.process(taskProcessor, signature)
+	deferred := isDeferred(err)
+	if !deferred {
+		amqpBroker.errorRate.record(err)
+	}
+
+	if err != nil && !deferred {
+		if action := actionFor(err); action == ActionRequeue || action == ActionDeadLetter {
+			log.Printf("%s requires AckAfterResult, message already acked", action)
+		}
+		amqpBroker.handleFailure(err, d)
+	}
+	amqpBroker.recordOutcome(signature, start, attempt, processedOutcome(signature, attempt, err, false), err)
+
+	return nil
+}
+
+// decodeError is returned from decode for messages which none of the
+// decoders could decode
+type decodeError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (decodeError *decodeError) Error() string {
+	return decodeError.Err.Error()
+}
+
+// Decompresses, upgrades, decodes, decrypts and transforms the delivered task
+func (amqpBroker *AMQPBroker) decode(d amqp.Delivery) (*signatures.TaskSignature, error) {
+	body, err := decompress(d.Body, d.ContentEncoding, amqpBroker.config.MaxConsumeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bring messages of older format versions up to date
+	formatVersion := (&signatures.TaskSignature{Headers: d.Headers}).GetFormatVersion()
+	body, err = upgrade(body, formatVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, decoder, err := decodeBody(body, amqpBroker.config.Decoders)
+	if err != nil {
+		return nil, &decodeError{Err: err}
+	}
+	if amqpBroker.onDecoded != nil {
+		amqpBroker.onDecoded(decoder)
+	}
+
+	if len(d.Headers) > 0 {
+		signature.Headers = d.Headers
+	}
+
+	// Republished tasks, e.g. retries, must not be upgraded again
+	if current := currentFormatVersion(); formatVersion < current {
+		signature.Headers = copyHeaders(signature.Headers)
+		signature.Headers[signatures.FormatVersionHeader] = current
+	}
+
+	if d.ReplyTo != "" {
+		signature.ReplyTo = d.ReplyTo
+		signature.ContentType = d.ContentType
+	}
+	signature.Redelivered = d.Redelivered
+
+	if amqpBroker.isLegacy(d) {
+		if err := amqpBroker.normalizeLegacy(signature); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := signature.DecryptArgs(amqpBroker.config.Encryptor); err != nil {
+		return nil, err
+	}
+
+	if err := transformInbound(signature); err != nil {
+		return nil, fmt.Errorf("Transform: %v", err)
+	}
+
+	return signature, nil
+}
+
+// Tells whether the message was published by a legacy producer, straight
+// to the legacy queue through the default exchange
+func (amqpBroker *AMQPBroker) isLegacy(d amqp.Delivery) bool {
+	legacyQueue := amqpBroker.config.LegacyQueue
+	return legacyQueue != "" && d.Exchange == "" && d.RoutingKey == legacyQueue
+}
+
+// Routes a task of a legacy producer as if it was published to the exchange,
+// so its retries and callbacks follow the new topology. Legacy producers set
+// the queue name as routing key, not the key tasks are routed by.
+func (amqpBroker *AMQPBroker) normalizeLegacy(signature *signatures.TaskSignature) error {
+	signature.RoutingKey = ""
+	return amqpBroker.adjustRoutingKey(signature)
+}
+
+// Returns why the decoded task must not be processed, if it mustn't
+func (amqpBroker *AMQPBroker) screen(signature *signatures.TaskSignature) error {
+	// Stale tasks are useless, drop them without processing
+	if signature.IsExpired() {
+		return ErrTaskExpired
+	}
+
+	// Never process tasks breaking the contract with their publishers
+	if amqpBroker.schemaRegistry != nil {
+		version, _ := signature.Headers[signatures.SchemaVersionHeader].(string)
+		if err := amqpBroker.schemaRegistry.CheckCompatibility(signature, version); err != nil {
+			return fmt.Errorf("Schema Incompatible: %v", err)
+		}
+	}
+
+	// Dead letter poison messages instead of processing them over and over
+	maxAttempts := amqpBroker.config.MaxDeliveryAttempts
+	if maxAttempts > 0 && signature.GetDeliveryCount() >= maxAttempts {
+		return fmt.Errorf("Exceeded %d delivery attempts", maxAttempts)
+	}
+
+	return nil
+}
+
+// Tells whether the worker handles the task, see AcceptPredicate
+func (amqpBroker *AMQPBroker) accepts(signature *signatures.TaskSignature) bool {
+	accept := amqpBroker.config.AcceptPredicate
+	return accept == nil || accept(signature)
+}
+
+// Drops a screened out task, stale tasks are acked, the rest is
+// rejected so it gets dead lettered (if configured)
+func (amqpBroker *AMQPBroker) drop(d amqp.Delivery, err error) {
+	if err == ErrTaskExpired {
+		d.Ack(false) // multiple false
+	} else {
+		d.Nack(false, false) // multiple, requeue both false
+	}
+	amqpBroker.handleFailure(err, d)
+}
+
+// Holds a task whose type is switched off. It is moved to HoldingQueue,
+// from where it returns to the default queue after HoldingDelay to be
+// checked again. Without HoldingQueue it is requeued after a pause, so
+// held tasks don't spin through the worker.
+func (amqpBroker *AMQPBroker) hold(d amqp.Delivery, signature *signatures.TaskSignature) {
+	if amqpBroker.config.HoldingQueue == "" {
+		requeueLater(d)
+		return
+	}
+
+	if err := amqpBroker.republish(d, amqpBroker.config.HoldingQueue); err != nil {
+		log.Printf("Failed holding %s (%s). Error = %v", signature.UUID, signature.Name, err)
+		d.Nack(false, true) // multiple false, requeue true
+		return
+	}
+	log.Printf("Holding %s, %s is switched off", signature.UUID, signature.Name)
+	d.Ack(false) // multiple false
+}
+
+// Requeues the delivery after a pause without holding up the goroutine
+// processing it meanwhile, the message stays unacked until then
+func requeueLater(d amqp.Delivery) {
+	time.AfterFunc(requeueDelay, func() {
+		d.Nack(false, true) // multiple false, requeue true
+	})
+}
+
+// Verifies the message signature of the delivery (see Verifier) and
+// quarantines it if verification fails. Returns the verification error.
+func (amqpBroker *AMQPBroker) verify(d amqp.Delivery) error {
+	if amqpBroker.config.Verifier == nil {
+		return nil
+	}
+
+	messageSignature, _ := d.Headers[signatures.MessageSignatureHeader].(string)
+	if err := amqpBroker.config.Verifier.Verify(d.Body, messageSignature); err != nil {
+		amqpBroker.quarantine(d, err)
+		return err
+	}
+	return nil
+}
+
+// Moves a message failing verification to QuarantineQueue as it was
+// received, to be inspected. Without QuarantineQueue it is rejected, so it
+// gets dead lettered (if configured).
+func (amqpBroker *AMQPBroker) quarantine(d amqp.Delivery, err error) {
+	if amqpBroker.config.QuarantineQueue == "" {
+		d.Nack(false, false) // multiple, requeue both false
+		amqpBroker.handleFailure(err, d)
+		return
+	}
+
+	if publishErr := amqpBroker.republish(d, amqpBroker.config.QuarantineQueue); publishErr != nil {
+		log.Printf("Failed quarantining message. Error = %v", publishErr)
+		d.Nack(false, true) // multiple false, requeue true
+		return
+	}
+	d.Ack(false) // multiple false
+	amqpBroker.handleFailure(err, d)
+}
+
+// Publishes the delivery to the queue as it was received
+func (amqpBroker *AMQPBroker) republish(d amqp.Delivery, queue string) error {
+	amqpBroker.publishMutex.Lock()
+	defer amqpBroker.publishMutex.Unlock()
+
+	channel, err := amqpBroker.getPublishChannel()
+	if err != nil {
+		return err
+	}
+
+	if err := channel.Publish(
+		"",    // default exchange
+		queue, // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			Headers:         d.Headers,
+			ContentType:     d.ContentType,
+			ContentEncoding: d.ContentEncoding,
+			DeliveryMode:    amqp.Persistent,
+			Priority:        d.Priority,
+			CorrelationId:   d.CorrelationId,
+			ReplyTo:         d.ReplyTo,
+			MessageId:       d.MessageId,
+			Body:            d.Body,
+		},
+	); err != nil {
+		// The channel is most likely dead, reconnect on the next publish
+		amqpBroker.closePublishConnection()
+		return &ConnectionError{Err: err}
+	}
+
+	return nil
+}
+
+// ExceededMaxQueueWait tells whether a dead lettered delivery is a task
+// which expired after waiting longer than its MaxQueueWait in the queue,
+// e.g. to count SLA breaches in a consumer of the rejection queue
+func ExceededMaxQueueWait(d amqp.Delivery) bool {
+	if _, ok := d.Headers[signatures.MaxQueueWaitHeader]; !ok {
+		return false
+	}
+
+	reason, _ := d.Headers["x-first-death-reason"].(string)
+	return reason == "expired"
+}
+
+// Logs a failed delivery and triggers the failure hook
+func (amqpBroker *AMQPBroker) handleFailure(err error, d amqp.Delivery) {
+	handlerError := NewHandlerError(err, d, amqpBroker.config.SensitiveFields)
+	log.Print(handlerError)
+	if amqpBroker.onFailure != nil {
+		amqpBroker.onFailure(handlerError)
+	}
+}
+
+// Checks the body against MaxConsumeBytes
+func (amqpBroker *AMQPBroker) tooLarge(body []byte) bool {
+	maxConsumeBytes := amqpBroker.config.MaxConsumeBytes
+	return maxConsumeBytes > 0 && len(body) > maxConsumeBytes
+}
+
+// Gradually increases the prefetch count over the ramp duration
+func rampPrefetch(prefetch *prefetchController, from, to int, duration time.Duration, stopChan chan int) {
+	ticker := time.NewTicker(duration / time.Duration(to-from))
+	defer ticker.Stop()
+
+	for prefetchCount := from + 1; prefetchCount <= to; prefetchCount++ {
+		select {
+		case <-ticker.C:
+			if _, err := prefetch.setRamp(prefetchCount); err != nil {
+				log.Printf("Channel Qos: %s", err)
+				return
+			}
+		case <-stopChan:
+			return
+		}
+	}
+}
+
+// Connects to the message queue, opens a channel, declares a queue
+func open(cnf *config.Config) (*amqp.Connection, *amqp.Channel, amqp.Queue, error) {
+	var queue amqp.Queue
+
+	conn, err := dial(cnf)
+	if err != nil {
+		return nil, nil, queue, err
+	}
+
+	declareRetries := cnf.DeclareRetries
+	if declareRetries == 0 {
+		declareRetries = 3 // retry transient declaration errors 3 times by default
+	}
+	backoff := &utils.ExponentialBackoff{Initial: 100 * time.Millisecond}
+
+	// Workers booting at once declare the same topology concurrently,
+	// which occasionally fails transiently. Failed declarations close
+	// the channel, so every attempt uses a new one.
+	for attempt := 0; ; attempt++ {
+		channel, err := conn.Channel()
+		if err != nil {
+			conn.Close()
+			utils.Connections.Release()
+			return nil, nil, queue, fmt.Errorf("Channel: %s", err)
+		}
+
+		queue, err = declare(channel, cnf)
+		if err == nil {
+			return conn, channel, queue, nil
+		}
+
+		if attempt >= declareRetries || !isTransientDeclareError(err) {
+			closeConn(channel, conn)
+			return nil, nil, queue, err
+		}
+
+		channel.Close()
+		log.Printf("Retrying declaration. Error = %v", err)
+		time.Sleep(backoff.NextDelay(attempt + 1))
+	}
+}
+
+// declareError is returned from declare with the failed declaration
+type declareError struct {
+	What string
+	Err  error
+}
+
+// Error implements the error interface
+func (declareError *declareError) Error() string {
+	return fmt.Sprintf("%s: %s", declareError.What, declareError.Err)
+}
+
+// Redeclaring equivalent topology succeeds, so only declarations
+// conflicting with the existing topology or denied to the user fail
+// for good. Others, e.g. binding to an exchange another worker is
+// still declaring, are worth retrying.
+func isTransientDeclareError(err error) bool {
+	declareError, ok := err.(*declareError)
+	if !ok {
+		return false
+	}
+
+	if amqpError, ok := declareError.Err.(*amqp.Error); ok {
+		switch amqpError.Code {
+		case amqp.PreconditionFailed, amqp.AccessRefused, amqp.NotAllowed:
+			return false
+		}
+	}
+	return true
+}
+
+// Dials the broker unless the maximum number of connections is reached
+func dial(cnf *config.Config) (*amqp.Connection, error) {
+	if err := utils.Connections.Acquire(cnf.MaxConnections); err != nil {
+		return nil, fmt.Errorf("Dial: %s", err)
+	}
+
+	conn, err := utils.DialAMQP(cnf.Broker, cnf.Dialer)
+	if err != nil {
+		utils.Connections.Release()
+		return nil, fmt.Errorf("Dial: %s", err)
+	}
+
+	return conn, nil
+}
+
+// Declares exchanges, the default queue and its bindings
+func declare(channel *amqp.Channel, cnf *config.Config) (amqp.Queue, error) {
+	var queue amqp.Queue
+	var err error
+
+	if err := channel.ExchangeDeclare(
+		cnf.Exchange,     // name of the exchange
+		cnf.ExchangeType, // type
+		true,             // durable
+		false,            // delete when complete
+		false,            // internal
+		false,            // noWait
+		nil,              // arguments
+	); err != nil {
+		return queue, &declareError{What: "Exchange", Err: err}
+	}
+
+	if cnf.AuditExchange != "" {
+		if err := channel.ExchangeDeclare(
+			cnf.AuditExchange, // name of the exchange
+			"fanout",          // type
+			true,              // durable
+			false,             // delete when complete
+			false,             // internal
+			false,             // noWait
+			nil,               // arguments
+		); err != nil {
+			return queue, &declareError{What: "Audit Exchange", Err: err}
+		}
+	}
+
+	if cnf.AffinityExchange != "" {
+		if err := channel.ExchangeDeclare(
+			cnf.AffinityExchange, // name of the exchange
+			"x-consistent-hash",  // type
+			true,                 // durable
+			false,                // delete when complete
+			false,                // internal
+			false,                // noWait
+			nil,                  // arguments
+		); err != nil {
+			return queue, &declareError{What: "Affinity Exchange", Err: err}
+		}
+	}
+
+	if cnf.PanicQueue != "" {
+		if _, err := channel.QueueDeclare(
+			cnf.PanicQueue, // name
+			true,           // durable
+			false,          // delete when unused
+			false,          // exclusive
+			false,          // no-wait
+			nil,            // arguments
+		); err != nil {
+			return queue, &declareError{What: "Panic Queue Declare", Err: err}
+		}
+	}
+
+	if cnf.QuarantineQueue != "" {
+		if _, err := channel.QueueDeclare(
+			cnf.QuarantineQueue, // name
+			true,                // durable
+			false,               // delete when unused
+			false,               // exclusive
+			false,               // no-wait
+			nil,                 // arguments
+		); err != nil {
+			return queue, &declareError{What: "Quarantine Queue Declare", Err: err}
+		}
+	}
+
+	// Retries wait in the retry queue until they expire, then
+	// they are dead lettered back to the default queue
+	if cnf.RetryQueue != "" {
+		if _, err := channel.QueueDeclare(
+			cnf.RetryQueue, // name
+			true,           // durable
+			false,          // delete when unused
+			false,          // exclusive
+			false,          // no-wait
+			amqp.Table{
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": cnf.DefaultQueue,
+			}, // arguments
+		); err != nil {
+			return queue, &declareError{What: "Retry Queue Declare", Err: err}
+		}
+	}
+
+	// Held tasks wait in the holding queue until they expire, then they
+	// are dead lettered back to the default queue to be checked again
+	if cnf.HoldingQueue != "" {
+		holdingDelay := cnf.HoldingDelay
+		if holdingDelay == 0 {
+			holdingDelay = 60 // check held tasks every minute by default
+		}
+		if _, err := channel.QueueDeclare(
+			cnf.HoldingQueue, // name
+			true,             // durable
+			false,            // delete when unused
+			false,            // exclusive
+			false,            // no-wait
+			amqp.Table{
+				"x-message-ttl":             int64(holdingDelay * 1000),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": cnf.DefaultQueue,
+			}, // arguments
+		); err != nil {
+			return queue, &declareError{What: "Holding Queue Declare", Err: err}
+		}
+	}
+
+	queue, err = channel.QueueDeclare(
+		cnf.DefaultQueue,      // name
+		true,                  // durable
+		false,                 // delete when unused
+		false,                 // exclusive
+		false,                 // no-wait
+		defaultQueueArgs(cnf), // arguments
+	)
+	if err != nil {
+		return queue, &declareError{What: "Queue Declare", Err: err}
+	}
+
+	if err := channel.QueueBind(
+		queue.Name,     // name of the queue
+		cnf.BindingKey, // binding key
+		cnf.Exchange,   // source exchange
+		false,          // noWait
+		nil,            // arguments
+	); err != nil {
+		return queue, &declareError{What: "Queue Bind", Err: err}
+	}
+
+	// Additional queues consumed on dedicated channels
+	for _, consumedQueue := range cnf.Queues {
+		if err := declareConsumedQueue(channel, cnf, consumedQueue); err != nil {
+			return queue, err
+		}
+	}
+
+	// Additional bindings, e.g. to aggregate messages from other exchanges
+	for _, binding := range cnf.Bindings {
+		if err := channel.QueueBind(
+			queue.Name,               // name of the queue
+			binding.BindingKey,       // binding key
+			binding.Exchange,         // source exchange
+			false,                    // noWait
+			amqp.Table(binding.Args), // arguments
+		); err != nil {
+			return queue, &declareError{What: "Queue Bind " + binding.Exchange, Err: err}
+		}
+	}
+
+	if cnf.DeadLetterQueue != "" {
+		if err := declareDeadLetterQueue(channel, cnf); err != nil {
+			return queue, err
+		}
+	}
+
+	return queue, nil
+}
+
+// Declares an additional queue and binds it to the exchange
+func declareConsumedQueue(channel *amqp.Channel, cnf *config.Config, consumedQueue config.ConsumedQueue) error {
+	args := queueArgs(cnf, consumedQueue.Name, consumedQueue.DeadLetterRoutingKey)
+	if _, err := channel.QueueDeclare(
+		consumedQueue.Name, // name
+		true,               // durable
+		false,              // delete when unused
+		false,              // exclusive
+		false,              // no-wait
+		args,               // arguments
+	); err != nil {
+		return &declareError{What: "Queue Declare " + consumedQueue.Name, Err: err}
+	}
+
+	if err := channel.QueueBind(
+		consumedQueue.Name,       // name of the queue
+		consumedQueue.BindingKey, // binding key
+		cnf.Exchange,             // source exchange
+		false,                    // noWait
+		nil,                      // arguments
+	); err != nil {
+		return &declareError{What: "Queue Bind " + consumedQueue.Name, Err: err}
+	}
+
+	return nil
+}
+
+// Declares the worker's affinity queue and binds it to the affinity exchange.
+// Tasks not taken within AffinityWait fall back to the default queue, the
+// queue of a worker which is gone is deleted after AffinityQueueExpires.
+func declareAffinityQueue(channel *amqp.Channel, cnf *config.Config, consumerTag string) (string, error) {
+	affinityWait := cnf.AffinityWait
+	if affinityWait == 0 {
+		affinityWait = 5 // fall back to any worker after 5 seconds by default
+	}
+	affinityQueueExpires := cnf.AffinityQueueExpires
+	if affinityQueueExpires == 0 {
+		affinityQueueExpires = 3600 // delete queues of workers gone for an hour by default
+	}
+
+	name := affinityQueueName(cnf.DefaultQueue, consumerTag)
+	if _, err := channel.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-message-ttl":             int64(affinityWait * 1000),
+			"x-expires":                 int64(affinityQueueExpires * 1000),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": cnf.DefaultQueue,
+		}, // arguments
+	); err != nil {
+		return "", &declareError{What: "Affinity Queue Declare", Err: err}
+	}
+
+	if err := channel.QueueBind(
+		name,                 // name of the queue
+		affinityWeight,       // binding key
+		cnf.AffinityExchange, // source exchange
+		false,                // noWait
+		nil,                  // arguments
+	); err != nil {
+		return "", &declareError{What: "Affinity Queue Bind", Err: err}
+	}
+
+	return name, nil
+}
+
+// Returns name of the affinity queue of a worker
+func affinityQueueName(defaultQueue, consumerTag string) string {
+	return defaultQueue + ".affinity." + consumerTag
+}
+
+// Declares the dead letter queue, bound to the dead letter exchange with
+// the dead letter routing keys of the default and additional queues.
+// Messages expire after DeadLetterTTL, dead lettered to the archive exchange
+// if set, so failed messages nobody reviewed don't pile up forever.
+func declareDeadLetterQueue(channel *amqp.Channel, cnf *config.Config) error {
+	if err := channel.ExchangeDeclare(
+		cnf.DeadLetterExchange, // name of the exchange
+		"direct",               // type
+		true,                   // durable
+		false,                  // delete when complete
+		false,                  // internal
+		false,                  // noWait
+		nil,                    // arguments
+	); err != nil {
+		return &declareError{What: "Dead Letter Exchange", Err: err}
+	}
+
+	var args amqp.Table
+	if cnf.DeadLetterTTL > 0 {
+		args = amqp.Table{"x-message-ttl": int64(cnf.DeadLetterTTL * 1000)}
+		if cnf.DeadLetterArchive != "" {
+			// Expired messages keep their dead letter routing key
+			args["x-dead-letter-exchange"] = cnf.DeadLetterArchive
+		}
+	}
+
+	if _, err := channel.QueueDeclare(
+		cnf.DeadLetterQueue, // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		args,                // arguments
+	); err != nil {
+		return &declareError{What: "Dead Letter Queue Declare", Err: err}
+	}
+
+	routingKeys := []string{deadLetterRoutingKey(cnf.DefaultQueue, cnf.DeadLetterRoutingKey)}
+	for _, consumedQueue := range cnf.Queues {
+		routingKeys = append(routingKeys, deadLetterRoutingKey(consumedQueue.Name, consumedQueue.DeadLetterRoutingKey))
+	}
+	for _, routingKey := range routingKeys {
+		if err := channel.QueueBind(
+			cnf.DeadLetterQueue,    // name of the queue
+			routingKey,             // binding key
+			cnf.DeadLetterExchange, // source exchange
+			false,                  // noWait
+			nil,                    // arguments
+		); err != nil {
+			return &declareError{What: "Dead Letter Queue Bind", Err: err}
+		}
+	}
+
+	return nil
+}
+
+// Returns the routing key messages of a queue are dead lettered with
+func deadLetterRoutingKey(queueName, routingKey string) string {
+	// Dead letter with the source queue name by default so the origin
+	// of messages in a shared dead letter queue is preserved
+	if routingKey == "" {
+		return queueName
+	}
+	return routingKey
+}
+
+// Returns arguments queues are declared with
+func queueArgs(cnf *config.Config, queueName, routingKey string) amqp.Table {
+	if cnf.DeadLetterExchange == "" && !cnf.LazyQueue && cnf.MessageTTL == 0 && cnf.QueueExpires == 0 && cnf.MaxPriority == 0 && cnf.MaxQueueLength == 0 {
+		return nil
+	}
+
+	args := make(amqp.Table)
+
+	if cnf.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = cnf.DeadLetterExchange
+		args["x-dead-letter-routing-key"] = deadLetterRoutingKey(queueName, routingKey)
+	}
+
+	// Expired messages are dead lettered like rejected ones, so with
+	// a dead letter exchange tasks which missed their SLA can be reviewed
+	if cnf.MessageTTL > 0 {
+		args["x-message-ttl"] = int64(cnf.MessageTTL * 1000)
+	}
+
+	// Let unused temporary queues be deleted instead of lingering
+	if cnf.QueueExpires > 0 {
+		args["x-expires"] = int64(cnf.QueueExpires * 1000)
+	}
+
+	// Deliver messages of higher priority first
+	if cnf.MaxPriority > 0 {
+		args["x-max-priority"] = uint8(cnf.MaxPriority)
+	}
+
+	// Bound the backlog, the overflow behavior tells which messages give way
+	if cnf.MaxQueueLength > 0 {
+		args["x-max-length"] = int64(cnf.MaxQueueLength)
+		if cnf.OverflowBehavior != "" {
+			args["x-overflow"] = cnf.OverflowBehavior
+		}
+	}
+
+	// Page messages to disk so deep backlogs don't exhaust broker memory
+	if cnf.LazyQueue {
+		args["x-queue-mode"] = "lazy"
+	}
+
+	return args
+}
+
+// Returns the arguments of the default queue, which can also be a stream
+// or a quorum queue
+func defaultQueueArgs(cnf *config.Config) amqp.Table {
+	args := queueArgs(cnf, cnf.DefaultQueue, cnf.DeadLetterRoutingKey)
+	if !cnf.StreamQueue && !cnf.QuorumQueue {
+		return args
+	}
+
+	if args == nil {
+		args = make(amqp.Table)
+	}
+	if cnf.StreamQueue {
+		args["x-queue-type"] = "stream"
+		return args
+	}
+
+	// The broker dead letters poison messages once they have been
+	// delivered DeliveryLimit times, e.g. crashing the worker every time
+	args["x-queue-type"] = "quorum"
+	if cnf.DeliveryLimit > 0 {
+		args["x-delivery-limit"] = int64(cnf.DeliveryLimit)
+	}
+	return args
+}
+
+// Closes the connection
+func closeConn(channel *amqp.Channel, conn *amqp.Connection) error {
+	defer utils.Connections.Release()
+
 	if err := channel.Close(); err != nil {
+		conn.Close()
 		return fmt.Errorf("Channel Close: %s", err)
 	}
 
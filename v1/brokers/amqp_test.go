@@ -0,0 +1,914 @@
+package brokers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/RichardKnop/machinery/v1/utils"
+	"github.com/streadway/amqp"
+)
+
+func TestAdjustRoutingKeyTemplate(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		Exchange:           "machinery_exchange",
+		ExchangeType:       "topic",
+		DefaultQueue:       "machinery_tasks",
+		BindingKey:         "machinery_task",
+		RoutingKeyTemplate: `tenant.{{index .Headers "tenant_id"}}.task.{{.Name}}`,
+	}, make(chan int)).(*AMQPBroker)
+
+	signature := signatures.TaskSignature{
+		Name:    "add",
+		Headers: map[string]interface{}{"tenant_id": "acme"},
+	}
+	if err := broker.adjustRoutingKey(&signature); err != nil {
+		t.Error(err)
+	}
+
+	if signature.RoutingKey != "tenant.acme.task.add" {
+		t.Errorf("signature.RoutingKey = %v, want tenant.acme.task.add", signature.RoutingKey)
+	}
+
+	// Explicit routing key takes precedence
+	signature = signatures.TaskSignature{
+		Name:       "add",
+		RoutingKey: "routing_key",
+	}
+	if err := broker.adjustRoutingKey(&signature); err != nil {
+		t.Error(err)
+	}
+
+	if signature.RoutingKey != "routing_key" {
+		t.Errorf("signature.RoutingKey = %v, want routing_key", signature.RoutingKey)
+	}
+}
+
+type fakeAcknowledger struct {
+	acked, requeued, rejected bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a.requeued = true
+	} else {
+		a.rejected = true
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+type fakeProcessor struct {
+	err       error
+	signature *signatures.TaskSignature
+}
+
+func (p *fakeProcessor) Process(signature *signatures.TaskSignature) error {
+	p.signature = signature
+	return p.err
+}
+
+func (p *fakeProcessor) Validate(signature *signatures.TaskSignature) error {
+	return nil
+}
+
+func TestConsumeOneAction(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		AckAfterResult: true,
+	}, make(chan int)).(*AMQPBroker)
+
+	testCases := []struct {
+		err  error
+		want fakeAcknowledger
+	}{
+		{nil, fakeAcknowledger{acked: true}},
+		{errors.New("oops"), fakeAcknowledger{acked: true}},
+		{NewActionError(ActionRequeue, nil), fakeAcknowledger{requeued: true}},
+		{NewActionError(ActionDeadLetter, nil), fakeAcknowledger{rejected: true}},
+		{NewActionError(ActionRetryLater, nil), fakeAcknowledger{acked: true}},
+		{&StateNotStoredError{}, fakeAcknowledger{requeued: true}},
+	}
+
+	for _, testCase := range testCases {
+		acknowledger := new(fakeAcknowledger)
+		d := amqp.Delivery{
+			Acknowledger: acknowledger,
+			Body:         []byte(`{"Name":"add"}`),
+		}
+
+		if err := broker.consumeOne(d, &fakeProcessor{err: testCase.err}); err != nil {
+			t.Error(err)
+		}
+
+		if *acknowledger != testCase.want {
+			t.Errorf("%v: acknowledger = %+v, want %+v", testCase.err, *acknowledger, testCase.want)
+		}
+	}
+}
+
+func TestConsumeOneAcceptPredicate(t *testing.T) {
+	defer func(delay time.Duration) { requeueDelay = delay }(requeueDelay)
+	requeueDelay = 50 * time.Millisecond
+
+	broker := NewAMQPBroker(&config.Config{
+		AcceptPredicate: func(signature *signatures.TaskSignature) bool {
+			return signature.Headers["tenant"] == "acme"
+		},
+	}, make(chan int)).(*AMQPBroker)
+
+	testCases := []struct {
+		tenant   string
+		accepted bool
+	}{
+		{"acme", true},
+		{"other", false},
+	}
+
+	for _, testCase := range testCases {
+		processor := new(fakeProcessor)
+		acknowledger := newRequeueAcknowledger()
+		d := amqp.Delivery{
+			Acknowledger: acknowledger,
+			Headers:      amqp.Table{"tenant": testCase.tenant},
+			Body:         []byte(`{"Name":"add"}`),
+		}
+
+		// Tasks not accepted are requeued after a pause, so they don't
+		// spin through the worker if no other worker accepts them
+		start := time.Now()
+		if err := broker.consumeOne(d, processor); err != nil {
+			t.Error(err)
+		}
+		if acknowledger.requeued(0) {
+			t.Errorf("%s: requeued right away, want after %v", testCase.tenant, requeueDelay)
+		}
+		if requeued := acknowledger.requeued(10 * requeueDelay); requeued == testCase.accepted {
+			t.Errorf("%s: requeued = %v, want %v", testCase.tenant, requeued, !testCase.accepted)
+		}
+		if !testCase.accepted && time.Since(start) < requeueDelay {
+			t.Errorf("%s: requeued after %v, want after %v", testCase.tenant, time.Since(start), requeueDelay)
+		}
+		if processed := processor.signature != nil; processed != testCase.accepted {
+			t.Errorf("%s: processed = %v, want %v", testCase.tenant, processed, testCase.accepted)
+		}
+	}
+}
+
+func TestQueueArgs(t *testing.T) {
+	cnf := &config.Config{
+		DefaultQueue: "machinery_tasks",
+	}
+
+	if args := queueArgs(cnf, cnf.DefaultQueue, cnf.DeadLetterRoutingKey); args != nil {
+		t.Errorf("queueArgs() = %v, want nil", args)
+	}
+
+	cnf.DeadLetterExchange = "machinery_dlx"
+	args := queueArgs(cnf, cnf.DefaultQueue, cnf.DeadLetterRoutingKey)
+	if args["x-dead-letter-exchange"] != "machinery_dlx" {
+		t.Errorf("args[x-dead-letter-exchange] = %v, want machinery_dlx", args["x-dead-letter-exchange"])
+	}
+	if args["x-dead-letter-routing-key"] != "machinery_tasks" {
+		t.Errorf("args[x-dead-letter-routing-key] = %v, want machinery_tasks", args["x-dead-letter-routing-key"])
+	}
+
+	cnf.DeadLetterRoutingKey = "dead.machinery_tasks"
+	args = queueArgs(cnf, cnf.DefaultQueue, cnf.DeadLetterRoutingKey)
+	if args["x-dead-letter-routing-key"] != "dead.machinery_tasks" {
+		t.Errorf("args[x-dead-letter-routing-key] = %v, want dead.machinery_tasks", args["x-dead-letter-routing-key"])
+	}
+
+	args = queueArgs(&config.Config{MaxPriority: 10}, cnf.DefaultQueue, "")
+	if args["x-max-priority"] != uint8(10) {
+		t.Errorf("args[x-max-priority] = %v, want 10", args["x-max-priority"])
+	}
+}
+
+func TestIsTransientDeclareError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		want bool
+	}{
+		{&declareError{What: "Queue Bind", Err: &amqp.Error{Code: amqp.NotFound}}, true},
+		{&declareError{What: "Queue Declare", Err: amqp.ErrClosed}, true},
+		{&declareError{What: "Queue Declare", Err: &amqp.Error{Code: amqp.PreconditionFailed}}, false},
+		{&declareError{What: "Exchange", Err: &amqp.Error{Code: amqp.AccessRefused}}, false},
+		{errors.New("oops"), false},
+	}
+
+	for _, testCase := range testCases {
+		if transient := isTransientDeclareError(testCase.err); transient != testCase.want {
+			t.Errorf("isTransientDeclareError(%v) = %v, want %v", testCase.err, transient, testCase.want)
+		}
+	}
+}
+
+func TestGetQueue(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	broker.setConsumeConnection(nil, nil, amqp.Queue{Name: "amq.gen-abc", Messages: 3})
+	if queue := broker.GetQueue(); queue.Name != "amq.gen-abc" || queue.Messages != 3 {
+		t.Errorf("broker.GetQueue() = %+v, want amq.gen-abc with 3 messages", queue)
+	}
+
+	broker.setConsumeConnection(nil, nil, amqp.Queue{})
+	if queue := broker.GetQueue(); queue.Name != "" {
+		t.Errorf("broker.GetQueue() = %+v, want empty queue", queue)
+	}
+}
+
+func TestConsumeOneMaxDeliveryAttempts(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		MaxDeliveryAttempts: 3,
+	}, make(chan int)).(*AMQPBroker)
+
+	processor := &fakeProcessor{err: errors.New("processed")}
+	var failure *HandlerError
+	broker.SetOnFailure(func(err *HandlerError) {
+		failure = err
+	})
+
+	acknowledger := new(fakeAcknowledger)
+	d := amqp.Delivery{
+		Acknowledger: acknowledger,
+		Headers:      amqp.Table{"x-delivery-count": int64(3)},
+		Body:         []byte(`{"Name":"add"}`),
+	}
+
+	if err := broker.consumeOne(d, processor); err != nil {
+		t.Error(err)
+	}
+
+	if !acknowledger.rejected || acknowledger.acked {
+		t.Errorf("acknowledger = %+v, want rejected", *acknowledger)
+	}
+
+	if failure == nil || failure.Err.Error() != "Exceeded 3 delivery attempts" {
+		t.Errorf("failure = %v, want Exceeded 3 delivery attempts", failure)
+	}
+}
+
+func TestCloseWaitsForConsumer(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		FlushTimeout: 1,
+	}, make(chan int)).(*AMQPBroker)
+
+	broker.consuming.Add(1)
+	stopped := false
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		stopped = true
+		broker.consuming.Done()
+	}()
+
+	if err := broker.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if !stopped {
+		t.Error("Close should wait for the consumer to stop")
+	}
+}
+
+func TestWorkerLimits(t *testing.T) {
+	testCases := []struct {
+		minWorkers, maxWorkers int
+		wantMin, wantMax       int
+	}{
+		{0, 0, 1, 1},
+		{2, 0, 2, 2},
+		{2, 5, 2, 5},
+		{0, 5, 1, 5},
+	}
+
+	for _, testCase := range testCases {
+		minWorkers, maxWorkers := workerLimits(testCase.minWorkers, testCase.maxWorkers)
+		if minWorkers != testCase.wantMin || maxWorkers != testCase.wantMax {
+			t.Errorf(
+				"workerLimits(%d, %d) = %d, %d, want %d, %d",
+				testCase.minWorkers,
+				testCase.maxWorkers,
+				minWorkers,
+				maxWorkers,
+				testCase.wantMin,
+				testCase.wantMax,
+			)
+		}
+	}
+}
+
+type fakeSchemaRegistry struct {
+	version string
+}
+
+func (r *fakeSchemaRegistry) Validate(signature *signatures.TaskSignature) (string, error) {
+	if len(signature.Args) == 0 {
+		return "", errors.New("args required")
+	}
+	return r.version, nil
+}
+
+func (r *fakeSchemaRegistry) CheckCompatibility(signature *signatures.TaskSignature, version string) error {
+	if version != r.version {
+		return errors.New("unknown version")
+	}
+	return nil
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+	broker.SetSchemaRegistry(&fakeSchemaRegistry{version: "2"})
+
+	if err := broker.Publish(&signatures.TaskSignature{Name: "add"}); err == nil {
+		t.Error("publishing invalid signature should return error")
+	}
+
+	testCases := []struct {
+		headers amqp.Table
+		want    fakeAcknowledger
+	}{
+		{amqp.Table{"x-schema-version": "2"}, fakeAcknowledger{acked: true}},
+		{amqp.Table{"x-schema-version": "1"}, fakeAcknowledger{rejected: true}},
+		{nil, fakeAcknowledger{rejected: true}},
+	}
+
+	for _, testCase := range testCases {
+		acknowledger := new(fakeAcknowledger)
+		d := amqp.Delivery{
+			Acknowledger: acknowledger,
+			Headers:      testCase.headers,
+			Body:         []byte(`{"Name":"add"}`),
+		}
+
+		if err := broker.consumeOne(d, &fakeProcessor{}); err != nil {
+			t.Error(err)
+		}
+
+		if *acknowledger != testCase.want {
+			t.Errorf("%v: acknowledger = %+v, want %+v", testCase.headers, *acknowledger, testCase.want)
+		}
+	}
+}
+
+func TestQueueArgsLazyQueue(t *testing.T) {
+	args := queueArgs(&config.Config{LazyQueue: true}, "machinery_tasks", "")
+	if args["x-queue-mode"] != "lazy" {
+		t.Errorf("args[x-queue-mode] = %v, want lazy", args["x-queue-mode"])
+	}
+
+	if _, ok := args["x-dead-letter-exchange"]; ok {
+		t.Error("args should not contain x-dead-letter-exchange")
+	}
+}
+
+func TestQueueArgsMessageTTL(t *testing.T) {
+	cnf := &config.Config{
+		MessageTTL:         60,
+		DeadLetterExchange: "machinery_dlx",
+	}
+
+	args := queueArgs(cnf, "machinery_tasks", "")
+	if args["x-message-ttl"] != int64(60000) {
+		t.Errorf("args[x-message-ttl] = %v, want 60000", args["x-message-ttl"])
+	}
+	if args["x-dead-letter-exchange"] != "machinery_dlx" {
+		t.Errorf("args[x-dead-letter-exchange] = %v, want machinery_dlx", args["x-dead-letter-exchange"])
+	}
+	if args["x-dead-letter-routing-key"] != "machinery_tasks" {
+		t.Errorf("args[x-dead-letter-routing-key] = %v, want machinery_tasks", args["x-dead-letter-routing-key"])
+	}
+}
+
+func TestQueueArgsQueueExpires(t *testing.T) {
+	args := queueArgs(&config.Config{QueueExpires: 300}, "", "")
+	if args["x-expires"] != int64(300000) {
+		t.Errorf("args[x-expires] = %v, want 300000", args["x-expires"])
+	}
+}
+
+func TestQueueArgsMaxQueueLength(t *testing.T) {
+	cnf := &config.Config{MaxQueueLength: 1000, OverflowBehavior: "reject-publish"}
+	args := queueArgs(cnf, "machinery_tasks", "")
+	if want := (amqp.Table{"x-max-length": int64(1000), "x-overflow": "reject-publish"}); !reflect.DeepEqual(args, want) {
+		t.Errorf("queueArgs() = %v, want %v", args, want)
+	}
+
+	testCases := []struct {
+		overflowBehavior string
+		rejectsPublishes bool
+	}{
+		{"", false},
+		{"drop-head", false},
+		{"reject-publish", true},
+		{"reject-publish-dlx", true},
+	}
+	for _, testCase := range testCases {
+		cnf.OverflowBehavior = testCase.overflowBehavior
+		broker := NewAMQPBroker(cnf, make(chan int)).(*AMQPBroker)
+		if rejectsPublishes := broker.rejectsPublishes(); rejectsPublishes != testCase.rejectsPublishes {
+			t.Errorf("%q rejectsPublishes() = %v, want %v", testCase.overflowBehavior, rejectsPublishes, testCase.rejectsPublishes)
+		}
+	}
+}
+
+func TestDefaultQueueArgs(t *testing.T) {
+	if args := defaultQueueArgs(&config.Config{}); args != nil {
+		t.Errorf("defaultQueueArgs() = %v, want nil", args)
+	}
+
+	args := defaultQueueArgs(&config.Config{StreamQueue: true})
+	if want := (amqp.Table{"x-queue-type": "stream"}); !reflect.DeepEqual(args, want) {
+		t.Errorf("defaultQueueArgs() = %v, want %v", args, want)
+	}
+
+	args = defaultQueueArgs(&config.Config{DefaultQueue: "machinery_tasks", QuorumQueue: true, DeliveryLimit: 5, DeadLetterExchange: "machinery_dlx"})
+	want := amqp.Table{
+		"x-queue-type":              "quorum",
+		"x-delivery-limit":          int64(5),
+		"x-dead-letter-exchange":    "machinery_dlx",
+		"x-dead-letter-routing-key": "machinery_tasks",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("defaultQueueArgs() = %v, want %v", args, want)
+	}
+}
+
+func TestConsumeOneExpired(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	var failure *HandlerError
+	broker.SetOnFailure(func(err *HandlerError) {
+		failure = err
+	})
+
+	processor := &fakeProcessor{err: errors.New("processed")}
+	acknowledger := new(fakeAcknowledger)
+	d := amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`{"Name":"add","ValidUntil":"2015-01-01T00:00:00Z"}`),
+	}
+
+	if err := broker.consumeOne(d, processor); err != nil {
+		t.Error(err)
+	}
+
+	if !acknowledger.acked {
+		t.Errorf("acknowledger = %+v, want acked", *acknowledger)
+	}
+
+	if failure == nil || failure.Err != ErrTaskExpired {
+		t.Errorf("failure = %v, want %v", failure, ErrTaskExpired)
+	}
+}
+
+func TestCollectConfirmations(t *testing.T) {
+	published := map[uint64]int{1: 0, 2: 2, 3: 3, 4: 4}
+	confirmations := make(chan amqp.Confirmation, 3)
+	confirmations <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	confirmations <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirmations <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+	// The builtin close is shadowed in this package
+	reflect.ValueOf(confirmations).Close()
+
+	result := &BatchPublishResult{Nacked: []int{1}}
+	collectConfirmations(published, confirmations, result)
+
+	want := &BatchPublishResult{
+		Confirmed:   []int{0, 2},
+		Nacked:      []int{1, 3},
+		Unconfirmed: []int{4},
+	}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("result = %+v, want %+v", result, want)
+	}
+}
+
+func TestConsumeOneReplyTo(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	processor := new(fakeProcessor)
+	d := amqp.Delivery{
+		Acknowledger: new(fakeAcknowledger),
+		ReplyTo:      "amq.rabbitmq.reply-to.abc",
+		Body:         []byte(`{"UUID":"task_1","Name":"add"}`),
+	}
+
+	if err := broker.consumeOne(d, processor); err != nil {
+		t.Error(err)
+	}
+
+	if processor.signature.ReplyTo != "amq.rabbitmq.reply-to.abc" {
+		t.Errorf("signature.ReplyTo = %v, want amq.rabbitmq.reply-to.abc", processor.signature.ReplyTo)
+	}
+}
+
+func TestStopConsumingBeforeStartConsuming(t *testing.T) {
+	// Unbuffered with nobody receiving, the signal is dropped
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+	broker.StopConsuming()
+
+	// Buffered, the signal is kept for when consuming starts
+	stopChan := make(chan int, 1)
+	broker = NewAMQPBroker(&config.Config{}, stopChan).(*AMQPBroker)
+	broker.StopConsuming()
+	broker.StopConsuming()
+
+	select {
+	case <-stopChan:
+	default:
+		t.Error("stop signal was not kept")
+	}
+}
+
+func TestConsumeOneMaxConsumeBytes(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		MaxConsumeBytes: 16,
+	}, make(chan int)).(*AMQPBroker)
+
+	var failure *HandlerError
+	broker.SetOnFailure(func(err *HandlerError) {
+		failure = err
+	})
+
+	processor := &fakeProcessor{}
+	acknowledger := new(fakeAcknowledger)
+	d := amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`{"Name":"add","Args":[]}`),
+	}
+
+	if err := broker.consumeOne(d, processor); err != nil {
+		t.Error(err)
+	}
+
+	if !acknowledger.rejected {
+		t.Errorf("acknowledger = %+v, want rejected", *acknowledger)
+	}
+
+	if processor.signature != nil {
+		t.Error("oversized message should not be processed")
+	}
+
+	if failure == nil || failure.Err != ErrMessageTooLarge {
+		t.Errorf("failure = %v, want %v", failure, ErrMessageTooLarge)
+	}
+}
+
+func TestConsumeOneGzipBomb(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		MaxConsumeBytes: 1 << 20,
+	}, make(chan int)).(*AMQPBroker)
+
+	var failure *HandlerError
+	broker.SetOnFailure(func(err *HandlerError) {
+		failure = err
+	})
+
+	// A few KB inflating to 100MB
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(bytes.Repeat([]byte(" "), 100<<20))
+	writer.Close()
+
+	processor := &fakeProcessor{}
+	acknowledger := new(fakeAcknowledger)
+	d := amqp.Delivery{
+		Acknowledger:    acknowledger,
+		ContentEncoding: "gzip",
+		Body:            buffer.Bytes(),
+	}
+
+	if err := broker.consumeOne(d, processor); err != nil {
+		t.Error(err)
+	}
+
+	if !acknowledger.rejected || processor.signature != nil {
+		t.Errorf("acknowledger = %+v, want rejected without being processed", *acknowledger)
+	}
+	if failure == nil || failure.Err != ErrMessageTooLarge {
+		t.Errorf("failure = %v, want %v", failure, ErrMessageTooLarge)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	select {
+	case <-broker.Heartbeat():
+		t.Error("heartbeat before the consume loop ran")
+	default:
+	}
+
+	// Unread heartbeats are replaced, never block
+	broker.beat()
+	first := time.Now()
+	broker.beat()
+
+	select {
+	case beat := <-broker.Heartbeat():
+		if beat.Before(first) {
+			t.Errorf("heartbeat = %v, want the latest one after %v", beat, first)
+		}
+	default:
+		t.Error("no heartbeat")
+	}
+}
+
+func TestPrepareMaxQueueWait(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	signature := (&signatures.TaskSignature{Name: "add"}).WithMaxQueueWait(90 * time.Second)
+	publishing, err := broker.prepare(signature)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if publishing.Expiration != "90000" {
+		t.Errorf("publishing.Expiration = %v, want 90000", publishing.Expiration)
+	}
+
+	d := amqp.Delivery{Headers: publishing.Headers}
+	if ExceededMaxQueueWait(d) {
+		t.Error("ExceededMaxQueueWait() = true, want false before expiry")
+	}
+
+	d.Headers["x-first-death-reason"] = "expired"
+	if !ExceededMaxQueueWait(d) {
+		t.Error("ExceededMaxQueueWait() = false, want true once expired")
+	}
+
+	d = amqp.Delivery{Headers: amqp.Table{"x-first-death-reason": "expired"}}
+	if ExceededMaxQueueWait(d) {
+		t.Error("ExceededMaxQueueWait() = true, want false for MessageTTL expiry")
+	}
+}
+
+func TestPrepareSequence(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		DefaultQueue:      "machinery_tasks",
+		SequencePublishes: true,
+	}, make(chan int)).(*AMQPBroker)
+
+	testCases := []struct {
+		routingKey string
+		sequence   int64
+	}{
+		{"orders", 1},
+		{"orders", 2},
+		{"invoices", 1},
+		{"orders", 3},
+	}
+
+	for _, testCase := range testCases {
+		publishing, err := broker.prepare(&signatures.TaskSignature{Name: "add", RoutingKey: testCase.routingKey})
+		if err != nil {
+			t.Error(err)
+		}
+
+		signature := &signatures.TaskSignature{Headers: publishing.Headers}
+		if sequence, ok := signature.GetSequence(); !ok || sequence != testCase.sequence {
+			t.Errorf("%s: GetSequence() = %v, %v, want %v", testCase.routingKey, sequence, ok, testCase.sequence)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		Exchange:         "machinery_exchange",
+		AffinityExchange: "machinery_affinity",
+	}, make(chan int)).(*AMQPBroker)
+
+	testCases := []struct {
+		signature  *signatures.TaskSignature
+		exchange   string
+		routingKey string
+	}{
+		{&signatures.TaskSignature{RoutingKey: "tasks"}, "machinery_exchange", "tasks"},
+		{&signatures.TaskSignature{RoutingKey: "tasks", AffinityKey: "dataset-42"}, "machinery_affinity", "dataset-42"},
+	}
+
+	for _, testCase := range testCases {
+		exchange, routingKey := broker.route(testCase.signature)
+		if exchange != testCase.exchange || routingKey != testCase.routingKey {
+			t.Errorf("route() = %v, %v, want %v, %v", exchange, routingKey, testCase.exchange, testCase.routingKey)
+		}
+	}
+
+	// Affinity keys are ignored without an affinity exchange
+	broker.config.AffinityExchange = ""
+	if exchange, _ := broker.route(testCases[1].signature); exchange != "machinery_exchange" {
+		t.Errorf("route() exchange = %v, want machinery_exchange", exchange)
+	}
+}
+
+func TestQueueResolver(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		Exchange:     "machinery_exchange",
+		ExchangeType: "direct",
+		BindingKey:   "machinery_task",
+		QueueResolver: func(signature *signatures.TaskSignature) string {
+			if signature.Name == "unresolved" {
+				return ""
+			}
+			return "q." + signature.Name
+		},
+	}, make(chan int)).(*AMQPBroker)
+
+	testCases := []struct {
+		signature  *signatures.TaskSignature
+		exchange   string
+		routingKey string
+	}{
+		{&signatures.TaskSignature{Name: "add"}, "", "q.add"},
+		{&signatures.TaskSignature{Name: "add", RoutingKey: "tasks"}, "", "q.add"},
+		{&signatures.TaskSignature{Name: "unresolved"}, "machinery_exchange", "machinery_task"},
+	}
+
+	for _, testCase := range testCases {
+		if err := broker.adjustRoutingKey(testCase.signature); err != nil {
+			t.Fatal(err)
+		}
+		exchange, routingKey := broker.route(testCase.signature)
+		if exchange != testCase.exchange || routingKey != testCase.routingKey {
+			t.Errorf("route(%s) = %v, %v, want %v, %v", testCase.signature.Name, exchange, routingKey, testCase.exchange, testCase.routingKey)
+		}
+		if testCase.signature.RoutingKey != testCase.routingKey {
+			t.Errorf("RoutingKey = %v, want %v", testCase.signature.RoutingKey, testCase.routingKey)
+		}
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		Exchange:     "machinery_exchange",
+		ExchangeType: "direct",
+		BindingKey:   "machinery_task",
+		DefaultQueue: "machinery_tasks",
+		LegacyQueue:  "legacy_tasks",
+	}, make(chan int)).(*AMQPBroker)
+
+	testCases := []struct {
+		exchange   string
+		routingKey string
+		want       string
+	}{
+		// Legacy producers publish straight to the legacy queue
+		{"", "legacy_tasks", "machinery_task"},
+		{"machinery_exchange", "machinery_task", "legacy_tasks"},
+	}
+
+	for _, testCase := range testCases {
+		signature, err := broker.decode(amqp.Delivery{
+			Exchange:   testCase.exchange,
+			RoutingKey: testCase.routingKey,
+			Body:       []byte(`{"Name":"add","RoutingKey":"legacy_tasks"}`),
+		})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if signature.RoutingKey != testCase.want {
+			t.Errorf("decode() routing key = %v, want %v", signature.RoutingKey, testCase.want)
+		}
+	}
+}
+
+type switchedOff map[string]bool
+
+func (gate switchedOff) Enabled(taskName string) bool {
+	return !gate[taskName]
+}
+
+// requeueAcknowledger signals requeues, which happen after a pause
+type requeueAcknowledger struct {
+	fakeAcknowledger
+	requeues chan uint64
+}
+
+func newRequeueAcknowledger() *requeueAcknowledger {
+	return &requeueAcknowledger{requeues: make(chan uint64, 1)}
+}
+
+func (a *requeueAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.fakeAcknowledger.Nack(tag, multiple, requeue)
+	if requeue {
+		a.requeues <- tag
+	}
+	return nil
+}
+
+func (a *requeueAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// Tells whether the delivery was requeued within the timeout
+func (a *requeueAcknowledger) requeued(timeout time.Duration) bool {
+	select {
+	case <-a.requeues:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestConsumeOneFeatureGate(t *testing.T) {
+	defer func(delay time.Duration) { requeueDelay = delay }(requeueDelay)
+	requeueDelay = 50 * time.Millisecond
+
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+	broker.SetFeatureGate(switchedOff{"add": true})
+
+	testCases := []struct {
+		body     string
+		held     bool
+		consumed bool
+	}{
+		{`{"Name":"add"}`, true, false},
+		{`{"Name":"multiply"}`, false, true},
+	}
+
+	for _, testCase := range testCases {
+		processor := new(fakeProcessor)
+		acknowledger := newRequeueAcknowledger()
+		d := amqp.Delivery{Acknowledger: acknowledger, Body: []byte(testCase.body)}
+
+		// Held tasks don't hold up the goroutine until they are requeued
+		start := time.Now()
+		if err := broker.consumeOne(d, processor); err != nil {
+			t.Error(err)
+		}
+		if elapsed := time.Since(start); elapsed >= requeueDelay {
+			t.Errorf("%s consumed in %v, want less than %v", testCase.body, elapsed, requeueDelay)
+		}
+
+		if requeued := acknowledger.requeued(time.Second); requeued != testCase.held {
+			t.Errorf("%s requeued = %v, want %v", testCase.body, requeued, testCase.held)
+		}
+		if consumed := processor.signature != nil; consumed != testCase.consumed {
+			t.Errorf("%s processed = %v, want %v", testCase.body, consumed, testCase.consumed)
+		}
+	}
+}
+
+func TestConsumeOneVerifier(t *testing.T) {
+	signer, err := utils.NewHMACSigner("1", map[string][]byte{"1": []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := NewAMQPBroker(&config.Config{Signer: signer, Verifier: signer}, make(chan int)).(*AMQPBroker)
+
+	var failures []error
+	broker.SetOnFailure(func(err *HandlerError) {
+		failures = append(failures, err.Err)
+	})
+
+	publishing, err := broker.prepare(&signatures.TaskSignature{Name: "add"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := []byte(`{"Name":"delete"}`)
+
+	testCases := []struct {
+		body     []byte
+		headers  amqp.Table
+		consumed bool
+	}{
+		{publishing.Body, publishing.Headers, true},
+		{forged, publishing.Headers, false},
+		{forged, nil, false},
+	}
+
+	for _, testCase := range testCases {
+		processor := new(fakeProcessor)
+		acknowledger := new(fakeAcknowledger)
+		d := amqp.Delivery{Acknowledger: acknowledger, Body: testCase.body, Headers: testCase.headers}
+
+		if err := broker.consumeOne(d, processor); err != nil {
+			t.Error(err)
+		}
+
+		if consumed := processor.signature != nil; consumed != testCase.consumed {
+			t.Errorf("%s processed = %v, want %v", testCase.body, consumed, testCase.consumed)
+		}
+		if acknowledger.rejected == testCase.consumed {
+			t.Errorf("%s rejected = %v, want %v", testCase.body, acknowledger.rejected, !testCase.consumed)
+		}
+	}
+
+	if len(failures) != 2 || failures[0] != utils.ErrInvalidSignature || failures[1] != utils.ErrMissingSignature {
+		t.Errorf("failures = %v, want invalid and missing signature", failures)
+	}
+}
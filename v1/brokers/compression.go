@@ -0,0 +1,98 @@
+package brokers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Decompressor returns a reader decompressing message bodies of a content
+// encoding. Readers which are io.Closers are closed once read.
+type Decompressor func(body io.Reader) (io.Reader, error)
+
+// Magic numbers used to detect compressed bodies sent without
+// the content encoding property
+var compressionMagic = []struct {
+	encoding string
+	magic    []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+}
+
+var (
+	decompressors = map[string]Decompressor{
+		"gzip": gunzip,
+	}
+	decompressorsMutex sync.RWMutex
+)
+
+// RegisterDecompressor teaches the broker how to decompress message bodies
+// of a content encoding. Gzip is supported out of the box, zstd bodies are
+// detected but need a decompressor registered, e.g. using
+// github.com/klauspost/compress/zstd
+func RegisterDecompressor(encoding string, decompress Decompressor) {
+	decompressorsMutex.Lock()
+	defer decompressorsMutex.Unlock()
+
+	decompressors[encoding] = decompress
+}
+
+// Decompresses the body according to the content encoding, or to its
+// magic number when the content encoding is not set. Uncompressed bodies
+// are returned untouched. At most limit bytes are decompressed, unless
+// limit is 0, so small bodies inflating to huge ones can't exhaust memory.
+// Returns ErrMessageTooLarge if the decompressed body exceeds the limit.
+func decompress(body []byte, contentEncoding string, limit int) ([]byte, error) {
+	encoding := contentEncoding
+	if encoding == "" {
+		encoding = detectEncoding(body)
+	}
+	if encoding == "" || encoding == "identity" {
+		return body, nil
+	}
+
+	decompressorsMutex.RLock()
+	decompress, ok := decompressors[encoding]
+	decompressorsMutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("Decompress: no decompressor registered for %q", encoding)
+	}
+
+	reader, err := decompress(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Decompress %s: %v", encoding, err)
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	if limit > 0 {
+		reader = io.LimitReader(reader, int64(limit)+1)
+	}
+	decompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Decompress %s: %v", encoding, err)
+	}
+	if limit > 0 && len(decompressed) > limit {
+		return nil, ErrMessageTooLarge
+	}
+	return decompressed, nil
+}
+
+func detectEncoding(body []byte) string {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(body, m.magic) {
+			return m.encoding
+		}
+	}
+	return ""
+}
+
+func gunzip(body io.Reader) (io.Reader, error) {
+	return gzip.NewReader(body)
+}
@@ -0,0 +1,84 @@
+package brokers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	body := []byte(`{"Name":"add"}`)
+
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(body)
+	writer.Close()
+	gzipped := buffer.Bytes()
+
+	testCases := []struct {
+		body            []byte
+		contentEncoding string
+	}{
+		{body, ""},
+		{body, "identity"},
+		{gzipped, "gzip"},
+		{gzipped, ""},
+	}
+
+	for _, testCase := range testCases {
+		decompressed, err := decompress(testCase.body, testCase.contentEncoding, 0)
+		if err != nil {
+			t.Errorf("decompress(%q) error = %v", testCase.contentEncoding, err)
+		}
+		if !bytes.Equal(decompressed, body) {
+			t.Errorf("decompress(%q) = %s, want %s", testCase.contentEncoding, decompressed, body)
+		}
+	}
+}
+
+func TestDecompressUnregistered(t *testing.T) {
+	zstdFrame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00}
+
+	if _, err := decompress(zstdFrame, "", 0); err == nil {
+		t.Error("decompress() error = nil, want missing zstd decompressor")
+	}
+
+	RegisterDecompressor("zstd", func(body io.Reader) (io.Reader, error) {
+		return strings.NewReader("decompressed"), nil
+	})
+	defer func() {
+		decompressorsMutex.Lock()
+		delete(decompressors, "zstd")
+		decompressorsMutex.Unlock()
+	}()
+
+	decompressed, err := decompress(zstdFrame, "", 0)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(decompressed) != "decompressed" {
+		t.Errorf("decompress() = %s, want decompressed", decompressed)
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// 10MB of zeros compress to a few KB
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	writer.Write(make([]byte, 10<<20))
+	writer.Close()
+
+	if _, err := decompress(buffer.Bytes(), "gzip", 1<<20); err != ErrMessageTooLarge {
+		t.Errorf("decompress() error = %v, want %v", err, ErrMessageTooLarge)
+	}
+
+	decompressed, err := decompress(buffer.Bytes(), "gzip", 10<<20)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(decompressed) != 10<<20 {
+		t.Errorf("len(decompress()) = %d, want %d", len(decompressed), 10<<20)
+	}
+}
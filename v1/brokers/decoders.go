@@ -0,0 +1,72 @@
+package brokers
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// DefaultDecoder decodes JSON encoded tasks, used unless Decoders is set
+const DefaultDecoder = "json"
+
+// Decoder decodes a task from a message body
+type Decoder func(body []byte) (*signatures.TaskSignature, error)
+
+var (
+	decoders = map[string]Decoder{
+		DefaultDecoder: decodeJSON,
+	}
+	decodersMutex sync.RWMutex
+)
+
+// RegisterDecoder teaches the broker how to decode tasks of a serialization
+// format, e.g. "protobuf". Formats are tried in the order of the Decoders
+// configuration option.
+func RegisterDecoder(name string, decode Decoder) {
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+
+	decoders[name] = decode
+}
+
+func decodeJSON(body []byte) (*signatures.TaskSignature, error) {
+	signature := new(signatures.TaskSignature)
+	if err := json.Unmarshal(body, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// Tries the named decoders in order and returns the task decoded by the
+// first one which succeeds along with its name. Errors of all decoders
+// are returned if none succeeds.
+func decodeBody(body []byte, names []string) (*signatures.TaskSignature, string, error) {
+	if len(names) == 0 {
+		names = []string{DefaultDecoder}
+	}
+
+	decodersMutex.RLock()
+	defer decodersMutex.RUnlock()
+
+	var errs []string
+	var lastErr error
+	for _, name := range names {
+		decode, ok := decoders[name]
+		if !ok {
+			lastErr = fmt.Errorf("Decoder %s not registered", name)
+		} else if signature, err := decode(body); err != nil {
+			lastErr = err
+		} else {
+			return signature, name, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", name, lastErr))
+	}
+
+	if len(names) == 1 {
+		return nil, "", lastErr
+	}
+	return nil, "", fmt.Errorf("All decoders failed: %s", strings.Join(errs, "; "))
+}
@@ -0,0 +1,54 @@
+package brokers
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+func TestDecodeBody(t *testing.T) {
+	// Decodes the new format, "name:<task name>"
+	RegisterDecoder("text", func(body []byte) (*signatures.TaskSignature, error) {
+		if !bytes.HasPrefix(body, []byte("name:")) {
+			return nil, errors.New("not text")
+		}
+		return &signatures.TaskSignature{Name: string(body[5:])}, nil
+	})
+	defer func() {
+		decodersMutex.Lock()
+		delete(decoders, "text")
+		decodersMutex.Unlock()
+	}()
+
+	names := []string{"text", DefaultDecoder}
+	testCases := []struct {
+		body    string
+		name    string
+		decoder string
+	}{
+		{"name:add", "add", "text"},
+		{`{"Name":"add"}`, "add", DefaultDecoder},
+	}
+
+	for _, testCase := range testCases {
+		signature, decoder, err := decodeBody([]byte(testCase.body), names)
+		if err != nil {
+			t.Errorf("decodeBody(%s) error = %v", testCase.body, err)
+			continue
+		}
+		if signature.Name != testCase.name || decoder != testCase.decoder {
+			t.Errorf("decodeBody(%s) = %v, %v, want %v, %v", testCase.body, signature.Name, decoder, testCase.name, testCase.decoder)
+		}
+	}
+
+	if _, _, err := decodeBody([]byte("garbage"), names); err == nil {
+		t.Error("decodeBody() error = nil, want an error when all decoders fail")
+	}
+
+	// JSON only by default
+	if _, _, err := decodeBody([]byte("name:add"), nil); err == nil {
+		t.Error("decodeBody() error = nil, want an error without the text decoder")
+	}
+}
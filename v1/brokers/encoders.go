@@ -0,0 +1,44 @@
+package brokers
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// DefaultContentType is used for replies to requests of unknown content type
+const DefaultContentType = "application/json"
+
+// ReplyEncoder encodes RPC replies for callers expecting a content type
+type ReplyEncoder func(reply interface{}) ([]byte, error)
+
+var (
+	replyEncoders = map[string]ReplyEncoder{
+		DefaultContentType: json.Marshal,
+	}
+	replyEncodersMutex sync.RWMutex
+)
+
+// RegisterReplyEncoder teaches the broker how to encode RPC replies to
+// requests of a content type, e.g. "application/x-msgpack"
+func RegisterReplyEncoder(contentType string, encode ReplyEncoder) {
+	replyEncodersMutex.Lock()
+	defer replyEncodersMutex.Unlock()
+
+	replyEncoders[contentType] = encode
+}
+
+// Returns the content type a reply to a request of the given content type
+// is encoded with and its encoder, JSON unless an encoder is registered
+func replyEncoder(contentType string) (string, ReplyEncoder) {
+	// Ignore parameters, e.g. "application/json; charset=utf-8"
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+
+	replyEncodersMutex.RLock()
+	defer replyEncodersMutex.RUnlock()
+
+	if encode, ok := replyEncoders[contentType]; ok {
+		return contentType, encode
+	}
+	return DefaultContentType, replyEncoders[DefaultContentType]
+}
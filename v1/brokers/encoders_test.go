@@ -0,0 +1,39 @@
+package brokers
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestReplyEncoder(t *testing.T) {
+	RegisterReplyEncoder("text/plain", func(reply interface{}) ([]byte, error) {
+		return []byte(fmt.Sprint(reply)), nil
+	})
+
+	testCases := []struct {
+		contentType string
+		want        string
+		wantBody    string
+	}{
+		{"text/plain", "text/plain", "42"},
+		{"text/plain; charset=utf-8", "text/plain", "42"},
+		{"application/json", "application/json", "42"},
+		{"application/x-unknown", "application/json", "42"},
+		{"", "application/json", "42"},
+	}
+
+	for _, testCase := range testCases {
+		contentType, encode := replyEncoder(testCase.contentType)
+		if contentType != testCase.want {
+			t.Errorf("replyEncoder(%q) content type = %v, want %v", testCase.contentType, contentType, testCase.want)
+		}
+
+		body, err := encode(42)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(body) != testCase.wantBody {
+			t.Errorf("replyEncoder(%q) body = %s, want %v", testCase.contentType, body, testCase.wantBody)
+		}
+	}
+}
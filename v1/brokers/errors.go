@@ -0,0 +1,198 @@
+package brokers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// RedactedValue replaces values of sensitive fields
+const RedactedValue = "[REDACTED]"
+
+// ErrConsumerLifetimeExceeded is returned from StartConsuming when
+// the consumer stops to reconnect after MaxConsumerLifetime
+var ErrConsumerLifetimeExceeded = errors.New("Consumer lifetime exceeded")
+
+// ErrNotHandled can be returned from a RawDeliveryHandler to pass
+// the delivery on to be decoded and processed as a task
+var ErrNotHandled = errors.New("Delivery not handled")
+
+// ErrTaskExpired is reported to the failure hook when a task is dropped
+// because it was consumed after its ValidUntil deadline
+var ErrTaskExpired = errors.New("Task expired")
+
+// ErrReplyTimeout is returned from PublishAndWait when no reply
+// arrives in time
+var ErrReplyTimeout = errors.New("Reply timed out")
+
+// ErrMessageTooLarge is reported to the failure hook when a message is
+// rejected because its body exceeds MaxConsumeBytes
+var ErrMessageTooLarge = errors.New("Message too large")
+
+// ErrExchangeNotFound is returned when publishing to an exchange which
+// doesn't exist, e.g. because it hasn't been provisioned
+var ErrExchangeNotFound = errors.New("Exchange not found")
+
+// ErrAlreadyConsuming is returned when starting a consumer on a broker
+// which is already running one
+var ErrAlreadyConsuming = errors.New("Broker already consuming")
+
+// ErrQueueFull is returned from Publish when the queue reached
+// MaxQueueLength and rejected the message (see OverflowBehavior)
+var ErrQueueFull = errors.New("Queue full")
+
+// ConnectionError is returned from publishing when the connection to the
+// broker or its channel failed, rather than the broker refusing the message,
+// e.g. so FailoverBroker only fails over when the broker is unreachable
+type ConnectionError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (connectionError *ConnectionError) Error() string {
+	return connectionError.Err.Error()
+}
+
+// StateNotStoredError is returned by task processors when a task state
+// could not be stored in the result backend
+type StateNotStoredError struct {
+	Err error
+}
+
+// Error implements the error interface
+func (stateNotStoredError *StateNotStoredError) Error() string {
+	return fmt.Sprintf("State Not Stored: %v", stateNotStoredError.Err)
+}
+
+// DeferredError is returned by task processors for tasks which didn't run
+// because a limit was reached, e.g. a concurrency limit, and run later. With
+// AckAfterResult it is wrapped in an ActionError requeueing the message,
+// otherwise the task has been published again.
+type DeferredError struct {
+	Reason error
+}
+
+// Error implements the error interface
+func (deferredError *DeferredError) Error() string {
+	return fmt.Sprintf("Deferred: %v", deferredError.Reason)
+}
+
+// Tells whether the task processor deferred the task rather than ran it
+func isDeferred(err error) bool {
+	if actionError, ok := err.(*ActionError); ok {
+		err = actionError.Err
+	}
+	_, ok := err.(*DeferredError)
+	return ok
+}
+
+// ActionError is returned by tasks or task processors to explicitly
+// control what happens to the delivered message
+type ActionError struct {
+	Action Action
+	Err    error
+}
+
+// NewActionError creates ActionError instance
+func NewActionError(action Action, err error) *ActionError {
+	return &ActionError{Action: action, Err: err}
+}
+
+// Error implements the error interface
+func (actionError *ActionError) Error() string {
+	return fmt.Sprintf("%s: %v", actionError.Action, actionError.Err)
+}
+
+// HandlerError wraps an error returned by a task processor together with
+// the raw delivery which caused it, so failures can be root-caused easily
+type HandlerError struct {
+	Err         error
+	Body        []byte
+	Headers     map[string]interface{}
+	Exchange    string
+	RoutingKey  string
+	ContentType string
+	MessageID   string
+	DeliveryTag uint64
+	Redelivered bool
+}
+
+// Error implements the error interface
+func (handlerError *HandlerError) Error() string {
+	return fmt.Sprintf(
+		"Handler Error: %v (exchange = %q, routing key = %q, headers = %v, body = %s)",
+		handlerError.Err,
+		handlerError.Exchange,
+		handlerError.RoutingKey,
+		handlerError.Headers,
+		handlerError.Body,
+	)
+}
+
+// NewHandlerError creates HandlerError instance. Headers and JSON body
+// fields named in sensitiveFields are redacted.
+func NewHandlerError(err error, d amqp.Delivery, sensitiveFields []string) *HandlerError {
+	return &HandlerError{
+		Err:         err,
+		Body:        redactBody(d.Body, sensitiveFields),
+		Headers:     redactHeaders(d.Headers, sensitiveFields),
+		Exchange:    d.Exchange,
+		RoutingKey:  d.RoutingKey,
+		ContentType: d.ContentType,
+		MessageID:   d.MessageId,
+		DeliveryTag: d.DeliveryTag,
+		Redelivered: d.Redelivered,
+	}
+}
+
+func redactHeaders(headers amqp.Table, sensitiveFields []string) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(headers))
+	for k, v := range headers {
+		redacted[k] = v
+	}
+	for _, field := range sensitiveFields {
+		if _, ok := redacted[field]; ok {
+			redacted[field] = RedactedValue
+		}
+	}
+	return redacted
+}
+
+// Bodies which are not valid JSON are returned untouched
+func redactBody(body []byte, sensitiveFields []string) []byte {
+	if len(sensitiveFields) == 0 {
+		return body
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return body
+	}
+
+	redacted, err := json.Marshal(redactValue(decoded, sensitiveFields))
+	if err != nil {
+		return body
+	}
+	return redacted
+}
+
+func redactValue(value interface{}, sensitiveFields []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, nested := range v {
+			v[k] = redactValue(nested, sensitiveFields)
+			for _, field := range sensitiveFields {
+				if k == field {
+					v[k] = RedactedValue
+				}
+			}
+		}
+	case []interface{}:
+		for i, nested := range v {
+			v[i] = redactValue(nested, sensitiveFields)
+		}
+	}
+	return value
+}
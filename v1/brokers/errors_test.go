@@ -0,0 +1,59 @@
+package brokers
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestNewHandlerError(t *testing.T) {
+	d := amqp.Delivery{
+		Headers: amqp.Table{
+			"password": "secret",
+			"trace":    "abc",
+		},
+		Exchange:   "machinery_exchange",
+		RoutingKey: "machinery_task",
+		Body:       []byte(`{"Name":"add","Args":[{"Type":"string","Value":"v","password":"secret"}]}`),
+	}
+
+	handlerError := NewHandlerError(errors.New("oops"), d, []string{"password"})
+
+	if handlerError.Err.Error() != "oops" {
+		t.Errorf("handlerError.Err = %v, want oops", handlerError.Err)
+	}
+
+	if handlerError.RoutingKey != "machinery_task" {
+		t.Errorf("handlerError.RoutingKey = %v, want machinery_task", handlerError.RoutingKey)
+	}
+
+	if handlerError.Headers["password"] != RedactedValue {
+		t.Errorf("handlerError.Headers[password] = %v, want %v", handlerError.Headers["password"], RedactedValue)
+	}
+
+	if handlerError.Headers["trace"] != "abc" {
+		t.Errorf("handlerError.Headers[trace] = %v, want abc", handlerError.Headers["trace"])
+	}
+
+	if d.Headers["password"] != "secret" {
+		t.Error("original delivery headers should not be modified")
+	}
+
+	var body struct {
+		Name string
+		Args []map[string]interface{}
+	}
+	if err := json.Unmarshal(handlerError.Body, &body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Name != "add" {
+		t.Errorf("body.Name = %v, want add", body.Name)
+	}
+
+	if body.Args[0]["password"] != RedactedValue {
+		t.Errorf("body.Args[0][password] = %v, want %v", body.Args[0]["password"], RedactedValue)
+	}
+}
@@ -0,0 +1,307 @@
+package brokers
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/RichardKnop/machinery/v1/utils"
+)
+
+const (
+	// PrimaryBroker - the failover broker publishes to the primary broker
+	PrimaryBroker = "primary"
+	// SecondaryBroker - the failover broker failed over to the secondary
+	// broker after the primary one was unreachable
+	SecondaryBroker = "secondary"
+)
+
+// FailoverStats tells which broker a FailoverBroker publishes to and how
+// many times it failed over to the secondary broker
+type FailoverStats struct {
+	Active    string
+	Failovers int64
+}
+
+// FailoverBroker publishes to a primary broker and fails over to a
+// secondary one, e.g. in another cluster, whenever the primary is
+// unreachable. It consumes from both, so tasks published to either are
+// processed.
+type FailoverBroker struct {
+	primary   Broker
+	secondary Broker
+	stats     FailoverStats
+	backoff   utils.BackoffStrategy
+	mutex     sync.Mutex
+}
+
+// NewFailoverBroker creates FailoverBroker instance
+func NewFailoverBroker(primary, secondary Broker) Broker {
+	return &FailoverBroker{
+		primary:   primary,
+		secondary: secondary,
+		stats:     FailoverStats{Active: PrimaryBroker},
+	}
+}
+
+// Primary returns the primary broker, e.g. to set hooks of AMQPBroker
+func (failoverBroker *FailoverBroker) Primary() Broker {
+	return failoverBroker.primary
+}
+
+// Secondary returns the secondary broker
+func (failoverBroker *FailoverBroker) Secondary() Broker {
+	return failoverBroker.secondary
+}
+
+// SetReconnectBackoff sets the backoff strategy for reconnecting to either
+// broker (see ReconnectBackoff), Fibonacci in seconds by default
+func (failoverBroker *FailoverBroker) SetReconnectBackoff(backoff utils.BackoffStrategy) {
+	failoverBroker.backoff = backoff
+}
+
+// StartConsuming consumes from both brokers until StopConsuming is called,
+// reconnecting to either independently, so an unreachable broker doesn't
+// keep tasks of the other one from being processed
+func (failoverBroker *FailoverBroker) StartConsuming(consumerTag string, taskProcessor TaskProcessor) (bool, error) {
+	errChan := make(chan error, 2)
+	for _, broker := range []Broker{failoverBroker.primary, failoverBroker.secondary} {
+		go func(broker Broker) {
+			errChan <- failoverBroker.consumeUntilStopped(broker, consumerTag, taskProcessor)
+		}(broker)
+	}
+
+	// Once either one stops, stop the other one as well
+	err := <-errChan
+	failoverBroker.StopConsuming()
+	if otherErr := <-errChan; err == nil {
+		err = otherErr
+	}
+
+	return false, err
+}
+
+// Consumes from the broker, reconnecting until it stops without an error
+// to retry
+func (failoverBroker *FailoverBroker) consumeUntilStopped(broker Broker, consumerTag string, taskProcessor TaskProcessor) error {
+	retryFunc := failoverBroker.newRetryClosure()
+	for {
+		retryFunc()
+		retry, err := broker.StartConsuming(consumerTag, taskProcessor)
+		if !retry {
+			return err
+		}
+
+		log.Print(err)
+
+		// Rolling reconnect, no need to back off
+		if err == ErrConsumerLifetimeExceeded {
+			retryFunc = failoverBroker.newRetryClosure()
+		}
+	}
+}
+
+// Backs off reconnecting to a broker
+func (failoverBroker *FailoverBroker) newRetryClosure() func() {
+	if failoverBroker.backoff != nil {
+		return utils.NewRetryClosure(failoverBroker.backoff)
+	}
+	return utils.RetryClosure()
+}
+
+// StopConsuming stops consuming from both brokers
+func (failoverBroker *FailoverBroker) StopConsuming() {
+	failoverBroker.primary.StopConsuming()
+	failoverBroker.secondary.StopConsuming()
+}
+
+// Drain processes all tasks waiting in the default queues of both brokers
+func (failoverBroker *FailoverBroker) Drain(taskProcessor TaskProcessor) error {
+	if err := failoverBroker.primary.Drain(taskProcessor); err != nil {
+		return fmt.Errorf("Primary: %v", err)
+	}
+	if err := failoverBroker.secondary.Drain(taskProcessor); err != nil {
+		return fmt.Errorf("Secondary: %v", err)
+	}
+	return nil
+}
+
+// DeclareTopology declares the topology on both brokers
+func (failoverBroker *FailoverBroker) DeclareTopology() error {
+	if err := failoverBroker.primary.DeclareTopology(); err != nil {
+		return fmt.Errorf("Primary: %v", err)
+	}
+	if err := failoverBroker.secondary.DeclareTopology(); err != nil {
+		return fmt.Errorf("Secondary: %v", err)
+	}
+	return nil
+}
+
+// SetOnFailure sets the failure hook of both brokers
+func (failoverBroker *FailoverBroker) SetOnFailure(hook func(err *HandlerError)) {
+	failoverBroker.primary.SetOnFailure(hook)
+	failoverBroker.secondary.SetOnFailure(hook)
+}
+
+// SetPositionStore sets the stream position store of both brokers
+func (failoverBroker *FailoverBroker) SetPositionStore(positionStore backends.PositionStore) {
+	failoverBroker.eachHooked(func(broker HookedBroker) {
+		broker.SetPositionStore(positionStore)
+	})
+}
+
+// SetOnDecoded sets the decoded hook of both brokers
+func (failoverBroker *FailoverBroker) SetOnDecoded(hook func(decoder string)) {
+	failoverBroker.eachHooked(func(broker HookedBroker) {
+		broker.SetOnDecoded(hook)
+	})
+}
+
+// SetOnLatency sets the latency hook of both brokers
+func (failoverBroker *FailoverBroker) SetOnLatency(hook func(queue string, latency time.Duration)) {
+	failoverBroker.eachHooked(func(broker HookedBroker) {
+		broker.SetOnLatency(hook)
+	})
+}
+
+// SetOutcomeRecorder sets the outcome recorder of both brokers
+func (failoverBroker *FailoverBroker) SetOutcomeRecorder(recorder OutcomeRecorder, workerID string) {
+	failoverBroker.eachHooked(func(broker HookedBroker) {
+		broker.SetOutcomeRecorder(recorder, workerID)
+	})
+}
+
+// Calls set with each broker which takes hooks
+func (failoverBroker *FailoverBroker) eachHooked(set func(broker HookedBroker)) {
+	for _, broker := range []Broker{failoverBroker.primary, failoverBroker.secondary} {
+		if hookedBroker, ok := broker.(HookedBroker); ok {
+			set(hookedBroker)
+		}
+	}
+}
+
+// WaitConsuming waits for both brokers to finish processing messages once
+// consuming has been stopped, at most for the timeout. Returns false if it
+// timed out.
+func (failoverBroker *FailoverBroker) WaitConsuming(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, broker := range []Broker{failoverBroker.primary, failoverBroker.secondary} {
+		gracefulBroker, ok := broker.(GracefulBroker)
+		if !ok {
+			continue
+		}
+		if !gracefulBroker.WaitConsuming(deadline.Sub(time.Now())) {
+			return false
+		}
+	}
+	return true
+}
+
+// AbortConsuming stops consuming from both brokers without waiting for
+// messages being processed
+func (failoverBroker *FailoverBroker) AbortConsuming() {
+	for _, broker := range []Broker{failoverBroker.primary, failoverBroker.secondary} {
+		if gracefulBroker, ok := broker.(GracefulBroker); ok {
+			gracefulBroker.AbortConsuming()
+		} else {
+			broker.StopConsuming()
+		}
+	}
+}
+
+// Publish places a new message on the primary broker, or on the secondary
+// one if that fails
+func (failoverBroker *FailoverBroker) Publish(signature *signatures.TaskSignature) error {
+	return failoverBroker.publish(func(broker Broker) error {
+		return broker.Publish(signature)
+	})
+}
+
+// PublishRetry publishes a failed task to be retried after the delay to the
+// primary broker, or to the secondary one if that fails. Brokers which
+// can't delay retries get the task published right away.
+func (failoverBroker *FailoverBroker) PublishRetry(signature *signatures.TaskSignature, delay time.Duration) error {
+	return failoverBroker.publish(func(broker Broker) error {
+		if retryPublisher, ok := broker.(RetryPublisher); ok {
+			return retryPublisher.PublishRetry(signature, delay)
+		}
+		return broker.Publish(signature)
+	})
+}
+
+// PublishAuditEvent publishes an audit event to the primary broker, or to
+// the secondary one if that fails
+func (failoverBroker *FailoverBroker) PublishAuditEvent(routingKey string, event interface{}) error {
+	return failoverBroker.publish(func(broker Broker) error {
+		return broker.PublishAuditEvent(routingKey, event)
+	})
+}
+
+// PublishReply publishes a reply to the primary broker, or to the secondary
+// one if that fails
+func (failoverBroker *FailoverBroker) PublishReply(replyTo, correlationID, contentType string, reply interface{}) error {
+	return failoverBroker.publish(func(broker Broker) error {
+		return broker.PublishReply(replyTo, correlationID, contentType, reply)
+	})
+}
+
+// Close closes both brokers
+func (failoverBroker *FailoverBroker) Close() error {
+	primaryErr := failoverBroker.primary.Close()
+	if err := failoverBroker.secondary.Close(); err != nil {
+		return fmt.Errorf("Secondary: %v", err)
+	}
+	if primaryErr != nil {
+		return fmt.Errorf("Primary: %v", primaryErr)
+	}
+	return nil
+}
+
+// Stats returns which broker is published to and how many times publishing
+// failed over to the secondary broker
+func (failoverBroker *FailoverBroker) Stats() FailoverStats {
+	failoverBroker.mutex.Lock()
+	defer failoverBroker.mutex.Unlock()
+
+	return failoverBroker.stats
+}
+
+// Publishes to the primary broker, which is tried first every time so
+// publishing returns to it as soon as it's reachable again, and fails over
+// to the secondary broker if the primary one is unreachable. Errors of the
+// broker refusing the message, e.g. ErrQueueFull, are returned unchanged,
+// a full or unprovisioned primary broker doesn't fail over.
+func (failoverBroker *FailoverBroker) publish(publish func(broker Broker) error) error {
+	primaryErr := publish(failoverBroker.primary)
+	if primaryErr == nil {
+		failoverBroker.setActive(PrimaryBroker)
+		return nil
+	}
+	if _, ok := primaryErr.(*ConnectionError); !ok {
+		return primaryErr
+	}
+
+	if err := publish(failoverBroker.secondary); err != nil {
+		if _, ok := err.(*ConnectionError); !ok {
+			return err
+		}
+		return &ConnectionError{Err: fmt.Errorf("Primary: %v, Secondary: %v", primaryErr, err)}
+	}
+
+	log.Printf("Failed over to the secondary broker. Error = %v", primaryErr)
+	failoverBroker.setActive(SecondaryBroker)
+	return nil
+}
+
+func (failoverBroker *FailoverBroker) setActive(active string) {
+	failoverBroker.mutex.Lock()
+	defer failoverBroker.mutex.Unlock()
+
+	if active == SecondaryBroker {
+		failoverBroker.stats.Failovers++
+	}
+	failoverBroker.stats.Active = active
+}
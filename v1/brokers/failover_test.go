@@ -0,0 +1,131 @@
+package brokers
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+type publishingBroker struct {
+	Broker
+	err       error
+	published []*signatures.TaskSignature
+}
+
+func (b *publishingBroker) Publish(signature *signatures.TaskSignature) error {
+	if b.err != nil {
+		return b.err
+	}
+	b.published = append(b.published, signature)
+	return nil
+}
+
+func TestFailoverBrokerPublish(t *testing.T) {
+	primary := new(publishingBroker)
+	secondary := new(publishingBroker)
+	failoverBroker := NewFailoverBroker(primary, secondary).(*FailoverBroker)
+
+	if err := failoverBroker.Publish(&signatures.TaskSignature{Name: "add"}); err != nil {
+		t.Error(err)
+	}
+	if len(primary.published) != 1 || failoverBroker.Stats().Active != PrimaryBroker {
+		t.Errorf("published to primary %d times, stats = %+v, want 1 with primary active", len(primary.published), failoverBroker.Stats())
+	}
+
+	primary.err = &ConnectionError{Err: errors.New("unreachable")}
+	if err := failoverBroker.Publish(&signatures.TaskSignature{Name: "add"}); err != nil {
+		t.Error(err)
+	}
+	if stats := failoverBroker.Stats(); len(secondary.published) != 1 || stats.Active != SecondaryBroker || stats.Failovers != 1 {
+		t.Errorf("published to secondary %d times, stats = %+v, want 1 with secondary active after 1 failover", len(secondary.published), stats)
+	}
+
+	secondary.err = &ConnectionError{Err: errors.New("unreachable")}
+	if err := failoverBroker.Publish(&signatures.TaskSignature{Name: "add"}); err == nil {
+		t.Error("failoverBroker.Publish() error = nil, want an error when both brokers fail")
+	}
+
+	// Publishing returns to the primary broker once it's reachable
+	primary.err = nil
+	if err := failoverBroker.Publish(&signatures.TaskSignature{Name: "add"}); err != nil {
+		t.Error(err)
+	}
+	if stats := failoverBroker.Stats(); stats.Active != PrimaryBroker || stats.Failovers != 1 {
+		t.Errorf("failoverBroker.Stats() = %+v, want primary active after 1 failover", stats)
+	}
+}
+
+func TestFailoverBrokerPublishRefused(t *testing.T) {
+	testCases := []error{
+		ErrQueueFull,
+		ErrExchangeNotFound,
+		ErrMessageTooLarge,
+		errors.New("Sign: no key"),
+	}
+
+	for _, primaryErr := range testCases {
+		primary := &publishingBroker{err: primaryErr}
+		secondary := new(publishingBroker)
+		failoverBroker := NewFailoverBroker(primary, secondary).(*FailoverBroker)
+
+		// The primary broker is reachable, it refused the message
+		if err := failoverBroker.Publish(&signatures.TaskSignature{Name: "add"}); err != primaryErr {
+			t.Errorf("failoverBroker.Publish() error = %v, want %v", err, primaryErr)
+		}
+		if stats := failoverBroker.Stats(); len(secondary.published) != 0 || stats.Failovers != 0 {
+			t.Errorf("published to secondary %d times, stats = %+v, want no failover on %v", len(secondary.published), stats, primaryErr)
+		}
+	}
+
+	// Errors of the secondary broker are returned unchanged as well
+	primary := &publishingBroker{err: &ConnectionError{Err: errors.New("unreachable")}}
+	secondary := &publishingBroker{err: ErrQueueFull}
+	failoverBroker := NewFailoverBroker(primary, secondary)
+	if err := failoverBroker.Publish(&signatures.TaskSignature{Name: "add"}); err != ErrQueueFull {
+		t.Errorf("failoverBroker.Publish() error = %v, want %v", err, ErrQueueFull)
+	}
+}
+
+// Fails to connect a number of times before consuming until stopped
+type reconnectingBroker struct {
+	Broker
+	failures int
+	attempts int
+}
+
+func (b *reconnectingBroker) StartConsuming(consumerTag string, taskProcessor TaskProcessor) (bool, error) {
+	b.attempts++
+	if b.attempts <= b.failures {
+		return true, errors.New("unreachable")
+	}
+	return false, nil
+}
+
+type countingBackoff struct {
+	delays int
+}
+
+func (backoff *countingBackoff) NextDelay(attempt int) time.Duration {
+	backoff.delays++
+	return 0
+}
+
+func (backoff *countingBackoff) Reset() {}
+
+func TestFailoverBrokerReconnectBackoff(t *testing.T) {
+	primary := &reconnectingBroker{failures: 2}
+	backoff := new(countingBackoff)
+	failoverBroker := NewFailoverBroker(primary, new(reconnectingBroker)).(*FailoverBroker)
+	failoverBroker.SetReconnectBackoff(backoff)
+
+	if err := failoverBroker.consumeUntilStopped(primary, "test_worker", new(fakeProcessor)); err != nil {
+		t.Errorf("failoverBroker.consumeUntilStopped() error = %v, want nil", err)
+	}
+
+	// The configured backoff spaces out reconnects
+	if backoff.delays != 2 {
+		t.Errorf("backoff.delays = %v, want 2", backoff.delays)
+	}
+}
@@ -1,16 +1,96 @@
 package brokers
 
-import "github.com/RichardKnop/machinery/v1/signatures"
+import (
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
 
 // Broker - a common interface for all brokers
 type Broker interface {
 	StartConsuming(consumerTag string, p TaskProcessor) (bool, error)
 	StopConsuming()
+	Drain(p TaskProcessor) error
+	DeclareTopology() error
+	SetOnFailure(hook func(err *HandlerError))
 	Publish(task *signatures.TaskSignature) error
+	PublishAuditEvent(routingKey string, event interface{}) error
+	PublishReply(replyTo, correlationID, contentType string, reply interface{}) error
+	Close() error
+}
+
+// HookedBroker - brokers reporting on the messages they consume, such as
+// AMQPBroker, or FailoverBroker passing the hooks on to both its brokers
+type HookedBroker interface {
+	SetPositionStore(positionStore backends.PositionStore)
+	SetOnDecoded(hook func(decoder string))
+	SetOnLatency(hook func(queue string, latency time.Duration))
+	SetOutcomeRecorder(recorder OutcomeRecorder, workerID string)
+}
+
+// GracefulBroker - brokers which can wait for messages being processed
+// once consuming has been stopped, or abort processing them
+type GracefulBroker interface {
+	WaitConsuming(timeout time.Duration) bool
+	AbortConsuming()
+}
+
+// RetryPublisher - brokers which can publish a failed task to be retried
+// after a delay (see RetryQueue)
+type RetryPublisher interface {
+	PublishRetry(signature *signatures.TaskSignature, delay time.Duration) error
 }
 
 // TaskProcessor - can process a delivered task
 // This will probably always be a worker instance
 type TaskProcessor interface {
-	Process(signature *signatures.TaskSignature)
+	Process(signature *signatures.TaskSignature) error
+	Validate(signature *signatures.TaskSignature) error
+}
+
+// RawDeliveryHandler - handles raw AMQP deliveries bypassing task decoding
+type RawDeliveryHandler func(d amqp.Delivery) error
+
+// SchemaRegistry - validates task payloads against registered schemas,
+// e.g. backed by Confluent Schema Registry or local schema files
+type SchemaRegistry interface {
+	// Validate checks the signature before it is published and
+	// returns version of the schema it conforms to
+	Validate(signature *signatures.TaskSignature) (string, error)
+	// CheckCompatibility checks a consumed signature published with
+	// the given schema version can be processed
+	CheckCompatibility(signature *signatures.TaskSignature, version string) error
+}
+
+// FeatureGate - tells whether tasks of a type may be processed, e.g. backed
+// by a feature flag service, so operators can switch a buggy task type off
+// fleet-wide without redeploying
+type FeatureGate interface {
+	Enabled(taskName string) bool
+}
+
+// BatchPublishResult tells which signatures of a published batch, by index,
+// were confirmed by the broker. Nacked signatures were rejected by the broker
+// or could not be published and can safely be published again. The outcome
+// of unconfirmed signatures is unknown, e.g. because the connection was lost,
+// publishing them again could duplicate them.
+type BatchPublishResult struct {
+	Confirmed   []int
+	Nacked      []int
+	Unconfirmed []int
+}
+
+// PublishResult tells where a published signature went: the exchange,
+// the routing key it resolved to, the size of the encoded body and the
+// message ID (the task UUID). Confirmed is false if the broker rejected
+// the message or the outcome is unknown, e.g. because the connection
+// was lost before the broker confirmed it.
+type PublishResult struct {
+	Exchange   string
+	RoutingKey string
+	BodySize   int
+	MessageID  string
+	Confirmed  bool
 }
@@ -0,0 +1,129 @@
+package brokers
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Number of most recent latencies of a queue percentiles are computed over
+const latencyWindow = 1024
+
+// LatencyStats describes how long tasks of a queue took from being
+// published until they were processed: percentiles over the most recent
+// tasks and how many were observed since the broker was created
+type LatencyStats struct {
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+	Count int64
+}
+
+// latencies keeps a sliding window of latencies of each queue
+type latencies struct {
+	queues map[string]*latencyWindowState
+	mutex  sync.Mutex
+}
+
+type latencyWindowState struct {
+	samples []time.Duration
+	next    int
+	count   int64
+}
+
+// Records the latency of a task of the queue
+func (l *latencies) observe(queue string, latency time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.queues == nil {
+		l.queues = make(map[string]*latencyWindowState)
+	}
+	window, ok := l.queues[queue]
+	if !ok {
+		window = new(latencyWindowState)
+		l.queues[queue] = window
+	}
+
+	if len(window.samples) < latencyWindow {
+		window.samples = append(window.samples, latency)
+	} else {
+		window.samples[window.next] = latency
+		window.next = (window.next + 1) % latencyWindow
+	}
+	window.count++
+}
+
+// Returns the percentiles of each queue
+func (l *latencies) stats() map[string]LatencyStats {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	stats := make(map[string]LatencyStats, len(l.queues))
+	for queue, window := range l.queues {
+		sorted := make([]time.Duration, len(window.samples))
+		copy(sorted, window.samples)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		stats[queue] = LatencyStats{
+			P50:   percentile(sorted, 0.5),
+			P95:   percentile(sorted, 0.95),
+			P99:   percentile(sorted, 0.99),
+			Count: window.count,
+		}
+	}
+	return stats
+}
+
+// Returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Returns the names of the consumed queues by the channel acknowledging
+// their deliveries, which tells the queue of a delivery apart even when
+// the queues share a pool
+func queuesByChannel(consumers []*queueConsumer) map[amqp.Acknowledger]string {
+	queues := make(map[amqp.Acknowledger]string, len(consumers))
+	for _, consumer := range consumers {
+		if consumer.channel != nil {
+			queues[consumer.channel] = consumer.queue.Name
+		}
+	}
+	return queues
+}
+
+// Records the latency of a processed delivery, from the time it was
+// published until now. Deliveries published without a timestamp, e.g.
+// by other clients, are skipped.
+func (amqpBroker *AMQPBroker) observeLatency(queue string, d amqp.Delivery) {
+	if d.Timestamp.IsZero() {
+		return
+	}
+	latency := time.Since(d.Timestamp)
+	if latency < 0 {
+		latency = 0 // clocks of publishers and consumers drift apart
+	}
+
+	amqpBroker.latencies.observe(queue, latency)
+	if amqpBroker.onLatency != nil {
+		amqpBroker.onLatency(queue, latency)
+	}
+}
+
+// LatencyStats returns p50, p95 and p99 latencies by queue, from the time
+// tasks were published until they were processed, e.g. to serve them on a
+// debug endpoint
+func (amqpBroker *AMQPBroker) LatencyStats() map[string]LatencyStats {
+	return amqpBroker.latencies.stats()
+}
@@ -0,0 +1,58 @@
+package brokers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/streadway/amqp"
+)
+
+func TestLatencies(t *testing.T) {
+	l := new(latencies)
+	for i := 1; i <= 100; i++ {
+		l.observe("fast", time.Duration(i)*time.Millisecond)
+	}
+	l.observe("slow", time.Minute)
+
+	stats := l.stats()
+	if want := (LatencyStats{P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond, Count: 100}); stats["fast"] != want {
+		t.Errorf("stats[fast] = %+v, want %+v", stats["fast"], want)
+	}
+	if want := (LatencyStats{P50: time.Minute, P95: time.Minute, P99: time.Minute, Count: 1}); stats["slow"] != want {
+		t.Errorf("stats[slow] = %+v, want %+v", stats["slow"], want)
+	}
+
+	// Percentiles only cover the most recent latencies
+	for i := 0; i < latencyWindow; i++ {
+		l.observe("fast", time.Second)
+	}
+	if stats := l.stats()["fast"]; stats.P50 != time.Second || stats.Count != 100+latencyWindow {
+		t.Errorf("stats[fast] = %+v, want P50 1s over the window", stats)
+	}
+}
+
+func TestObserveLatency(t *testing.T) {
+	broker := NewAMQPBroker(new(config.Config), make(chan int)).(*AMQPBroker)
+
+	var observed []string
+	broker.SetOnLatency(func(queue string, latency time.Duration) {
+		if latency < time.Second {
+			t.Errorf("latency = %v, want at least 1s", latency)
+		}
+		observed = append(observed, queue)
+	})
+
+	channel := new(amqp.Channel)
+	queues := queuesByChannel([]*queueConsumer{{channel: channel, queue: amqp.Queue{Name: "machinery_tasks"}}})
+
+	broker.observeLatency(queues[channel], amqp.Delivery{Acknowledger: channel, Timestamp: time.Now().Add(-time.Second)})
+	broker.observeLatency(queues[channel], amqp.Delivery{Acknowledger: channel})
+
+	if len(observed) != 1 || observed[0] != "machinery_tasks" {
+		t.Errorf("observed = %v, want [machinery_tasks] without the untimestamped delivery", observed)
+	}
+	if stats := broker.LatencyStats()["machinery_tasks"]; stats.Count != 1 {
+		t.Errorf("LatencyStats() count = %d, want 1", stats.Count)
+	}
+}
@@ -0,0 +1,176 @@
+package brokers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
+
+// Delivery is a consumed task pulled from Messages. The caller is
+// responsible for acknowledging it. Its outcome is recorded (see
+// SetOutcomeRecorder) once it is: a success when acked, a retry when
+// requeued and a failure otherwise.
+type Delivery struct {
+	Signature *signatures.TaskSignature
+	delivery  amqp.Delivery
+	broker    *AMQPBroker
+	start     time.Time
+}
+
+// Ack acknowledges the message
+func (delivery *Delivery) Ack() error {
+	delivery.recordOutcome(OutcomeSuccess)
+	return delivery.delivery.Ack(false) // multiple false
+}
+
+// Nack rejects the message, requeueing it or letting it be dead lettered
+// (if configured)
+func (delivery *Delivery) Nack(requeue bool) error {
+	if requeue {
+		delivery.recordOutcome(OutcomeRetry)
+	} else {
+		delivery.recordOutcome(OutcomeFailure)
+	}
+	return delivery.delivery.Nack(false, requeue) // multiple false
+}
+
+func (delivery *Delivery) recordOutcome(outcome string) {
+	if delivery.broker != nil {
+		delivery.broker.recordOutcome(delivery.Signature, delivery.start, delivery.Signature.GetAttempt()+1, outcome, nil)
+	}
+}
+
+// Messages starts consuming the default queue and returns a channel of
+// decoded tasks to range over, for callers which own their main loop and
+// control concurrency and acknowledgment themselves. Messages which fail
+// verification (see Verifier), can't be decoded or are screened out, e.g.
+// stale tasks, tasks rejected by AcceptPredicate or of types switched off
+// by the feature gate, are handled like when pushed to a TaskProcessor and
+// never sent. The channel is closed once consuming stops, after
+// StopConsuming or when the connection is lost.
+func (amqpBroker *AMQPBroker) Messages() (<-chan *Delivery, error) {
+	if !amqpBroker.claim() {
+		return nil, ErrAlreadyConsuming
+	}
+
+	conn, channel, queue, err := open(amqpBroker.config)
+	if err != nil {
+		amqpBroker.unclaim()
+		return nil, err
+	}
+
+	prefetchCount := amqpBroker.config.PrefetchCount
+	if prefetchCount == 0 {
+		prefetchCount = 3
+	}
+
+	if err := channel.Qos(
+		prefetchCount, // prefetch count
+		0,             // prefetch size
+		false,         // global
+	); err != nil {
+		closeConn(channel, conn)
+		amqpBroker.unclaim()
+		return nil, fmt.Errorf("Channel Qos: %s", err)
+	}
+
+	deliveries, err := channel.Consume(
+		queue.Name, // queue
+		"",         // consumer tag
+		false,      // auto-ack
+		false,      // exclusive
+		false,      // no-local
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		closeConn(channel, conn)
+		amqpBroker.unclaim()
+		return nil, fmt.Errorf("Queue Consume: %s", err)
+	}
+
+	messages := make(chan *Delivery)
+
+	amqpBroker.consuming.Add(1)
+	go func() {
+		defer amqpBroker.consuming.Done()
+		defer amqpBroker.unclaim()
+		defer closeConn(channel, conn)
+		defer close(messages)
+
+		for {
+			select {
+			case <-amqpBroker.stopChan:
+				return
+			case d, ok := <-deliveries:
+				if !ok {
+					return
+				}
+
+				delivery := amqpBroker.pull(d)
+				if delivery == nil {
+					continue
+				}
+
+				// Unacked messages are requeued when the channel
+				// is closed if the caller stops reading
+				select {
+				case messages <- delivery:
+				case <-amqpBroker.stopChan:
+					return
+				}
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+// Decodes and screens a pulled delivery, returns nil if it was dropped
+func (amqpBroker *AMQPBroker) pull(d amqp.Delivery) *Delivery {
+	start := time.Now()
+
+	if amqpBroker.tooLarge(d.Body) {
+		d.Nack(false, false) // multiple, requeue both false
+		d.Body = nil         // keep the body out of the failure log
+		amqpBroker.handleFailure(ErrMessageTooLarge, d)
+		amqpBroker.recordOutcome(nil, start, 0, OutcomeDropped, ErrMessageTooLarge)
+		return nil
+	}
+
+	if err := amqpBroker.verify(d); err != nil {
+		amqpBroker.recordOutcome(nil, start, 0, OutcomeDropped, err)
+		return nil
+	}
+
+	signature, err := amqpBroker.decode(d)
+	if err != nil {
+		d.Nack(false, false) // multiple, requeue both false
+		amqpBroker.handleFailure(err, d)
+		amqpBroker.recordOutcome(nil, start, 0, OutcomeDropped, err)
+		return nil
+	}
+
+	attempt := signature.GetAttempt() + 1
+	if err := amqpBroker.screen(signature); err != nil {
+		amqpBroker.drop(d, err)
+		amqpBroker.recordOutcome(signature, start, attempt, OutcomeDropped, err)
+		return nil
+	}
+
+	if !amqpBroker.accepts(signature) {
+		requeueLater(d)
+		amqpBroker.recordOutcome(signature, start, attempt, OutcomeDeferred, nil)
+		return nil
+	}
+
+	if amqpBroker.featureGate != nil && !amqpBroker.featureGate.Enabled(signature.Name) {
+		amqpBroker.hold(d, signature)
+		amqpBroker.recordOutcome(signature, start, attempt, OutcomeDeferred, nil)
+		return nil
+	}
+
+	return &Delivery{Signature: signature, delivery: d, broker: amqpBroker, start: start}
+}
@@ -0,0 +1,106 @@
+package brokers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/RichardKnop/machinery/v1/utils"
+	"github.com/streadway/amqp"
+)
+
+func TestPull(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	acknowledger := new(fakeAcknowledger)
+	delivery := broker.pull(amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`{"Name":"add"}`),
+	})
+	if delivery == nil || delivery.Signature.Name != "add" {
+		t.Fatalf("broker.pull() = %+v, want add", delivery)
+	}
+
+	// The caller acknowledges
+	if acknowledger.acked || acknowledger.rejected {
+		t.Errorf("acknowledger = %+v, want untouched", *acknowledger)
+	}
+	delivery.Ack()
+	if !acknowledger.acked {
+		t.Errorf("acknowledger = %+v, want acked", *acknowledger)
+	}
+
+	// Stale tasks are dropped
+	acknowledger = new(fakeAcknowledger)
+	delivery = broker.pull(amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`{"Name":"add","ValidUntil":"` + time.Now().Add(-time.Hour).Format(time.RFC3339) + `"}`),
+	})
+	if delivery != nil || !acknowledger.acked {
+		t.Errorf("broker.pull() = %+v, acknowledger = %+v, want dropped", delivery, *acknowledger)
+	}
+
+	// Undecodable messages are rejected
+	acknowledger = new(fakeAcknowledger)
+	delivery = broker.pull(amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`not json`),
+	})
+	if delivery != nil || !acknowledger.rejected {
+		t.Errorf("broker.pull() = %+v, acknowledger = %+v, want rejected", delivery, *acknowledger)
+	}
+}
+
+func TestPullVerifier(t *testing.T) {
+	signer, err := utils.NewHMACSigner("1", map[string][]byte{"1": []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := NewAMQPBroker(&config.Config{Signer: signer, Verifier: signer}, make(chan int)).(*AMQPBroker)
+
+	var failures []error
+	broker.SetOnFailure(func(err *HandlerError) {
+		failures = append(failures, err.Err)
+	})
+
+	publishing, err := broker.prepare(&signatures.TaskSignature{Name: "add"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acknowledger := new(fakeAcknowledger)
+	delivery := broker.pull(amqp.Delivery{Acknowledger: acknowledger, Body: publishing.Body, Headers: publishing.Headers})
+	if delivery == nil || delivery.Signature.Name != "add" {
+		t.Errorf("broker.pull() = %+v, want add", delivery)
+	}
+
+	// Forged messages are quarantined, rejected without QuarantineQueue
+	acknowledger = new(fakeAcknowledger)
+	delivery = broker.pull(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(`{"Name":"delete"}`), Headers: publishing.Headers})
+	if delivery != nil || !acknowledger.rejected {
+		t.Errorf("broker.pull() = %+v, acknowledger = %+v, want rejected", delivery, *acknowledger)
+	}
+	if len(failures) != 1 || failures[0] != utils.ErrInvalidSignature {
+		t.Errorf("failures = %v, want invalid signature", failures)
+	}
+}
+
+func TestPullFeatureGate(t *testing.T) {
+	defer func(delay time.Duration) { requeueDelay = delay }(requeueDelay)
+	requeueDelay = time.Millisecond
+
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+	broker.SetFeatureGate(switchedOff{"add": true})
+
+	acknowledger := newRequeueAcknowledger()
+	delivery := broker.pull(amqp.Delivery{Acknowledger: acknowledger, Body: []byte(`{"Name":"add"}`)})
+	if delivery != nil || !acknowledger.requeued(time.Second) {
+		t.Errorf("broker.pull() = %+v, want add held", delivery)
+	}
+
+	delivery = broker.pull(amqp.Delivery{Acknowledger: newRequeueAcknowledger(), Body: []byte(`{"Name":"multiply"}`)})
+	if delivery == nil || delivery.Signature.Name != "multiply" {
+		t.Errorf("broker.pull() = %+v, want multiply", delivery)
+	}
+}
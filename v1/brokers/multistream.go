@@ -0,0 +1,179 @@
+package brokers
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/utils"
+)
+
+// Stream is a queue consumed by a MultiStreamConsumer along with the
+// processor its tasks are handed to
+type Stream struct {
+	Queue     config.ConsumedQueue
+	Processor TaskProcessor
+}
+
+// MultiStreamConsumer consumes many logically distinct streams under one
+// lifecycle over a shared connection. Each stream is consumed on its own
+// channel with its own pool, processor and stats, by a broker of its own
+// configured by the shared configuration.
+type MultiStreamConsumer struct {
+	config   *config.Config
+	streams  map[string]Stream
+	brokers  map[string]*AMQPBroker
+	stopChan chan int
+}
+
+// NewMultiStreamConsumer creates MultiStreamConsumer instance consuming the
+// streams by name
+func NewMultiStreamConsumer(cnf *config.Config, streams map[string]Stream) *MultiStreamConsumer {
+	brokers := make(map[string]*AMQPBroker, len(streams))
+	for name := range streams {
+		brokers[name] = NewAMQPBroker(cnf, make(chan int, 1)).(*AMQPBroker)
+	}
+
+	return &MultiStreamConsumer{
+		config:   cnf,
+		streams:  streams,
+		brokers:  brokers,
+		stopChan: make(chan int, 1),
+	}
+}
+
+// Broker returns the broker consuming the named stream, e.g. to set its
+// failure hook or feature gate, or nil if there is no such stream
+func (multiStreamConsumer *MultiStreamConsumer) Broker(name string) *AMQPBroker {
+	return multiStreamConsumer.brokers[name]
+}
+
+// StartConsuming declares the queues of the streams, bound to the exchange
+// with their binding keys, and consumes all of them until StopConsuming is
+// called. If consuming a stream fails, the others are stopped as well and
+// the error is returned, to be retried like Broker.StartConsuming.
+func (multiStreamConsumer *MultiStreamConsumer) StartConsuming(consumerTag string) (bool, error) {
+	cnf := multiStreamConsumer.config
+
+	conn, err := dial(cnf)
+	if err != nil {
+		return true, err // retry true
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		utils.Connections.Release()
+		return true, fmt.Errorf("Channel: %s", err) // retry true
+	}
+	defer closeConn(channel, conn)
+
+	if err := channel.ExchangeDeclare(
+		cnf.Exchange,     // name of the exchange
+		cnf.ExchangeType, // type
+		true,             // durable
+		false,            // delete when complete
+		false,            // internal
+		false,            // noWait
+		nil,              // arguments
+	); err != nil {
+		return true, &declareError{What: "Exchange", Err: err} // retry true
+	}
+
+	consumers := make(map[string]*queueConsumer, len(multiStreamConsumer.streams))
+	for name, stream := range multiStreamConsumer.streams {
+		if err := declareConsumedQueue(channel, cnf, stream.Queue); err != nil {
+			return true, err // retry true
+		}
+
+		consumer, err := consumeQueue(conn, consumerTag, stream.Queue)
+		if err != nil {
+			return true, err // retry true
+		}
+		defer consumer.channel.Close()
+
+		consumers[name] = consumer
+	}
+
+	log.Printf("[*] Waiting for messages of %d streams. To exit press CTRL+C", len(consumers))
+
+	errChan := make(chan error, len(consumers))
+	var consuming sync.WaitGroup
+	for name, consumer := range consumers {
+		broker := multiStreamConsumer.brokers[name]
+		processor := multiStreamConsumer.streams[name].Processor
+
+		state := broker.consumerState(consumerTag)
+		state.connect()
+		defer state.disconnect()
+
+		consuming.Add(1)
+		go func(name string, broker *AMQPBroker, consumer *queueConsumer) {
+			defer consuming.Done()
+
+			err := broker.consume([]*queueConsumer{consumer}, consumerTag, processor)
+			if err != nil {
+				err = fmt.Errorf("Stream %s: %v", name, err)
+			}
+			errChan <- err
+		}(name, broker, consumer)
+	}
+
+	// Streams only return on their own when they fail, stop the others
+	var consumeErr error
+	select {
+	case <-multiStreamConsumer.stopChan:
+	case consumeErr = <-errChan:
+	}
+	for _, broker := range multiStreamConsumer.brokers {
+		broker.StopConsuming()
+	}
+	consuming.Wait()
+
+	// Forget stop signals of streams which had already returned
+	for _, broker := range multiStreamConsumer.brokers {
+		select {
+		case <-broker.stopChan:
+		default:
+		}
+	}
+
+	if consumeErr != nil {
+		return true, consumeErr // retry true
+	}
+	return false, nil
+}
+
+// StopConsuming stops consuming all streams
+func (multiStreamConsumer *MultiStreamConsumer) StopConsuming() {
+	select {
+	case multiStreamConsumer.stopChan <- 1:
+	default:
+	}
+}
+
+// Stats returns stats of each stream by name
+func (multiStreamConsumer *MultiStreamConsumer) Stats() map[string]BrokerStats {
+	stats := make(map[string]BrokerStats, len(multiStreamConsumer.brokers))
+	for name, broker := range multiStreamConsumer.brokers {
+		// Brokers of streams only consume with the tag of StartConsuming
+		var streamStats BrokerStats
+		for _, consumerStats := range broker.StatsByConsumer() {
+			streamStats = consumerStats
+		}
+		stats[name] = streamStats
+	}
+	return stats
+}
+
+// Close closes the publish connections of the streams' brokers, used to
+// retry and hold their tasks
+func (multiStreamConsumer *MultiStreamConsumer) Close() error {
+	for name, broker := range multiStreamConsumer.brokers {
+		if err := broker.Close(); err != nil {
+			return fmt.Errorf("Stream %s: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package brokers
+
+import (
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/config"
+)
+
+func TestMultiStreamConsumer(t *testing.T) {
+	multiStreamConsumer := NewMultiStreamConsumer(&config.Config{}, map[string]Stream{
+		"orders":   Stream{Queue: config.ConsumedQueue{Name: "orders"}, Processor: new(fakeProcessor)},
+		"invoices": Stream{Queue: config.ConsumedQueue{Name: "invoices"}, Processor: new(fakeProcessor)},
+	})
+
+	orders := multiStreamConsumer.Broker("orders")
+	if orders == nil || orders == multiStreamConsumer.Broker("invoices") {
+		t.Fatal("multiStreamConsumer.Broker() should return a broker per stream")
+	}
+	if multiStreamConsumer.Broker("unknown") != nil {
+		t.Error("multiStreamConsumer.Broker(unknown) should return nil")
+	}
+
+	// Stats are kept per stream
+	state := orders.consumerState("consumer")
+	state.connect()
+	state.record(nil)
+
+	stats := multiStreamConsumer.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("multiStreamConsumer.Stats() = %v, want stats of 2 streams", stats)
+	}
+	if stats["orders"].Processed != 1 || !stats["orders"].Connected {
+		t.Errorf("stats[orders] = %+v, want 1 processed, connected", stats["orders"])
+	}
+	if stats["invoices"].Processed != 0 || stats["invoices"].Connected {
+		t.Errorf("stats[invoices] = %+v, want none processed, disconnected", stats["invoices"])
+	}
+}
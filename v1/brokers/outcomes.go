@@ -0,0 +1,136 @@
+package brokers
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+const (
+	// OutcomeSuccess - the task succeeded
+	OutcomeSuccess = "success"
+	// OutcomeRetry - the task failed and runs again
+	OutcomeRetry = "retry"
+	// OutcomeFailure - the task failed for good
+	OutcomeFailure = "failure"
+	// OutcomeDropped - the message was dropped without running the task,
+	// e.g. because it expired or could not be decoded
+	OutcomeDropped = "dropped"
+	// OutcomeDeferred - the task didn't run and runs later, e.g. because
+	// its type is switched off or a concurrency limit was reached
+	OutcomeDeferred = "deferred"
+)
+
+// TaskOutcome is a structured record of the disposition of a consumed
+// task. Attempt counts from 1. Dropped messages which could not be decoded
+// have no UUID, name and attempt.
+type TaskOutcome struct {
+	TaskUUID string
+	TaskName string
+	Start    time.Time
+	End      time.Time
+	Outcome  string
+	Error    string
+	Attempt  int
+	WorkerID string
+}
+
+// OutcomeRecorder receives a record of every consumed task once its
+// message has been acked, nacked or rejected, e.g. to keep a machine
+// parseable processing log
+type OutcomeRecorder interface {
+	RecordOutcome(outcome *TaskOutcome)
+}
+
+// JSONLinesRecorder writes outcome records as JSON lines
+type JSONLinesRecorder struct {
+	writer io.Writer
+	mutex  sync.Mutex
+}
+
+// NewJSONLinesRecorder creates JSONLinesRecorder instance writing to writer
+func NewJSONLinesRecorder(writer io.Writer) *JSONLinesRecorder {
+	return &JSONLinesRecorder{writer: writer}
+}
+
+// OpenJSONLinesRecorder creates JSONLinesRecorder instance appending to the
+// file at path, created if it doesn't exist
+func OpenJSONLinesRecorder(path string) (*JSONLinesRecorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesRecorder(file), nil
+}
+
+// RecordOutcome implements the OutcomeRecorder interface
+func (recorder *JSONLinesRecorder) RecordOutcome(outcome *TaskOutcome) {
+	line, err := json.Marshal(outcome)
+	if err != nil {
+		log.Printf("Failed encoding outcome of %s. Error = %v", outcome.TaskUUID, err)
+		return
+	}
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if _, err := recorder.writer.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed recording outcome of %s. Error = %v", outcome.TaskUUID, err)
+	}
+}
+
+// Close closes the file of a recorder created by OpenJSONLinesRecorder
+func (recorder *JSONLinesRecorder) Close() error {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if closer, ok := recorder.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Records the outcome of a consumed task, if an outcome recorder is set.
+// The signature is nil for messages which could not be decoded.
+func (amqpBroker *AMQPBroker) recordOutcome(signature *signatures.TaskSignature, start time.Time, attempt int, outcome string, err error) {
+	if amqpBroker.outcomes == nil {
+		return
+	}
+
+	taskOutcome := &TaskOutcome{
+		Start:    start.UTC(),
+		End:      time.Now().UTC(),
+		Outcome:  outcome,
+		Attempt:  attempt,
+		WorkerID: amqpBroker.workerID,
+	}
+	if signature != nil {
+		taskOutcome.TaskUUID = signature.UUID
+		taskOutcome.TaskName = signature.Name
+	}
+	if err != nil {
+		taskOutcome.Error = err.Error()
+	}
+	amqpBroker.outcomes.RecordOutcome(taskOutcome)
+}
+
+// Returns the outcome of a processed task. Failed tasks which have been
+// republished to be retried have their attempt stamped, failed tasks whose
+// message is requeued run again as well.
+func processedOutcome(signature *signatures.TaskSignature, attempt int, err error, requeued bool) string {
+	if err == nil {
+		return OutcomeSuccess
+	}
+	if isDeferred(err) {
+		return OutcomeDeferred
+	}
+	if requeued || signature.GetAttempt() >= attempt {
+		return OutcomeRetry
+	}
+	return OutcomeFailure
+}
@@ -0,0 +1,163 @@
+package brokers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
+
+func TestRecordOutcome(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{AckAfterResult: true}, make(chan int)).(*AMQPBroker)
+
+	var records bytes.Buffer
+	broker.SetOutcomeRecorder(NewJSONLinesRecorder(&records), "worker-1")
+
+	testCases := []struct {
+		body    string
+		err     error
+		outcome string
+	}{
+		{`{"UUID":"1","Name":"add"}`, nil, OutcomeSuccess},
+		{`{"UUID":"2","Name":"add"}`, errors.New("failed"), OutcomeFailure},
+		{`{"UUID":"3","Name":"add"}`, &StateNotStoredError{Err: errors.New("unavailable")}, OutcomeRetry},
+		{`{"UUID":"4","Name":"add","ValidUntil":"2000-01-01T00:00:00Z"}`, nil, OutcomeDropped},
+	}
+
+	for _, testCase := range testCases {
+		d := amqp.Delivery{Acknowledger: new(fakeAcknowledger), Body: []byte(testCase.body)}
+		broker.consumeOne(d, &fakeProcessor{err: testCase.err})
+	}
+
+	lines := strings.Split(strings.TrimSpace(records.String()), "\n")
+	if len(lines) != len(testCases) {
+		t.Fatalf("len(lines) = %d, want %d", len(lines), len(testCases))
+	}
+	for i, line := range lines {
+		outcome := new(TaskOutcome)
+		if err := json.Unmarshal([]byte(line), outcome); err != nil {
+			t.Fatal(err)
+		}
+
+		testCase := testCases[i]
+		if outcome.Outcome != testCase.outcome || outcome.Attempt != 1 || outcome.WorkerID != "worker-1" || outcome.TaskName != "add" {
+			t.Errorf("outcome = %+v, want %s of attempt 1 by worker-1", outcome, testCase.outcome)
+		}
+		if outcome.End.Before(outcome.Start) {
+			t.Errorf("outcome ended at %v before it started at %v", outcome.End, outcome.Start)
+		}
+		if testCase.err != nil && outcome.Error != testCase.err.Error() {
+			t.Errorf("outcome error = %q, want %q", outcome.Error, testCase.err.Error())
+		}
+	}
+}
+
+// Decodes the recorded outcomes
+func recordedOutcomes(t *testing.T, records *bytes.Buffer) []*TaskOutcome {
+	var outcomes []*TaskOutcome
+	for _, line := range strings.Split(strings.TrimSpace(records.String()), "\n") {
+		outcome := new(TaskOutcome)
+		if err := json.Unmarshal([]byte(line), outcome); err != nil {
+			t.Fatal(err)
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
+}
+
+func TestRecordOutcomeDeferred(t *testing.T) {
+	defer func(delay time.Duration) { requeueDelay = delay }(requeueDelay)
+	requeueDelay = time.Millisecond
+
+	broker := NewAMQPBroker(&config.Config{
+		AcceptPredicate: func(signature *signatures.TaskSignature) bool {
+			return signature.Name != "foreign"
+		},
+	}, make(chan int)).(*AMQPBroker)
+	broker.SetFeatureGate(switchedOff{"held": true})
+
+	var records bytes.Buffer
+	broker.SetOutcomeRecorder(NewJSONLinesRecorder(&records), "worker-1")
+
+	testCases := []struct {
+		body string
+		err  error
+	}{
+		{`{"UUID":"1","Name":"foreign"}`, nil},
+		{`{"UUID":"2","Name":"held"}`, nil},
+		// Deferred by the processor and published again, not a success
+		{`{"UUID":"3","Name":"add"}`, &DeferredError{Reason: errors.New("limit reached")}},
+	}
+
+	for _, testCase := range testCases {
+		d := amqp.Delivery{Acknowledger: newRequeueAcknowledger(), Body: []byte(testCase.body)}
+		broker.consumeOne(d, &fakeProcessor{err: testCase.err})
+	}
+
+	outcomes := recordedOutcomes(t, &records)
+	if len(outcomes) != len(testCases) {
+		t.Fatalf("len(outcomes) = %d, want %d", len(outcomes), len(testCases))
+	}
+	for _, outcome := range outcomes {
+		if outcome.Outcome != OutcomeDeferred {
+			t.Errorf("%s outcome = %s, want %s", outcome.TaskName, outcome.Outcome, OutcomeDeferred)
+		}
+	}
+}
+
+func TestRecordOutcomeRawAndPulled(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	var records bytes.Buffer
+	broker.SetOutcomeRecorder(NewJSONLinesRecorder(&records), "worker-1")
+
+	// Handled by the raw delivery handler
+	broker.SetRawDeliveryHandler(func(d amqp.Delivery) error {
+		if d.ContentType == "application/x-foreign" {
+			return errors.New("failed")
+		}
+		return ErrNotHandled
+	})
+	d := amqp.Delivery{Acknowledger: new(fakeAcknowledger), ContentType: "application/x-foreign", Body: []byte("foreign")}
+	broker.consumeOne(d, new(fakeProcessor))
+
+	// Pulled and acked, requeued or rejected by the caller
+	for _, settle := range []func(delivery *Delivery) error{
+		(*Delivery).Ack,
+		func(delivery *Delivery) error { return delivery.Nack(true) },
+		func(delivery *Delivery) error { return delivery.Nack(false) },
+	} {
+		delivery := broker.pull(amqp.Delivery{Acknowledger: new(fakeAcknowledger), Body: []byte(`{"UUID":"1","Name":"add"}`)})
+		settle(delivery)
+	}
+
+	outcomes := recordedOutcomes(t, &records)
+	want := []string{OutcomeFailure, OutcomeSuccess, OutcomeRetry, OutcomeFailure}
+	if len(outcomes) != len(want) {
+		t.Fatalf("len(outcomes) = %d, want %d", len(outcomes), len(want))
+	}
+	for i, outcome := range outcomes {
+		if outcome.Outcome != want[i] {
+			t.Errorf("outcomes[%d] = %s, want %s", i, outcome.Outcome, want[i])
+		}
+	}
+}
+
+func TestProcessedOutcome(t *testing.T) {
+	signature := new(signatures.TaskSignature)
+	signature.StampRetry(errors.New("failed"))
+
+	// The task was republished with its attempt stamped
+	if outcome := processedOutcome(signature, 1, errors.New("failed"), false); outcome != OutcomeRetry {
+		t.Errorf("processedOutcome() = %s, want %s", outcome, OutcomeRetry)
+	}
+	if outcome := processedOutcome(signature, 2, errors.New("failed"), false); outcome != OutcomeFailure {
+		t.Errorf("processedOutcome() = %s, want %s", outcome, OutcomeFailure)
+	}
+}
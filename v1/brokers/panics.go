@@ -0,0 +1,64 @@
+package brokers
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// PanicError is returned when processing a task panicked
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error implements the error interface
+func (panicError *PanicError) Error() string {
+	return fmt.Sprintf("Panic: %v", panicError.Value)
+}
+
+// PanicReport is published to the panic queue when a task panics
+type PanicReport struct {
+	TaskUUID  string
+	TaskName  string
+	Args      []signatures.TaskArg
+	Message   string
+	Stack     string
+	Timestamp time.Time
+}
+
+// NewPanicReport creates PanicReport instance. Values of sensitive args
+// are redacted.
+func NewPanicReport(signature *signatures.TaskSignature, panicError *PanicError) *PanicReport {
+	args := make([]signatures.TaskArg, len(signature.Args))
+	for i, arg := range signature.Args {
+		args[i] = arg
+		if arg.Sensitive {
+			args[i].Value = RedactedValue
+		}
+	}
+
+	return &PanicReport{
+		TaskUUID:  signature.UUID,
+		TaskName:  signature.Name,
+		Args:      args,
+		Message:   fmt.Sprint(panicError.Value),
+		Stack:     string(panicError.Stack),
+		Timestamp: time.Now().UTC(),
+	}
+}
+
+// Processes the task, recovering a panic as PanicError
+func safeProcess(taskProcessor TaskProcessor, signature *signatures.TaskSignature) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			stack := make([]byte, 64<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			err = &PanicError{Value: value, Stack: stack}
+		}
+	}()
+
+	return taskProcessor.Process(signature)
+}
@@ -0,0 +1,90 @@
+package brokers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
+
+type panickingProcessor struct {
+	fakeProcessor
+}
+
+func (p *panickingProcessor) Process(signature *signatures.TaskSignature) error {
+	panic("boom")
+}
+
+func TestSafeProcess(t *testing.T) {
+	err := safeProcess(new(panickingProcessor), &signatures.TaskSignature{Name: "add"})
+
+	panicError, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("err = %v, want PanicError", err)
+	}
+	if panicError.Value != "boom" {
+		t.Errorf("panicError.Value = %v, want boom", panicError.Value)
+	}
+	if !strings.Contains(string(panicError.Stack), "Process") {
+		t.Errorf("panicError.Stack = %s, want the panicking frame", panicError.Stack)
+	}
+
+	if action := actionFor(err); action != ActionDeadLetter {
+		t.Errorf("actionFor(err) = %v, want %v", action, ActionDeadLetter)
+	}
+}
+
+func TestNewPanicReport(t *testing.T) {
+	signature := &signatures.TaskSignature{
+		UUID: "task_1",
+		Name: "login",
+		Args: []signatures.TaskArg{
+			signatures.TaskArg{Type: "string", Value: "john"},
+			signatures.TaskArg{Type: "string", Value: "secret", Sensitive: true},
+		},
+	}
+
+	report := NewPanicReport(signature, &PanicError{Value: "boom", Stack: []byte("stack")})
+	if report.TaskUUID != "task_1" || report.Message != "boom" || report.Stack != "stack" {
+		t.Errorf("report = %+v, want task_1 boom stack", report)
+	}
+	if report.Args[0].Value != "john" || report.Args[1].Value != RedactedValue {
+		t.Errorf("report.Args = %v, want sensitive arg redacted", report.Args)
+	}
+
+	// The signature itself is left intact
+	if signature.Args[1].Value != "secret" {
+		t.Errorf("signature.Args[1].Value = %v, want secret", signature.Args[1].Value)
+	}
+}
+
+func TestConsumeOnePanic(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{
+		AckAfterResult: true,
+	}, make(chan int)).(*AMQPBroker)
+
+	var failure *HandlerError
+	broker.SetOnFailure(func(err *HandlerError) {
+		failure = err
+	})
+
+	acknowledger := new(fakeAcknowledger)
+	d := amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`{"Name":"add"}`),
+	}
+
+	if err := broker.consumeOne(d, new(panickingProcessor)); err != nil {
+		t.Error(err)
+	}
+
+	if !acknowledger.rejected {
+		t.Errorf("acknowledger = %+v, want rejected", *acknowledger)
+	}
+
+	if _, ok := failure.Err.(*PanicError); !ok {
+		t.Errorf("failure = %v, want PanicError", failure)
+	}
+}
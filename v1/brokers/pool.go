@@ -0,0 +1,86 @@
+package brokers
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+var errDeliveriesClosed = errors.New("Delivery channel closed")
+
+// consumerPool is a pool of goroutines processing deliveries concurrently
+type consumerPool struct {
+	deliveries <-chan amqp.Delivery
+	handler    func(d amqp.Delivery) error
+	quitChans  []chan int
+	errChan    chan error
+	waitGroup  sync.WaitGroup
+}
+
+// Errors stopping the goroutines are reported to errChan, which
+// can be shared by several pools
+func newConsumerPool(deliveries <-chan amqp.Delivery, handler func(d amqp.Delivery) error, errChan chan error) *consumerPool {
+	return &consumerPool{
+		deliveries: deliveries,
+		handler:    handler,
+		errChan:    errChan,
+	}
+}
+
+// Returns number of running goroutines
+func (pool *consumerPool) size() int {
+	return len(pool.quitChans)
+}
+
+// Starts another goroutine
+func (pool *consumerPool) grow() {
+	quitChan := make(chan int, 1)
+	pool.quitChans = append(pool.quitChans, quitChan)
+	pool.waitGroup.Add(1)
+	go pool.run(quitChan)
+}
+
+// Stops a goroutine once it finishes processing its current delivery
+func (pool *consumerPool) shrink() {
+	last := len(pool.quitChans) - 1
+	pool.quitChans[last] <- 1
+	pool.quitChans = pool.quitChans[:last]
+}
+
+// Stops all goroutines and waits for in-flight deliveries to be processed
+func (pool *consumerPool) stop() {
+	for pool.size() > 0 {
+		pool.shrink()
+	}
+	pool.waitGroup.Wait()
+}
+
+func (pool *consumerPool) run(quitChan chan int) {
+	defer pool.waitGroup.Done()
+
+	for {
+		select {
+		case <-quitChan:
+			return
+		case d, ok := <-pool.deliveries:
+			if !ok {
+				pool.reportError(errDeliveriesClosed)
+				return
+			}
+
+			if err := pool.handler(d); err != nil {
+				pool.reportError(err)
+				return
+			}
+		}
+	}
+}
+
+// Only the first error is kept, it stops the consumer anyway
+func (pool *consumerPool) reportError(err error) {
+	select {
+	case pool.errChan <- err:
+	default:
+	}
+}
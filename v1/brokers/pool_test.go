@@ -0,0 +1,64 @@
+package brokers
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConsumerPool(t *testing.T) {
+	deliveries := make(chan amqp.Delivery)
+
+	var mutex sync.Mutex
+	processed := 0
+	pool := newConsumerPool(deliveries, func(d amqp.Delivery) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		processed++
+		return nil
+	}, make(chan error, 1))
+
+	pool.grow()
+	pool.grow()
+	if pool.size() != 2 {
+		t.Errorf("pool.size() = %v, want 2", pool.size())
+	}
+
+	for i := 0; i < 5; i++ {
+		deliveries <- amqp.Delivery{}
+	}
+
+	pool.shrink()
+	if pool.size() != 1 {
+		t.Errorf("pool.size() = %v, want 1", pool.size())
+	}
+
+	deliveries <- amqp.Delivery{}
+
+	pool.stop()
+	if pool.size() != 0 {
+		t.Errorf("pool.size() = %v, want 0", pool.size())
+	}
+
+	if processed != 6 {
+		t.Errorf("processed = %v, want 6", processed)
+	}
+}
+
+func TestConsumerPoolError(t *testing.T) {
+	deliveries := make(chan amqp.Delivery)
+	pool := newConsumerPool(deliveries, func(d amqp.Delivery) error {
+		return errors.New("oops")
+	}, make(chan error, 1))
+
+	pool.grow()
+	deliveries <- amqp.Delivery{}
+
+	if err := <-pool.errChan; err.Error() != "oops" {
+		t.Errorf("err = %v, want oops", err)
+	}
+
+	pool.stop()
+}
@@ -0,0 +1,87 @@
+package brokers
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// RabbitMQ header holding the offset of a message in a stream
+const streamOffsetHeader = "x-stream-offset"
+
+// positionTracker tracks offsets of stream messages being processed.
+// Messages are delivered in order but processed concurrently, so the
+// position is the offset below which all messages have been processed.
+type positionTracker struct {
+	inFlight map[int64]bool
+	received int64
+	started  bool
+	mutex    sync.Mutex
+}
+
+func newPositionTracker() *positionTracker {
+	return &positionTracker{inFlight: make(map[int64]bool)}
+}
+
+// Wraps a delivery handler to track offsets of the deliveries it handles
+func (tracker *positionTracker) track(handler func(d amqp.Delivery) error) func(d amqp.Delivery) error {
+	return func(d amqp.Delivery) error {
+		offset, ok := streamOffset(d)
+		if !ok {
+			return handler(d)
+		}
+
+		tracker.start(offset)
+		defer tracker.finish(offset)
+
+		return handler(d)
+	}
+}
+
+func (tracker *positionTracker) start(offset int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.inFlight[offset] = true
+	if !tracker.started || offset > tracker.received {
+		tracker.received = offset
+	}
+	tracker.started = true
+}
+
+func (tracker *positionTracker) finish(offset int64) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	delete(tracker.inFlight, offset)
+}
+
+// Returns the offset of the last message processed with all messages
+// before it, false if no message has been received yet
+func (tracker *positionTracker) position() (int64, bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if !tracker.started {
+		return 0, false
+	}
+
+	position := tracker.received
+	for offset := range tracker.inFlight {
+		if offset-1 < position {
+			position = offset - 1
+		}
+	}
+	return position, true
+}
+
+// Returns the stream offset of a delivery
+func streamOffset(d amqp.Delivery) (int64, bool) {
+	switch offset := d.Headers[streamOffsetHeader].(type) {
+	case int64:
+		return offset, true
+	case int32:
+		return int64(offset), true
+	}
+	return 0, false
+}
@@ -0,0 +1,53 @@
+package brokers
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPositionTracker(t *testing.T) {
+	tracker := newPositionTracker()
+
+	if _, ok := tracker.position(); ok {
+		t.Error("tracker.position() ok = true, want no position before receiving")
+	}
+
+	tracker.start(10)
+	tracker.start(11)
+	tracker.start(12)
+	if position, _ := tracker.position(); position != 9 {
+		t.Errorf("tracker.position() = %v, want 9", position)
+	}
+
+	// Messages processed out of order don't move the position past
+	// a message still in flight
+	tracker.finish(12)
+	tracker.finish(10)
+	if position, _ := tracker.position(); position != 10 {
+		t.Errorf("tracker.position() = %v, want 10", position)
+	}
+
+	tracker.finish(11)
+	if position, _ := tracker.position(); position != 12 {
+		t.Errorf("tracker.position() = %v, want 12", position)
+	}
+}
+
+func TestPositionTrackerTrack(t *testing.T) {
+	tracker := newPositionTracker()
+	handler := tracker.track(func(d amqp.Delivery) error {
+		return nil
+	})
+
+	handler(amqp.Delivery{Headers: amqp.Table{streamOffsetHeader: int64(7)}})
+	if position, ok := tracker.position(); !ok || position != 7 {
+		t.Errorf("tracker.position() = %v, %v, want 7", position, ok)
+	}
+
+	// Deliveries of classic queues have no offset
+	handler(amqp.Delivery{})
+	if position, _ := tracker.position(); position != 7 {
+		t.Errorf("tracker.position() = %v, want 7", position)
+	}
+}
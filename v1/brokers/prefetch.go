@@ -0,0 +1,69 @@
+package brokers
+
+import (
+	"sync"
+)
+
+// Sets the prefetch count of a channel, implemented by amqp.Channel
+type qosSetter interface {
+	Qos(prefetchCount, prefetchSize int, global bool) error
+}
+
+// prefetchController sets the prefetch count of a channel to the lowest of
+// the ramp (see PrefetchRampDuration) and the throttle (see
+// ThrottledPrefetchCount), so ramping up doesn't undo throttling and
+// restoring the prefetch after throttling doesn't skip the ramp
+type prefetchController struct {
+	channel  qosSetter
+	ramp     int
+	throttle int
+	applied  int
+	mutex    sync.Mutex
+}
+
+func newPrefetchController(channel qosSetter, prefetchCount int) *prefetchController {
+	return &prefetchController{
+		channel:  channel,
+		ramp:     prefetchCount,
+		throttle: prefetchCount,
+	}
+}
+
+// Sets the prefetch count the ramp got to, returns the one applied
+func (controller *prefetchController) setRamp(prefetchCount int) (int, error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.ramp = prefetchCount
+	return controller.apply()
+}
+
+// Sets the prefetch count the throttle allows, returns the one applied
+func (controller *prefetchController) setThrottle(prefetchCount int) (int, error) {
+	controller.mutex.Lock()
+	defer controller.mutex.Unlock()
+
+	controller.throttle = prefetchCount
+	return controller.apply()
+}
+
+// Applies the lowest of the limits, must be called with the mutex held
+func (controller *prefetchController) apply() (int, error) {
+	prefetchCount := controller.ramp
+	if controller.throttle < prefetchCount {
+		prefetchCount = controller.throttle
+	}
+	if prefetchCount == controller.applied {
+		return prefetchCount, nil
+	}
+
+	if err := controller.channel.Qos(
+		prefetchCount, // prefetch count
+		0,             // prefetch size
+		false,         // global
+	); err != nil {
+		return controller.applied, err
+	}
+	controller.applied = prefetchCount
+	return prefetchCount, nil
+}
@@ -0,0 +1,44 @@
+package brokers
+
+import (
+	"reflect"
+	"testing"
+)
+
+type qosRecorder struct {
+	prefetchCounts []int
+}
+
+func (recorder *qosRecorder) Qos(prefetchCount, prefetchSize int, global bool) error {
+	recorder.prefetchCounts = append(recorder.prefetchCounts, prefetchCount)
+	return nil
+}
+
+func TestPrefetchController(t *testing.T) {
+	recorder := new(qosRecorder)
+	prefetch := newPrefetchController(recorder, 10)
+
+	steps := []struct {
+		set           func(prefetchCount int) (int, error)
+		prefetchCount int
+		want          int
+	}{
+		{prefetch.setRamp, 1, 1},
+		{prefetch.setRamp, 5, 5},
+		{prefetch.setThrottle, 2, 2},
+		// Ramping up while throttled keeps the throttled prefetch count
+		{prefetch.setRamp, 8, 2},
+		{prefetch.setThrottle, 10, 8},
+		{prefetch.setRamp, 10, 10},
+	}
+	for _, step := range steps {
+		if applied, err := step.set(step.prefetchCount); err != nil || applied != step.want {
+			t.Errorf("set(%d) = %v, %v, want %v, nil", step.prefetchCount, applied, err, step.want)
+		}
+	}
+
+	// The channel's prefetch count is only set when it changes
+	if want := []int{1, 5, 2, 8, 10}; !reflect.DeepEqual(recorder.prefetchCounts, want) {
+		t.Errorf("recorder.prefetchCounts = %v, want %v", recorder.prefetchCounts, want)
+	}
+}
@@ -0,0 +1,56 @@
+package brokers
+
+import (
+	"sync"
+	"time"
+)
+
+// progress tracks since when in-flight messages are processed and how
+// many finished, telling a busy consumer from a stalled one
+type progress struct {
+	started  map[uint64]time.Time
+	nextID   uint64
+	finished int
+	mutex    sync.Mutex
+}
+
+// Records a message whose processing started, returns its ID to finish it
+func (p *progress) start() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.started == nil {
+		p.started = make(map[uint64]time.Time)
+	}
+	p.nextID++
+	p.started[p.nextID] = time.Now()
+	return p.nextID
+}
+
+// Records a message whose processing finished
+func (p *progress) finish(id uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.started, id)
+	p.finished++
+}
+
+// Returns the number of in-flight messages, for how long the oldest one
+// has been processed and the number of messages finished since the last
+// report
+func (p *progress) report() (int, time.Duration, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var oldest time.Duration
+	for _, started := range p.started {
+		if elapsed := time.Since(started); elapsed > oldest {
+			oldest = elapsed
+		}
+	}
+
+	finished := p.finished
+	p.finished = 0
+	return len(p.started), oldest, finished
+}
@@ -0,0 +1,30 @@
+package brokers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := new(progress)
+
+	first := p.start()
+	time.Sleep(5 * time.Millisecond)
+	second := p.start()
+	p.finish(second)
+
+	inFlight, oldest, finished := p.report()
+	if inFlight != 1 || finished != 1 || oldest < 5*time.Millisecond {
+		t.Errorf("p.report() = %v, %v, %v, want 1, at least 5ms, 1", inFlight, oldest, finished)
+	}
+
+	// Finished messages are counted since the last report
+	if _, _, finished := p.report(); finished != 0 {
+		t.Errorf("p.report() finished = %v, want 0", finished)
+	}
+
+	p.finish(first)
+	if inFlight, oldest, finished := p.report(); inFlight != 0 || oldest != 0 || finished != 1 {
+		t.Errorf("p.report() = %v, %v, %v, want 0, 0, 1", inFlight, oldest, finished)
+	}
+}
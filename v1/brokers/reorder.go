@@ -0,0 +1,120 @@
+package brokers
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
+
+// orderedDelivery is a sequenced task waiting for its turn
+type orderedDelivery struct {
+	sequence  int64
+	delivery  amqp.Delivery
+	signature *signatures.TaskSignature
+}
+
+// reorderBuffer holds sequenced tasks until their predecessors of the same
+// routing key have been processed. A gap in the sequence is waited for
+// until gapTimeout or until size tasks of the key are waiting, then it is
+// skipped. Tasks behind the expected sequence, e.g. redeliveries, are
+// processed right away.
+type reorderBuffer struct {
+	size       int
+	gapTimeout time.Duration
+	next       map[string]int64
+	pending    map[string][]*orderedDelivery
+	gapSince   map[string]time.Time
+	busy       map[string]bool
+	mutex      sync.Mutex
+}
+
+func newReorderBuffer(size int, gapTimeout time.Duration) *reorderBuffer {
+	return &reorderBuffer{
+		size:       size,
+		gapTimeout: gapTimeout,
+		next:       make(map[string]int64),
+		pending:    make(map[string][]*orderedDelivery),
+		gapSince:   make(map[string]time.Time),
+		busy:       make(map[string]bool),
+	}
+}
+
+// Adds a task to wait for its turn
+func (buffer *reorderBuffer) add(key string, ordered *orderedDelivery) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	pending := buffer.pending[key]
+	i := len(pending)
+	for i > 0 && pending[i-1].sequence > ordered.sequence {
+		i--
+	}
+	pending = append(pending, nil)
+	copy(pending[i+1:], pending[i:])
+	pending[i] = ordered
+	buffer.pending[key] = pending
+}
+
+// Returns the next task of the key if its turn has come and no other task
+// of the key is being processed, the caller must call done once processed
+func (buffer *reorderBuffer) take(key string) (*orderedDelivery, bool) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	pending := buffer.pending[key]
+	if buffer.busy[key] || len(pending) == 0 {
+		return nil, false
+	}
+
+	head := pending[0]
+	next, started := buffer.next[key]
+	if started && head.sequence > next {
+		gapSince, ok := buffer.gapSince[key]
+		if !ok {
+			gapSince = time.Now()
+			buffer.gapSince[key] = gapSince
+		}
+		if len(pending) < buffer.size && time.Since(gapSince) < buffer.gapTimeout {
+			return nil, false
+		}
+		log.Printf("Skipping %d missing tasks of %s", head.sequence-next, key)
+	}
+
+	if len(pending) == 1 {
+		delete(buffer.pending, key)
+	} else {
+		buffer.pending[key] = pending[1:]
+	}
+	delete(buffer.gapSince, key)
+	if !started || head.sequence >= next {
+		buffer.next[key] = head.sequence + 1
+	}
+	buffer.busy[key] = true
+
+	return head, true
+}
+
+// Marks the task of the key taken last as processed
+func (buffer *reorderBuffer) done(key string) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	delete(buffer.busy, key)
+}
+
+// Returns keys whose tasks wait for a gap which timed out
+func (buffer *reorderBuffer) gapped() []string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	var keys []string
+	for key, gapSince := range buffer.gapSince {
+		if !buffer.busy[key] && time.Since(gapSince) >= buffer.gapTimeout {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
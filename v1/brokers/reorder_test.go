@@ -0,0 +1,132 @@
+package brokers
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
+
+// Records names of processed tasks in order
+type orderingProcessor struct {
+	names []string
+}
+
+func (p *orderingProcessor) Process(signature *signatures.TaskSignature) error {
+	p.names = append(p.names, signature.Name)
+	return nil
+}
+
+func (p *orderingProcessor) Validate(signature *signatures.TaskSignature) error {
+	return nil
+}
+
+func TestReorderBuffer(t *testing.T) {
+	buffer := newReorderBuffer(3, time.Hour)
+	add := func(sequence int64) {
+		buffer.add("orders", &orderedDelivery{sequence: sequence})
+	}
+	take := func() int64 {
+		ordered, ok := buffer.take("orders")
+		if !ok {
+			return 0
+		}
+		buffer.done("orders")
+		return ordered.sequence
+	}
+
+	// The first task sets where the sequence starts
+	add(1)
+	if sequence := take(); sequence != 1 {
+		t.Errorf("take() = %v, want 1", sequence)
+	}
+
+	// Later tasks wait for the gap to be filled
+	add(3)
+	if sequence := take(); sequence != 0 {
+		t.Errorf("take() = %v, want nothing before 2", sequence)
+	}
+	add(2)
+	if sequence := take(); sequence != 2 {
+		t.Errorf("take() = %v, want 2", sequence)
+	}
+	if sequence := take(); sequence != 3 {
+		t.Errorf("take() = %v, want 3", sequence)
+	}
+
+	// Only one task of a key is processed at a time
+	add(4)
+	add(5)
+	if _, ok := buffer.take("orders"); !ok {
+		t.Fatal("take() = false, want 4")
+	}
+	if _, ok := buffer.take("orders"); ok {
+		t.Error("take() = true, want false while 4 is processed")
+	}
+	buffer.done("orders")
+	take()
+
+	// The gap is skipped once the buffer is full
+	add(7)
+	add(8)
+	if sequence := take(); sequence != 0 {
+		t.Errorf("take() = %v, want nothing before 6", sequence)
+	}
+	add(9)
+	if sequence := take(); sequence != 7 {
+		t.Errorf("take() = %v, want 7 once full", sequence)
+	}
+
+	// Tasks behind the sequence, e.g. redeliveries, go right away
+	add(2)
+	if sequence := take(); sequence != 2 {
+		t.Errorf("take() = %v, want 2", sequence)
+	}
+	if sequence := take(); sequence != 8 {
+		t.Errorf("take() = %v, want 8", sequence)
+	}
+}
+
+func TestReorderBufferGapTimeout(t *testing.T) {
+	buffer := newReorderBuffer(10, time.Millisecond)
+	buffer.add("orders", &orderedDelivery{sequence: 1})
+	buffer.take("orders")
+	buffer.done("orders")
+
+	buffer.add("orders", &orderedDelivery{sequence: 3})
+	if _, ok := buffer.take("orders"); ok {
+		t.Error("take() = true, want false before the gap timed out")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if keys := buffer.gapped(); len(keys) != 1 || keys[0] != "orders" {
+		t.Errorf("gapped() = %v, want [orders]", keys)
+	}
+	if ordered, ok := buffer.take("orders"); !ok || ordered.sequence != 3 {
+		t.Error("take() = false, want 3 once the gap timed out")
+	}
+}
+
+func TestConsumeOneReorders(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+	broker.reorder = newReorderBuffer(10, time.Hour)
+
+	processor := new(orderingProcessor)
+	for _, sequence := range []int{1, 3, 2} {
+		d := amqp.Delivery{
+			Acknowledger: new(fakeAcknowledger),
+			Headers:      amqp.Table{signatures.SequenceHeader: sequence},
+			Body:         []byte(fmt.Sprintf(`{"Name":"task%d","RoutingKey":"orders"}`, sequence)),
+		}
+		if err := broker.consumeOne(d, processor); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if len(processor.names) != 3 || processor.names[1] != "task2" || processor.names[2] != "task3" {
+		t.Errorf("processed %v, want [task1 task2 task3]", processor.names)
+	}
+}
@@ -0,0 +1,110 @@
+package brokers
+
+import (
+	"sync"
+	"time"
+)
+
+// ConsumerStats describes how busy the consumer is. Saturation is the ratio
+// of in-flight messages to processing slots, slots being the prefetch count
+// of each consumed queue bounded by the goroutines processing it. The
+// consumer is saturated once no slot has been idle for SaturationWindow.
+type ConsumerStats struct {
+	InFlight   int
+	Slots      int
+	Saturation float64
+	Saturated  bool
+}
+
+// saturation tracks in-flight messages and since when all slots are busy
+type saturation struct {
+	inFlight  int
+	slots     int
+	fullSince time.Time
+	saturated bool
+	mutex     sync.Mutex
+}
+
+// Counts a message whose processing started
+func (s *saturation) start() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inFlight++
+	s.updateFullSince()
+}
+
+// Counts a message whose processing finished
+func (s *saturation) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.inFlight--
+	s.updateFullSince()
+}
+
+// Sets the number of processing slots, which changes
+// when pools are scaled or prefetching is throttled
+func (s *saturation) setSlots(slots int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.slots = slots
+	s.updateFullSince()
+}
+
+func (s *saturation) updateFullSince() {
+	if s.slots == 0 || s.inFlight < s.slots {
+		s.fullSince = time.Time{}
+	} else if s.fullSince.IsZero() {
+		s.fullSince = time.Now()
+	}
+}
+
+// Decides whether all slots have been busy for the window and
+// returns the stats and whether the consumer became saturated
+// or stopped being saturated since the last check
+func (s *saturation) check(window time.Duration) (ConsumerStats, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	saturated := !s.fullSince.IsZero() && time.Since(s.fullSince) >= window
+	changed := saturated != s.saturated
+	s.saturated = saturated
+
+	return s.stats(), changed
+}
+
+// Returns the current stats
+func (s *saturation) current() ConsumerStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.stats()
+}
+
+func (s *saturation) stats() ConsumerStats {
+	stats := ConsumerStats{
+		InFlight:  s.inFlight,
+		Slots:     s.slots,
+		Saturated: s.saturated,
+	}
+	if s.slots > 0 {
+		stats.Saturation = float64(s.inFlight) / float64(s.slots)
+	}
+	return stats
+}
+
+// Returns the number of processing slots of the consumers
+func consumerSlots(consumers []*queueConsumer, throttledPrefetchCount int, throttled bool) int {
+	slots := 0
+	for _, consumer := range consumers {
+		prefetchCount := throttledPrefetch(consumer.prefetchCount, throttledPrefetchCount, throttled)
+		if size := consumer.pool.size(); size < prefetchCount {
+			slots += size
+		} else {
+			slots += prefetchCount
+		}
+	}
+	return slots
+}
@@ -0,0 +1,61 @@
+package brokers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaturation(t *testing.T) {
+	s := new(saturation)
+
+	if stats, changed := s.check(0); stats.Saturated || changed {
+		t.Errorf("s.check() = %+v, %v, want not saturated without slots", stats, changed)
+	}
+
+	s.setSlots(2)
+	s.start()
+	if stats, changed := s.check(0); stats.Saturated || changed || stats.Saturation != 0.5 {
+		t.Errorf("s.check() = %+v, %v, want not saturated at 0.5", stats, changed)
+	}
+
+	s.start()
+	if stats, changed := s.check(time.Hour); stats.Saturated || changed {
+		t.Errorf("s.check() = %+v, %v, want not saturated before the window", stats, changed)
+	}
+	if stats, changed := s.check(0); !stats.Saturated || !changed || stats.Saturation != 1 {
+		t.Errorf("s.check() = %+v, %v, want saturated", stats, changed)
+	}
+	if _, changed := s.check(0); changed {
+		t.Error("s.check() changed = true, want saturation reported once")
+	}
+
+	// An idle slot ends saturation
+	s.finish()
+	if stats, changed := s.check(0); stats.Saturated || !changed {
+		t.Errorf("s.check() = %+v, %v, want no longer saturated", stats, changed)
+	}
+
+	// So does scaling up
+	s.start()
+	s.check(0)
+	s.setSlots(3)
+	if stats, changed := s.check(0); stats.Saturated || !changed {
+		t.Errorf("s.check() = %+v, %v, want no longer saturated", stats, changed)
+	}
+}
+
+func TestConsumerSlots(t *testing.T) {
+	small := &queueConsumer{prefetchCount: 3, pool: new(consumerPool)}
+	small.pool.quitChans = make([]chan int, 1)
+	large := &queueConsumer{prefetchCount: 3, pool: new(consumerPool)}
+	large.pool.quitChans = make([]chan int, 5)
+
+	consumers := []*queueConsumer{small, large}
+
+	if slots := consumerSlots(consumers, 1, false); slots != 4 {
+		t.Errorf("consumerSlots() = %v, want 4", slots)
+	}
+	if slots := consumerSlots(consumers, 1, true); slots != 2 {
+		t.Errorf("consumerSlots() throttled = %v, want 2", slots)
+	}
+}
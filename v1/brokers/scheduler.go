@@ -0,0 +1,108 @@
+package brokers
+
+import (
+	"reflect"
+
+	"github.com/streadway/amqp"
+)
+
+// Returns whether the queues share a pool with a weighted fair share
+func weighted(consumers []*queueConsumer) bool {
+	for _, consumer := range consumers {
+		if consumer.weight > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Merges deliveries of the consumers in proportion to their weights and
+// returns a consumer of the merged deliveries, to be processed by a pool
+// sized like the default queue's one
+func fairShare(consumers []*queueConsumer, stopChan <-chan int) *queueConsumer {
+	sources := make([]<-chan amqp.Delivery, len(consumers))
+	weights := make([]int, len(consumers))
+	prefetchCount := 0
+	for i, consumer := range consumers {
+		sources[i] = consumer.deliveries
+		weights[i] = consumer.weight
+		prefetchCount += consumer.prefetchCount
+	}
+
+	merged := make(chan amqp.Delivery)
+	go schedule(sources, weights, merged, stopChan)
+
+	return &queueConsumer{
+		channel:       consumers[0].channel,
+		queue:         consumers[0].queue,
+		deliveries:    merged,
+		prefetchCount: prefetchCount,
+		minWorkers:    consumers[0].minWorkers,
+		maxWorkers:    consumers[0].maxWorkers,
+	}
+}
+
+// Sends deliveries of the sources to merged in weighted round robin, taking
+// up to weight deliveries from each source per round. Empty sources are
+// skipped so the others get their share. Holding a single delivery at a
+// time, the ratio holds for as long as the pool is busy. Merged is closed
+// once any source is closed, so the pool reports the lost channel.
+func schedule(sources []<-chan amqp.Delivery, weights []int, merged chan<- amqp.Delivery, stopChan <-chan int) {
+	defer close(merged)
+
+	send := func(d amqp.Delivery) bool {
+		select {
+		case merged <- d:
+			return true
+		case <-stopChan:
+			return false
+		}
+	}
+
+	// Waits for whichever source has a delivery first
+	cases := make([]reflect.SelectCase, len(sources)+1)
+	for i, source := range sources {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(source)}
+	}
+	cases[len(sources)] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(stopChan)}
+
+	for {
+		taken := 0
+		for i, source := range sources {
+			weight := weights[i]
+			if weight < 1 {
+				weight = 1 // queues without a weight get the smallest share
+			}
+
+			for n := 0; n < weight; n++ {
+				select {
+				case d, ok := <-source:
+					if !ok {
+						return
+					}
+					if !send(d) {
+						return
+					}
+					taken++
+					continue
+				case <-stopChan:
+					return
+				default:
+				}
+				break // skip the empty source
+			}
+		}
+
+		if taken > 0 {
+			continue
+		}
+
+		chosen, value, ok := reflect.Select(cases)
+		if chosen == len(sources) || !ok {
+			return
+		}
+		if !send(value.Interface().(amqp.Delivery)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package brokers
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestSchedule(t *testing.T) {
+	high := make(chan amqp.Delivery, 10)
+	low := make(chan amqp.Delivery, 10)
+	for i := 0; i < 10; i++ {
+		high <- amqp.Delivery{RoutingKey: "high"}
+		low <- amqp.Delivery{RoutingKey: "low"}
+	}
+
+	merged := make(chan amqp.Delivery)
+	stopChan := make(chan int)
+	go schedule([]<-chan amqp.Delivery{high, low}, []int{3, 1}, merged, stopChan)
+
+	// 3 high priority messages for every low priority one
+	counts := map[string]int{}
+	for i := 0; i < 8; i++ {
+		counts[(<-merged).RoutingKey]++
+	}
+	if counts["high"] != 6 || counts["low"] != 2 {
+		t.Errorf("schedule() = %v, want 6 high and 2 low", counts)
+	}
+
+	// The share of the empty queue goes to the other one
+	for i := 0; i < 12; i++ {
+		counts[(<-merged).RoutingKey]++
+	}
+	if counts["high"] != 10 || counts["low"] != 10 {
+		t.Errorf("schedule() = %v, want 10 high and 10 low", counts)
+	}
+
+	// Idle queues are waited for
+	go func() { low <- amqp.Delivery{RoutingKey: "low"} }()
+	if d := <-merged; d.RoutingKey != "low" {
+		t.Errorf("schedule() = %v, want low", d.RoutingKey)
+	}
+
+	close(stopChan)
+	if _, ok := <-merged; ok {
+		t.Error("merged is open, want closed once stopped")
+	}
+}
+
+func TestScheduleSourceClosed(t *testing.T) {
+	high := make(chan amqp.Delivery)
+	low := make(chan amqp.Delivery)
+	close(low)
+
+	merged := make(chan amqp.Delivery)
+	go schedule([]<-chan amqp.Delivery{high, low}, []int{5, 0}, merged, make(chan int))
+
+	if _, ok := <-merged; ok {
+		t.Error("merged is open, want closed with a source")
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	if weighted([]*queueConsumer{{}, {}}) {
+		t.Error("weighted() = true, want false without weights")
+	}
+	if !weighted([]*queueConsumer{{}, {weight: 2}}) {
+		t.Error("weighted() = false, want true")
+	}
+}
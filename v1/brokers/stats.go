@@ -0,0 +1,134 @@
+package brokers
+
+import (
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// BrokerStats describes a consumer of the broker, identified by its
+// consumer tag: how busy it is, how many messages it processed and failed
+// since it first started, whether it is connected and how many times it
+// reconnected. Consumers which ran on the broker one after another, e.g.
+// workers with different consumer tags, can be told apart.
+type BrokerStats struct {
+	ConsumerStats
+	Processed  int64
+	Failed     int64
+	Connected  bool
+	Reconnects int
+}
+
+// consumerState tracks a consumer across reconnects
+type consumerState struct {
+	saturation saturation
+	processed  int64
+	failed     int64
+	connected  bool
+	connects   int
+	mutex      sync.Mutex
+}
+
+// Records the consumer connected
+func (state *consumerState) connect() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.connected = true
+	state.connects++
+}
+
+// Records the consumer lost its connection or stopped
+func (state *consumerState) disconnect() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.connected = false
+}
+
+// Records the outcome of a processed message
+func (state *consumerState) record(err error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	state.processed++
+	if err != nil {
+		state.failed++
+	}
+}
+
+func (state *consumerState) stats() BrokerStats {
+	consumerStats := state.saturation.current()
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	stats := BrokerStats{
+		ConsumerStats: consumerStats,
+		Processed:     state.processed,
+		Failed:        state.failed,
+		Connected:     state.connected,
+	}
+	if state.connects > 1 {
+		stats.Reconnects = state.connects - 1
+	}
+	return stats
+}
+
+// countingProcessor records outcomes of processed tasks of a consumer
+type countingProcessor struct {
+	TaskProcessor
+	state *consumerState
+}
+
+// Process implements the TaskProcessor interface
+func (processor *countingProcessor) Process(signature *signatures.TaskSignature) error {
+	err := processor.TaskProcessor.Process(signature)
+	processor.state.record(err)
+	return err
+}
+
+// Returns the state of the consumer with the tag, created on first use
+func (amqpBroker *AMQPBroker) consumerState(consumerTag string) *consumerState {
+	amqpBroker.statesMutex.Lock()
+	defer amqpBroker.statesMutex.Unlock()
+
+	if amqpBroker.states == nil {
+		amqpBroker.states = make(map[string]*consumerState)
+	}
+	state, ok := amqpBroker.states[consumerTag]
+	if !ok {
+		state = new(consumerState)
+		amqpBroker.states[consumerTag] = state
+	}
+	return state
+}
+
+// StatsByConsumer returns the stats of each consumer by consumer tag, so
+// one consumer's problems aren't masked by another's healthy traffic
+func (amqpBroker *AMQPBroker) StatsByConsumer() map[string]BrokerStats {
+	amqpBroker.statesMutex.Lock()
+	defer amqpBroker.statesMutex.Unlock()
+
+	stats := make(map[string]BrokerStats, len(amqpBroker.states))
+	for consumerTag, state := range amqpBroker.states {
+		stats[consumerTag] = state.stats()
+	}
+	return stats
+}
+
+// Stats returns how busy the consumers are altogether, e.g. to export the
+// saturation ratio as a metric. Slots are zero when not consuming. The
+// broker is saturated if any consumer is.
+func (amqpBroker *AMQPBroker) Stats() ConsumerStats {
+	var stats ConsumerStats
+	for _, consumerStats := range amqpBroker.StatsByConsumer() {
+		stats.InFlight += consumerStats.InFlight
+		stats.Slots += consumerStats.Slots
+		stats.Saturated = stats.Saturated || consumerStats.Saturated
+	}
+	if stats.Slots > 0 {
+		stats.Saturation = float64(stats.InFlight) / float64(stats.Slots)
+	}
+	return stats
+}
@@ -0,0 +1,59 @@
+package brokers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+func TestStatsByConsumer(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	healthy := broker.consumerState("healthy")
+	healthy.connect()
+	healthy.saturation.setSlots(2)
+	healthy.saturation.start()
+	processor := &countingProcessor{TaskProcessor: new(fakeProcessor), state: healthy}
+	processor.Process(new(signatures.TaskSignature))
+
+	failing := broker.consumerState("failing")
+	failing.connect()
+	failing.disconnect()
+	failing.connect()
+	failing.saturation.setSlots(2)
+	processor = &countingProcessor{TaskProcessor: &fakeProcessor{err: errors.New("oops")}, state: failing}
+	processor.Process(new(signatures.TaskSignature))
+
+	stats := broker.StatsByConsumer()
+	if want := (BrokerStats{ConsumerStats: ConsumerStats{InFlight: 1, Slots: 2, Saturation: 0.5}, Processed: 1, Connected: true}); stats["healthy"] != want {
+		t.Errorf("stats[healthy] = %+v, want %+v", stats["healthy"], want)
+	}
+	if want := (BrokerStats{ConsumerStats: ConsumerStats{Slots: 2}, Processed: 1, Failed: 1, Connected: true, Reconnects: 1}); stats["failing"] != want {
+		t.Errorf("stats[failing] = %+v, want %+v", stats["failing"], want)
+	}
+
+	if total := broker.Stats(); total.InFlight != 1 || total.Slots != 4 || total.Saturation != 0.25 {
+		t.Errorf("broker.Stats() = %+v, want 1 of 4 slots busy", total)
+	}
+}
+
+func TestOneConsumerPerBroker(t *testing.T) {
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+	if !broker.claim() {
+		t.Fatal("broker.claim() = false, want true")
+	}
+
+	if retry, err := broker.StartConsuming("second", new(fakeProcessor)); retry || err != ErrAlreadyConsuming {
+		t.Errorf("broker.StartConsuming() = %v, %v, want false, %v", retry, err, ErrAlreadyConsuming)
+	}
+	if _, err := broker.Messages(); err != ErrAlreadyConsuming {
+		t.Errorf("broker.Messages() error = %v, want %v", err, ErrAlreadyConsuming)
+	}
+
+	broker.unclaim()
+	if !broker.claim() {
+		t.Error("broker.claim() = false once unclaimed, want true")
+	}
+}
@@ -0,0 +1,47 @@
+package brokers
+
+import (
+	"sync"
+)
+
+// errorRate counts processed and failed tasks between measurements
+type errorRate struct {
+	processed int
+	failed    int
+	mutex     sync.Mutex
+}
+
+// Counts a processed task
+func (rate *errorRate) record(err error) {
+	rate.mutex.Lock()
+	defer rate.mutex.Unlock()
+
+	rate.processed++
+	if err != nil {
+		rate.failed++
+	}
+}
+
+// Returns the rate of failed tasks and the number of processed tasks
+// since the last measurement and starts counting again
+func (rate *errorRate) measure() (float64, int) {
+	rate.mutex.Lock()
+	defer rate.mutex.Unlock()
+
+	processed, failed := rate.processed, rate.failed
+	rate.processed, rate.failed = 0, 0
+
+	if processed == 0 {
+		return 0, 0
+	}
+	return float64(failed) / float64(processed), processed
+}
+
+// Returns the prefetch count of a consumer, throttled while the error rate
+// is too high but never above its normal prefetch count
+func throttledPrefetch(prefetchCount, throttledPrefetchCount int, throttled bool) int {
+	if throttled && throttledPrefetchCount < prefetchCount {
+		return throttledPrefetchCount
+	}
+	return prefetchCount
+}
@@ -0,0 +1,52 @@
+package brokers
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestErrorRate(t *testing.T) {
+	rate := new(errorRate)
+
+	if r, processed := rate.measure(); r != 0 || processed != 0 {
+		t.Errorf("rate.measure() = %v, %v, want 0, 0", r, processed)
+	}
+
+	rate.record(nil)
+	rate.record(errors.New("oops"))
+	rate.record(errors.New("oops"))
+	rate.record(nil)
+
+	if r, processed := rate.measure(); r != 0.5 || processed != 4 {
+		t.Errorf("rate.measure() = %v, %v, want 0.5, 4", r, processed)
+	}
+
+	// Counting starts again after a measurement
+	rate.record(nil)
+	if r, processed := rate.measure(); r != 0 || processed != 1 {
+		t.Errorf("rate.measure() = %v, %v, want 0, 1", r, processed)
+	}
+}
+
+func TestThrottledPrefetch(t *testing.T) {
+	testCases := []struct {
+		prefetchCount, throttledPrefetchCount int
+		throttled                             bool
+		want                                  int
+	}{
+		{10, 1, false, 10},
+		{10, 1, true, 1},
+		{2, 5, true, 2},
+	}
+
+	for _, testCase := range testCases {
+		prefetchCount := throttledPrefetch(
+			testCase.prefetchCount,
+			testCase.throttledPrefetchCount,
+			testCase.throttled,
+		)
+		if prefetchCount != testCase.want {
+			t.Errorf("throttledPrefetch(%+v) = %v, want %v", testCase, prefetchCount, testCase.want)
+		}
+	}
+}
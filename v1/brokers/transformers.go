@@ -0,0 +1,65 @@
+package brokers
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// ErrStopTransforming can be returned by a MessageTransformer to skip
+// the transformers registered after it
+var ErrStopTransforming = errors.New("Stop transforming")
+
+// MessageTransformer modifies every task published or consumed by the
+// broker, e.g. to redact personal data or enrich tasks, without touching
+// task handlers. Returning an error other than ErrStopTransforming fails
+// publishing, or rejects the consumed message so it gets dead lettered.
+type MessageTransformer interface {
+	// Outbound transforms a task before it is published
+	Outbound(signature *signatures.TaskSignature) error
+	// Inbound transforms a consumed task before it is processed
+	Inbound(signature *signatures.TaskSignature) error
+}
+
+var (
+	transformers      []MessageTransformer
+	transformersMutex sync.RWMutex
+)
+
+// RegisterTransformer appends a transformer to the chain applied to
+// tasks on publish and consume, transformers run in registration order
+func RegisterTransformer(transformer MessageTransformer) {
+	transformersMutex.Lock()
+	defer transformersMutex.Unlock()
+
+	transformers = append(transformers, transformer)
+}
+
+// Applies the transformers to a task being published
+func transformOutbound(signature *signatures.TaskSignature) error {
+	return transform(func(transformer MessageTransformer) error {
+		return transformer.Outbound(signature)
+	})
+}
+
+// Applies the transformers to a consumed task
+func transformInbound(signature *signatures.TaskSignature) error {
+	return transform(func(transformer MessageTransformer) error {
+		return transformer.Inbound(signature)
+	})
+}
+
+func transform(apply func(transformer MessageTransformer) error) error {
+	transformersMutex.RLock()
+	defer transformersMutex.RUnlock()
+
+	for _, transformer := range transformers {
+		if err := apply(transformer); err == ErrStopTransforming {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
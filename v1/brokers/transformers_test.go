@@ -0,0 +1,56 @@
+package brokers
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// Appends its name to the task name in both directions
+type namingTransformer struct {
+	name string
+	err  error
+}
+
+func (transformer *namingTransformer) Outbound(signature *signatures.TaskSignature) error {
+	signature.Name += transformer.name
+	return transformer.err
+}
+
+func (transformer *namingTransformer) Inbound(signature *signatures.TaskSignature) error {
+	signature.Name += transformer.name
+	return transformer.err
+}
+
+func TestTransform(t *testing.T) {
+	defer func() {
+		transformersMutex.Lock()
+		transformers = nil
+		transformersMutex.Unlock()
+	}()
+
+	RegisterTransformer(&namingTransformer{name: "a"})
+	RegisterTransformer(&namingTransformer{name: "b", err: ErrStopTransforming})
+	RegisterTransformer(&namingTransformer{name: "c"})
+
+	signature := &signatures.TaskSignature{Name: "add_"}
+	if err := transformOutbound(signature); err != nil {
+		t.Error(err)
+	}
+	if signature.Name != "add_ab" {
+		t.Errorf("signature.Name = %v, want add_ab", signature.Name)
+	}
+
+	transformersMutex.Lock()
+	transformers[1] = &namingTransformer{name: "b", err: errors.New("oops")}
+	transformersMutex.Unlock()
+
+	signature = &signatures.TaskSignature{Name: "add_"}
+	if err := transformInbound(signature); err == nil {
+		t.Error("transformInbound() error = nil, want oops")
+	}
+	if signature.Name != "add_ab" {
+		t.Errorf("signature.Name = %v, want add_ab", signature.Name)
+	}
+}
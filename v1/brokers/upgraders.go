@@ -0,0 +1,76 @@
+package brokers
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Upgrader upgrades a raw message body to the next format version
+type Upgrader func(raw []byte) ([]byte, error)
+
+var (
+	upgraders      = map[int]Upgrader{}
+	upgradersMutex sync.RWMutex
+)
+
+// RegisterUpgrader registers an upgrade of messages from a format version
+// to the next one. Upgraders are chained, e.g. registered from versions
+// 1 and 2, a version 1 message is upgraded to version 2 and then 3 before
+// it is decoded. The current version is the one after the latest
+// registered upgrader.
+func RegisterUpgrader(fromVersion int, upgrade Upgrader) {
+	upgradersMutex.Lock()
+	defer upgradersMutex.Unlock()
+
+	upgraders[fromVersion] = upgrade
+}
+
+// Returns the current message format version, 1 without upgraders
+func currentFormatVersion() int {
+	upgradersMutex.RLock()
+	defer upgradersMutex.RUnlock()
+
+	current := 1
+	for fromVersion := range upgraders {
+		if fromVersion+1 > current {
+			current = fromVersion + 1
+		}
+	}
+	return current
+}
+
+// Upgrades the raw message body from its format version to the current
+// one. Fails for versions newer than the current one or when a step of
+// the upgrade path is missing.
+func upgrade(raw []byte, version int) ([]byte, error) {
+	current := currentFormatVersion()
+	if version > current {
+		return nil, fmt.Errorf("Upgrade: unknown format version %d, current is %d", version, current)
+	}
+
+	upgradersMutex.RLock()
+	defer upgradersMutex.RUnlock()
+
+	for ; version < current; version++ {
+		upgrade, ok := upgraders[version]
+		if !ok {
+			return nil, fmt.Errorf("Upgrade: no upgrade path from format version %d", version)
+		}
+
+		var err error
+		if raw, err = upgrade(raw); err != nil {
+			return nil, fmt.Errorf("Upgrade from format version %d: %v", version, err)
+		}
+	}
+
+	return raw, nil
+}
+
+// Copies headers, so those of the delivery are left untouched
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(headers)+1)
+	for k, v := range headers {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,110 @@
+package brokers
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/streadway/amqp"
+)
+
+// Registers upgraders renaming the task in each step
+func registerTestUpgraders() func() {
+	RegisterUpgrader(1, func(raw []byte) ([]byte, error) {
+		return bytes.Replace(raw, []byte("add_v1"), []byte("add_v2"), 1), nil
+	})
+	RegisterUpgrader(2, func(raw []byte) ([]byte, error) {
+		return bytes.Replace(raw, []byte("add_v2"), []byte("add"), 1), nil
+	})
+
+	return func() {
+		upgradersMutex.Lock()
+		upgraders = map[int]Upgrader{}
+		upgradersMutex.Unlock()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	raw := []byte(`{"Name":"add"}`)
+	if upgraded, err := upgrade(raw, 1); err != nil || !bytes.Equal(upgraded, raw) {
+		t.Errorf("upgrade() without upgraders = %s, %v, want it untouched", upgraded, err)
+	}
+
+	defer registerTestUpgraders()()
+
+	if current := currentFormatVersion(); current != 3 {
+		t.Errorf("currentFormatVersion() = %v, want 3", current)
+	}
+
+	testCases := []struct {
+		raw     string
+		version int
+	}{
+		{`{"Name":"add_v1"}`, 1},
+		{`{"Name":"add_v2"}`, 2},
+		{`{"Name":"add"}`, 3},
+	}
+
+	for _, testCase := range testCases {
+		upgraded, err := upgrade([]byte(testCase.raw), testCase.version)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(upgraded) != `{"Name":"add"}` {
+			t.Errorf("upgrade(%s, %d) = %s, want add", testCase.raw, testCase.version, upgraded)
+		}
+	}
+
+	if _, err := upgrade(raw, 4); err == nil {
+		t.Error("upgrade() error = nil, want unknown format version")
+	}
+
+	upgradersMutex.Lock()
+	delete(upgraders, 1)
+	upgradersMutex.Unlock()
+
+	if _, err := upgrade(raw, 1); err == nil {
+		t.Error("upgrade() error = nil, want no upgrade path")
+	}
+}
+
+func TestConsumeOneUpgrade(t *testing.T) {
+	defer registerTestUpgraders()()
+
+	broker := NewAMQPBroker(&config.Config{}, make(chan int)).(*AMQPBroker)
+
+	processor := new(fakeProcessor)
+	acknowledger := new(fakeAcknowledger)
+	d := amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(`{"Name":"add_v1"}`),
+	}
+
+	if err := broker.consumeOne(d, processor); err != nil {
+		t.Error(err)
+	}
+
+	if processor.signature == nil || processor.signature.Name != "add" {
+		t.Fatalf("processor.signature = %+v, want upgraded add", processor.signature)
+	}
+	if version := processor.signature.GetFormatVersion(); version != 3 {
+		t.Errorf("processor.signature.GetFormatVersion() = %v, want 3", version)
+	}
+
+	// Too new for this consumer, dead lettered
+	acknowledger = new(fakeAcknowledger)
+	d = amqp.Delivery{
+		Acknowledger: acknowledger,
+		Headers:      amqp.Table{signatures.FormatVersionHeader: int32(4)},
+		Body:         []byte(`{"Name":"add_v4"}`),
+	}
+
+	if err := broker.consumeOne(d, new(fakeProcessor)); err != nil {
+		t.Error(err)
+	}
+
+	if !acknowledger.rejected {
+		t.Errorf("acknowledger = %+v, want rejected", *acknowledger)
+	}
+}
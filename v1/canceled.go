@@ -0,0 +1,27 @@
+package machinery
+
+import "fmt"
+
+// CanceledError is returned by tasks which stopped before completing, e.g.
+// past their own deadline or on an explicit cancel request, along with the
+// partial result they produced. The task is stored as CANCELED with the
+// partial result rather than failed, it isn't retried and its callbacks
+// aren't called.
+type CanceledError struct {
+	Partial interface{}
+	Reason  string
+}
+
+// Error implements the error interface
+func (canceledError *CanceledError) Error() string {
+	return fmt.Sprintf("Task canceled: %s", canceledError.Reason)
+}
+
+// Canceled returns a CanceledError keeping the partial result, e.g.
+//
+//	if cancelRequested(jobID) {
+//		return nil, machinery.Canceled(processed, "cancel requested")
+//	}
+func Canceled(partial interface{}, reason string) error {
+	return &CanceledError{Partial: partial, Reason: reason}
+}
@@ -0,0 +1,86 @@
+package machinery
+
+import (
+	"log"
+	"reflect"
+	"runtime"
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/brokers"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// A task call whose results are shared by tasks with the same coalescing key
+type coalescedCall struct {
+	done    chan struct{}
+	results []reflect.Value
+	err     error
+	waiters int
+}
+
+// coalescer runs concurrent task calls with the same key once
+type coalescer struct {
+	calls map[string]*coalescedCall
+	mutex sync.Mutex
+}
+
+// Runs the call, unless a call with the same key is already running, in
+// which case it waits for that call and returns its results. Returns
+// whether the results are shared. A panicking call is recovered and its
+// *brokers.PanicError returned to the caller and the waiters alike.
+func (c *coalescer) do(key string, call func() ([]reflect.Value, error)) ([]reflect.Value, bool, error) {
+	c.mutex.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	if running, ok := c.calls[key]; ok {
+		running.waiters++
+		c.mutex.Unlock()
+		<-running.done
+		return running.results, true, running.err
+	}
+
+	coalesced := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = coalesced
+	c.mutex.Unlock()
+
+	// Later tasks run again, results are only shared while in flight
+	defer func() {
+		c.mutex.Lock()
+		delete(c.calls, key)
+		c.mutex.Unlock()
+		close(coalesced.done)
+	}()
+
+	coalesced.results, coalesced.err = safeCall(call)
+	return coalesced.results, false, coalesced.err
+}
+
+// Calls the call, recovering a panic as a *brokers.PanicError
+func safeCall(call func() ([]reflect.Value, error)) (results []reflect.Value, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			stack := make([]byte, 64<<10)
+			stack = stack[:runtime.Stack(stack, false)]
+			results, err = nil, &brokers.PanicError{Value: value, Stack: stack}
+		}
+	}()
+
+	return call()
+}
+
+// Calls the task, coalescing it with a running task of the same name and
+// coalescing key, if it has one. Every coalesced task is finalized with
+// the shared results, i.e. its state stored, its callbacks run and its
+// message acked.
+func (worker *Worker) coalesce(signature *signatures.TaskSignature, call func() ([]reflect.Value, error)) ([]reflect.Value, error) {
+	if signature.CoalescingKey == "" {
+		return call()
+	}
+
+	results, shared, err := worker.coalescer.do(signature.Name+":"+signature.CoalescingKey, call)
+	if shared {
+		log.Printf("Coalesced %s with a running %s task", signature.UUID, signature.Name)
+	}
+	return results, err
+}
@@ -0,0 +1,114 @@
+package machinery
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/brokers"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := new(coalescer)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	call := func() ([]reflect.Value, error) {
+		calls++
+		close(started)
+		<-release
+		return []reflect.Value{reflect.ValueOf(42)}, nil
+	}
+
+	var wg sync.WaitGroup
+	shares := make([]bool, 3)
+	results := make([][]reflect.Value, 3)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], shares[0], _ = c.do("key", call)
+	}()
+	<-started
+
+	for i := 1; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], shares[i], _ = c.do("key", call)
+		}(i)
+	}
+
+	// Wait for the followers to join the running call
+	for {
+		c.mutex.Lock()
+		joined := c.calls["key"].waiters == 2
+		c.mutex.Unlock()
+		if joined {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+	if shares[0] {
+		t.Error("shared = true, want the first call to run")
+	}
+	for i, result := range results {
+		if result[0].Interface() != 42 {
+			t.Errorf("results[%d] = %v, want 42", i, result[0])
+		}
+	}
+
+	// Once finished, the next call runs again
+	if _, shared, _ := c.do("key", func() ([]reflect.Value, error) { return nil, nil }); shared {
+		t.Error("shared = true, want results only shared while in flight")
+	}
+}
+
+func TestCoalescerPanic(t *testing.T) {
+	c := new(coalescer)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	call := func() ([]reflect.Value, error) {
+		close(started)
+		<-release
+		panic("oops")
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := c.do("key", call)
+		errs <- err
+	}()
+	<-started
+
+	joined := make(chan error, 1)
+	go func() {
+		_, _, err := c.do("key", call)
+		joined <- err
+	}()
+	for {
+		c.mutex.Lock()
+		waiting := c.calls["key"].waiters == 1
+		c.mutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+
+	// The panic is returned to the caller and the waiter alike
+	for _, err := range []error{<-errs, <-joined} {
+		if _, ok := err.(*brokers.PanicError); !ok {
+			t.Errorf("c.do() error = %v, want PanicError", err)
+		}
+	}
+}
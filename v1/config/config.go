@@ -2,20 +2,152 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"text/template"
 
+	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/RichardKnop/machinery/v1/utils"
 	"gopkg.in/yaml.v2"
 )
 
 // Config holds all configuration for our program
 type Config struct {
-	Broker          string `yaml:"broker"`
-	ResultBackend   string `yaml:"result_backend"`
-	ResultsExpireIn int    `yaml:"results_expire_in"`
-	Exchange        string `yaml:"exchange"`
-	ExchangeType    string `yaml:"exchange_type"`
-	DefaultQueue    string `yaml:"default_queue"`
-	BindingKey      string `yaml:"binding_key"`
+	Broker                  string                                       `yaml:"broker"`
+	ResultBackend           string                                       `yaml:"result_backend"`
+	ResultsExpireIn         int                                          `yaml:"results_expire_in"`
+	Exchange                string                                       `yaml:"exchange"`
+	ExchangeType            string                                       `yaml:"exchange_type"`
+	DefaultQueue            string                                       `yaml:"default_queue"`
+	BindingKey              string                                       `yaml:"binding_key"`
+	WebhookSecret           string                                       `yaml:"webhook_secret"`
+	WebhookRetries          int                                          `yaml:"webhook_retries"`
+	WebhookTimeout          int                                          `yaml:"webhook_timeout"`
+	WebhookConcurrency      int                                          `yaml:"webhook_concurrency"`
+	SensitiveFields         []string                                     `yaml:"sensitive_fields"`
+	Bindings                []QueueBinding                               `yaml:"bindings"`
+	SafeMode                bool                                         `yaml:"safe_mode"`
+	MaxConsumerLifetime     int                                          `yaml:"max_consumer_lifetime"`
+	SharedConnection        bool                                         `yaml:"shared_connection"`
+	AuditExchange           string                                       `yaml:"audit_exchange"`
+	PrefetchCount           int                                          `yaml:"prefetch_count"`
+	PrefetchRampDuration    int                                          `yaml:"prefetch_ramp_duration"`
+	ResultBackendRetries    int                                          `yaml:"result_backend_retries"`
+	ResultBackendRetryDelay int                                          `yaml:"result_backend_retry_delay"`
+	MaxConnections          int                                          `yaml:"max_connections"`
+	RoutingKeyTemplate      string                                       `yaml:"routing_key_template"`
+	AckAfterResult          bool                                         `yaml:"ack_after_result"`
+	MinWorkers              int                                          `yaml:"min_workers"`
+	MaxWorkers              int                                          `yaml:"max_workers"`
+	ScaleUpThreshold        int                                          `yaml:"scale_up_threshold"`
+	ScaleInterval           int                                          `yaml:"scale_interval"`
+	WorkerID                string                                       `yaml:"worker_id"`
+	DeadLetterExchange      string                                       `yaml:"dead_letter_exchange"`
+	DeadLetterRoutingKey    string                                       `yaml:"dead_letter_routing_key"`
+	Dialer                  func(network, addr string) (net.Conn, error) `yaml:"-"`
+	ReconnectBackoff        utils.BackoffStrategy                        `yaml:"-"`
+	ResultBackendBackoff    utils.BackoffStrategy                        `yaml:"-"`
+	WebhookBackoff          utils.BackoffStrategy                        `yaml:"-"`
+	MaxDeliveryAttempts     int                                          `yaml:"max_delivery_attempts"`
+	FlushTimeout            int                                          `yaml:"flush_timeout"`
+	Queues                  []ConsumedQueue                              `yaml:"queues"`
+	LazyQueue               bool                                         `yaml:"lazy_queue"`
+	Encryptor               utils.Encryptor                              `yaml:"-"`
+	SkipCompletedTasks      bool                                         `yaml:"skip_completed_tasks"`
+	BloomFilterSize         int                                          `yaml:"bloom_filter_size"`
+	BloomFilterWindow       int                                          `yaml:"bloom_filter_window"`
+	MessageTTL              int                                          `yaml:"message_ttl"`
+	MetricsTasks            []string                                     `yaml:"metrics_tasks"`
+	MaxConsumeBytes         int                                          `yaml:"max_consume_bytes"`
+	ThrottleErrorRate       float64                                      `yaml:"throttle_error_rate"`
+	ThrottleInterval        int                                          `yaml:"throttle_interval"`
+	ThrottledPrefetchCount  int                                          `yaml:"throttled_prefetch_count"`
+	HeartbeatInterval       int                                          `yaml:"heartbeat_interval"`
+	QueueExpires            int                                          `yaml:"queue_expires"`
+	PanicQueue              string                                       `yaml:"panic_queue"`
+	SaturationWindow        int                                          `yaml:"saturation_window"`
+	StreamQueue             bool                                         `yaml:"stream_queue"`
+	ConsumerGroup           string                                       `yaml:"consumer_group"`
+	PositionInterval        int                                          `yaml:"position_interval"`
+	AcceptPredicate         func(*signatures.TaskSignature) bool         `yaml:"-"`
+	TaskConcurrency         map[string]int                               `yaml:"task_concurrency"`
+	SemaphoreLease          int                                          `yaml:"semaphore_lease"`
+	ConcurrencyRetryDelay   int                                          `yaml:"concurrency_retry_delay"`
+	DeclareRetries          int                                          `yaml:"declare_retries"`
+	SlowThreshold           int                                          `yaml:"slow_threshold"`
+	HungThreshold           int                                          `yaml:"hung_threshold"`
+	DefaultQueueWeight      int                                          `yaml:"default_queue_weight"`
+	RetryQueue              string                                       `yaml:"retry_queue"`
+	RetryBackoff            utils.BackoffStrategy                        `yaml:"-"`
+	Decoders                []string                                     `yaml:"decoders"`
+	SequencePublishes       bool                                         `yaml:"sequence_publishes"`
+	ReorderBufferSize       int                                          `yaml:"reorder_buffer_size"`
+	ReorderGapTimeout       int                                          `yaml:"reorder_gap_timeout"`
+	MaxTaskHeapDelta        int                                          `yaml:"max_task_heap_delta"`
+	AffinityExchange        string                                       `yaml:"affinity_exchange"`
+	AffinityWait            int                                          `yaml:"affinity_wait"`
+	AffinityQueueExpires    int                                          `yaml:"affinity_queue_expires"`
+	ProfileThreshold        int                                          `yaml:"profile_threshold"`
+	ProfileDir              string                                       `yaml:"profile_dir"`
+	ProgressInterval        int                                          `yaml:"progress_interval"`
+	ConsumerTimeout         int                                          `yaml:"consumer_timeout"`
+	DeadLetterQueue         string                                       `yaml:"dead_letter_queue"`
+	DeadLetterTTL           int                                          `yaml:"dead_letter_ttl"`
+	DeadLetterArchive       string                                       `yaml:"dead_letter_archive"`
+	LegacyQueue             string                                       `yaml:"legacy_queue"`
+	MaxWorkflowDepth        int                                          `yaml:"max_workflow_depth"`
+	HoldingQueue            string                                       `yaml:"holding_queue"`
+	HoldingDelay            int                                          `yaml:"holding_delay"`
+	IdempotencyCheck        IdempotencyChecker                           `yaml:"-"`
+	IdempotencyRecord       IdempotencyRecorder                          `yaml:"-"`
+	SecondaryBroker         string                                       `yaml:"secondary_broker"`
+	MaxPriority             int                                          `yaml:"max_priority"`
+	ExactlyOnce             bool                                         `yaml:"exactly_once"`
+	WarmShutdownTimeout     int                                          `yaml:"warm_shutdown_timeout"`
+	Signer                  utils.Signer                                 `yaml:"-"`
+	Verifier                utils.Verifier                               `yaml:"-"`
+	QuarantineQueue         string                                       `yaml:"quarantine_queue"`
+	QuorumQueue             bool                                         `yaml:"quorum_queue"`
+	DeliveryLimit           int                                          `yaml:"delivery_limit"`
+	CompressResults         bool                                         `yaml:"compress_results"`
+	QueueResolver           QueueResolver                                `yaml:"-"`
+	AckBatchSize            int                                          `yaml:"ack_batch_size"`
+	AckFlushInterval        int                                          `yaml:"ack_flush_interval"`
+	MaxQueueLength          int                                          `yaml:"max_queue_length"`
+	OverflowBehavior        string                                       `yaml:"overflow_behavior"`
+	TenantConcurrency       int                                          `yaml:"tenant_concurrency"`
+	TenantRateLimit         int                                          `yaml:"tenant_rate_limit"`
+	TenantRateWindow        int                                          `yaml:"tenant_rate_window"`
+}
+
+// IdempotencyChecker tells whether a task has already been processed,
+// e.g. looking it up in the application's own idempotency store
+type IdempotencyChecker func(signature *signatures.TaskSignature) (alreadyProcessed bool, err error)
+
+// IdempotencyRecorder records a task has been processed successfully
+type IdempotencyRecorder func(signature *signatures.TaskSignature) error
+
+// QueueResolver returns the queue a task is published to, e.g. following
+// a naming convention by task name, or an empty string for the default one
+type QueueResolver func(signature *signatures.TaskSignature) string
+
+// QueueBinding binds the default queue to an exchange with a binding key
+type QueueBinding struct {
+	Exchange   string                 `yaml:"exchange"`
+	BindingKey string                 `yaml:"binding_key"`
+	Args       map[string]interface{} `yaml:"args"`
+}
+
+// ConsumedQueue is an additional queue consumed by workers on its own
+// channel with its own prefetch and pool of goroutines
+type ConsumedQueue struct {
+	Name                 string `yaml:"name"`
+	BindingKey           string `yaml:"binding_key"`
+	PrefetchCount        int    `yaml:"prefetch_count"`
+	MinWorkers           int    `yaml:"min_workers"`
+	MaxWorkers           int    `yaml:"max_workers"`
+	DeadLetterRoutingKey string `yaml:"dead_letter_routing_key"`
+	Weight               int    `yaml:"weight"`
 }
 
 // ReadFromFile reads data from a file
@@ -44,5 +176,78 @@ func ParseYAMLConfig(data *[]byte, cnf *Config) error {
 		return fmt.Errorf("Config Unmarshal: %v", err)
 	}
 
+	return cnf.Validate()
+}
+
+// Validate checks the configuration is sensible
+func (cnf *Config) Validate() error {
+	if cnf.RoutingKeyTemplate != "" {
+		if _, err := template.New("routing_key").Parse(cnf.RoutingKeyTemplate); err != nil {
+			return fmt.Errorf("Routing Key Template: %v", err)
+		}
+	}
+
+	if cnf.QueueExpires < 0 {
+		return fmt.Errorf("Queue Expires: %d is negative", cnf.QueueExpires)
+	}
+
+	if cnf.DeadLetterQueue != "" && cnf.DeadLetterExchange == "" {
+		return fmt.Errorf("Dead Letter Queue: requires a dead letter exchange")
+	}
+	if (cnf.DeadLetterTTL > 0 || cnf.DeadLetterArchive != "") && cnf.DeadLetterQueue == "" {
+		return fmt.Errorf("Dead Letter TTL: requires a dead letter queue")
+	}
+
+	// Expired dead letters must not return to the dead letter queue,
+	// nor to the queues they failed in
+	if archive := cnf.DeadLetterArchive; archive != "" && (archive == cnf.DeadLetterExchange || archive == cnf.Exchange) {
+		return fmt.Errorf("Dead Letter Archive: %s would loop dead letters back", archive)
+	}
+
+	// Streams don't support these queue arguments
+	if cnf.StreamQueue && (cnf.DeadLetterExchange != "" || cnf.LazyQueue || cnf.MessageTTL > 0 || cnf.QueueExpires > 0 || cnf.MaxPriority > 0 || cnf.MaxQueueLength > 0) {
+		return fmt.Errorf("Stream Queue: dead lettering, lazy mode, message TTL, expiry, priorities and max length are not supported")
+	}
+
+	// Quorum queues don't support these queue arguments
+	if cnf.QuorumQueue && (cnf.StreamQueue || cnf.LazyQueue || cnf.QueueExpires > 0 || cnf.MaxPriority > 0) {
+		return fmt.Errorf("Quorum Queue: streams, lazy mode, expiry and priorities are not supported")
+	}
+
+	// Poison messages must be dead lettered rather than dropped
+	if cnf.DeliveryLimit < 0 {
+		return fmt.Errorf("Delivery Limit: %d is negative", cnf.DeliveryLimit)
+	}
+	if cnf.DeliveryLimit > 0 && !cnf.QuorumQueue {
+		return fmt.Errorf("Delivery Limit: requires a quorum queue")
+	}
+	if cnf.DeliveryLimit > 0 && cnf.DeadLetterExchange == "" {
+		return fmt.Errorf("Delivery Limit: requires a dead letter exchange")
+	}
+
+	// The message is only acked once the outcome is committed
+	if cnf.ExactlyOnce && !cnf.AckAfterResult {
+		return fmt.Errorf("Exactly Once: requires AckAfterResult")
+	}
+
+	switch cnf.OverflowBehavior {
+	case "", "drop-head", "reject-publish", "reject-publish-dlx":
+	default:
+		return fmt.Errorf("Overflow Behavior: %s is not drop-head, reject-publish or reject-publish-dlx", cnf.OverflowBehavior)
+	}
+	if cnf.MaxQueueLength < 0 {
+		return fmt.Errorf("Max Queue Length: %d is negative", cnf.MaxQueueLength)
+	}
+	if cnf.OverflowBehavior != "" && cnf.MaxQueueLength == 0 {
+		return fmt.Errorf("Overflow Behavior: requires a max queue length")
+	}
+	if cnf.OverflowBehavior == "reject-publish-dlx" && cnf.QuorumQueue {
+		return fmt.Errorf("Overflow Behavior: reject-publish-dlx is not supported by quorum queues")
+	}
+
+	if cnf.MaxPriority < 0 || cnf.MaxPriority > 255 {
+		return fmt.Errorf("Max Priority: %d is not between 0 and 255", cnf.MaxPriority)
+	}
+
 	return nil
 }
@@ -93,3 +93,85 @@ func TestParseYAMLConfig(t *testing.T) {
 		)
 	}
 }
+
+func TestValidate(t *testing.T) {
+	cnf := Config{RoutingKeyTemplate: "task.{{.Name}}"}
+	if err := cnf.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	cnf = Config{RoutingKeyTemplate: "task.{{.Name"}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for invalid routing key template")
+	}
+
+	cnf = Config{QueueExpires: -1}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for negative queue expiry")
+	}
+
+	cnf = Config{StreamQueue: true, LazyQueue: true}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for a lazy stream queue")
+	}
+
+	cnf = Config{DeadLetterExchange: "dlx", DeadLetterQueue: "dlq", DeadLetterTTL: 60, DeadLetterArchive: "archive"}
+	if err := cnf.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	cnf = Config{DeadLetterTTL: 60}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for a dead letter TTL without a dead letter queue")
+	}
+
+	cnf = Config{DeadLetterExchange: "dlx", DeadLetterQueue: "dlq", DeadLetterArchive: "dlx"}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for dead letters archived to the dead letter exchange")
+	}
+
+	cnf = Config{ExactlyOnce: true}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for exactly-once delivery without AckAfterResult")
+	}
+
+	cnf = Config{MaxPriority: 256}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for a max priority above 255")
+	}
+
+	cnf = Config{QuorumQueue: true, DeliveryLimit: 5, DeadLetterExchange: "dlx"}
+	if err := cnf.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	cnf = Config{DeliveryLimit: 5, DeadLetterExchange: "dlx"}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for a delivery limit without a quorum queue")
+	}
+
+	cnf = Config{QuorumQueue: true, DeliveryLimit: 5}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for a delivery limit without a dead letter exchange")
+	}
+
+	cnf = Config{QuorumQueue: true, StreamQueue: true}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for a quorum stream queue")
+	}
+
+	cnf = Config{MaxQueueLength: 1000, OverflowBehavior: "reject-publish"}
+	if err := cnf.Validate(); err != nil {
+		t.Error(err)
+	}
+
+	cnf = Config{MaxQueueLength: 1000, OverflowBehavior: "drop-tail"}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for an unknown overflow behavior")
+	}
+
+	cnf = Config{OverflowBehavior: "drop-head"}
+	if err := cnf.Validate(); err == nil {
+		t.Error("err should not be nil for an overflow behavior without a max queue length")
+	}
+}
@@ -0,0 +1,91 @@
+package machinery
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+)
+
+// TaskEventsHandler returns an HTTP handler streaming state transitions of
+// the task given by the uuid query parameter as Server-Sent Events, so
+// frontends can render live task status with an EventSource. The result
+// backend is polled every pollInterval (every second if not positive) and
+// each changed state is sent as a "state" event with the JSON encoded task
+// state. The stream ends once the task completes or the client disconnects.
+// The result backend must look up states without consuming them (see
+// backends.StatePeeker).
+func (server *Server) TaskEventsHandler(pollInterval time.Duration) http.Handler {
+	if pollInterval <= 0 {
+		pollInterval = time.Second // poll every second by default
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		taskUUID := r.URL.Query().Get("uuid")
+		if taskUUID == "" {
+			http.Error(w, "Missing uuid", http.StatusBadRequest)
+			return
+		}
+
+		// Polling must not take states away from AsyncResult
+		backend, ok := server.GetBackend().(backends.StatePeeker)
+		if !ok {
+			http.Error(w, "Result backend does not support peeking at states", http.StatusNotImplemented)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		// Stop polling when the client goes away
+		var disconnected <-chan bool
+		if closeNotifier, ok := w.(http.CloseNotifier); ok {
+			disconnected = closeNotifier.CloseNotify()
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		var lastEvent []byte
+		for {
+			// States which can't be fetched yet, e.g. before the task
+			// is received, are polled again
+			taskState, err := backend.PeekState(taskUUID)
+			if err == nil {
+				event, err := json.Marshal(taskState)
+				if err != nil {
+					return
+				}
+
+				if string(event) != string(lastEvent) {
+					if _, err := fmt.Fprintf(w, "event: state\ndata: %s\n\n", event); err != nil {
+						return
+					}
+					flusher.Flush()
+					lastEvent = event
+				}
+
+				if taskState.IsCompleted() {
+					return
+				}
+			}
+
+			select {
+			case <-disconnected:
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
@@ -10,13 +10,30 @@ import (
 )
 
 // BrokerFactory creates a new object with brokers.Broker interface
-// Currently only AMQP broker is supported
+// Currently only AMQP broker is supported. With SecondaryBroker, the
+// broker fails over to it (see brokers.FailoverBroker).
 func BrokerFactory(cnf *config.Config, stopChan chan int) (brokers.Broker, error) {
-	if strings.HasPrefix(cnf.Broker, "amqp://") {
-		return brokers.NewAMQPBroker(cnf, stopChan), nil
+	if !strings.HasPrefix(cnf.Broker, "amqp://") {
+		return nil, fmt.Errorf("Factory failed with broker URL: %v", cnf.Broker)
 	}
+	broker := brokers.NewAMQPBroker(cnf, stopChan)
 
-	return nil, fmt.Errorf("Factory failed with broker URL: %v", cnf.Broker)
+	if cnf.SecondaryBroker == "" {
+		return broker, nil
+	}
+	if !strings.HasPrefix(cnf.SecondaryBroker, "amqp://") {
+		return nil, fmt.Errorf("Factory failed with secondary broker URL: %v", cnf.SecondaryBroker)
+	}
+
+	secondaryConfig := *cnf
+	secondaryConfig.Broker = cnf.SecondaryBroker
+	secondary := brokers.NewAMQPBroker(&secondaryConfig, make(chan int, 1))
+
+	failoverBroker := brokers.NewFailoverBroker(broker, secondary).(*brokers.FailoverBroker)
+	if cnf.ReconnectBackoff != nil {
+		failoverBroker.SetReconnectBackoff(cnf.ReconnectBackoff)
+	}
+	return failoverBroker, nil
 }
 
 // BackendFactory creates a new object with backends.Backend interface
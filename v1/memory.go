@@ -0,0 +1,105 @@
+package machinery
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// How often the heap is sampled while a task runs with a memory guard
+const heapSampleInterval = 100 * time.Millisecond
+
+// HeapDeltaError is returned for tasks given up on after the heap grew by
+// more than MaxTaskHeapDelta bytes while they ran
+type HeapDeltaError struct {
+	Delta uint64
+	Limit uint64
+}
+
+// Error implements the error interface
+func (heapDeltaError *HeapDeltaError) Error() string {
+	return fmt.Sprintf(
+		"Heap grew by %d bytes while running the task, more than %d bytes allowed",
+		heapDeltaError.Delta,
+		heapDeltaError.Limit,
+	)
+}
+
+// Returns bytes of allocated heap objects
+func heapAlloc() uint64 {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	return memStats.HeapAlloc
+}
+
+// heapSampler samples the heap from a single goroutine for all tasks
+// running with a memory guard, as reading memory stats stops the world.
+// It samples while any task is running.
+type heapSampler struct {
+	alloc   uint64
+	sampled chan struct{}
+	users   int
+	running bool
+	mutex   sync.Mutex
+}
+
+// Starts sampling, unless already sampling, and returns the latest sample.
+// Must be followed by stop.
+func (sampler *heapSampler) start() uint64 {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	sampler.users++
+	if !sampler.running {
+		sampler.running = true
+		sampler.alloc = heapAlloc()
+		sampler.sampled = make(chan struct{})
+		go sampler.run()
+	}
+	return sampler.alloc
+}
+
+// Stops sampling once no task needs it anymore
+func (sampler *heapSampler) stop() {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	sampler.users--
+}
+
+// Returns a channel closed once the next sample is taken
+func (sampler *heapSampler) next() <-chan struct{} {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	return sampler.sampled
+}
+
+// Returns the latest sample
+func (sampler *heapSampler) current() uint64 {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+
+	return sampler.alloc
+}
+
+func (sampler *heapSampler) run() {
+	ticker := time.NewTicker(heapSampleInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		alloc := heapAlloc()
+
+		sampler.mutex.Lock()
+		sampler.alloc = alloc
+		close(sampler.sampled)
+		sampler.sampled = make(chan struct{})
+		if sampler.users == 0 {
+			sampler.running = false
+			sampler.mutex.Unlock()
+			return
+		}
+		sampler.mutex.Unlock()
+	}
+}
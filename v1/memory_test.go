@@ -0,0 +1,48 @@
+package machinery
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeapSampler(t *testing.T) {
+	var sampler heapSampler
+
+	// Tasks running at once share the sampling goroutine
+	if sampler.start() == 0 {
+		t.Error("sampler.start() = 0, want the allocated heap")
+	}
+	sampler.start()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sampler.next():
+		case <-time.After(time.Second):
+			t.Fatal("no heap sample taken")
+		}
+	}
+	sampler.stop()
+	sampler.stop()
+
+	// Sampling stops once no task needs it and starts again on demand
+	for deadline := time.Now().Add(time.Second); ; {
+		sampler.mutex.Lock()
+		running := sampler.running
+		sampler.mutex.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sampling didn't stop")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	sampler.start()
+	defer sampler.stop()
+	select {
+	case <-sampler.next():
+	case <-time.After(time.Second):
+		t.Fatal("no heap sample taken once restarted")
+	}
+}
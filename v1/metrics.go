@@ -0,0 +1,89 @@
+package machinery
+
+import (
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// OtherTaskLabel labels metrics of tasks which are not registered
+// or not listed in the MetricsTasks configuration option
+const OtherTaskLabel = "other"
+
+// TaskMetrics receives execution metrics of processed tasks labeled by
+// task name, e.g. to update a Prometheus duration histogram and success
+// and failure counters with a task label
+type TaskMetrics interface {
+	ObserveDuration(task string, duration time.Duration)
+	IncSuccess(task string)
+	IncFailure(task string)
+}
+
+// ExemplarMetrics can be implemented by TaskMetrics supporting OpenMetrics
+// exemplars. Durations of tasks published within a trace are then observed
+// with the trace ID as an exemplar, e.g. with Prometheus' ObserveWithExemplar,
+// linking latency outliers to their traces.
+type ExemplarMetrics interface {
+	ObserveDurationWithExemplar(task string, duration time.Duration, traceID string)
+}
+
+// DecoderMetrics can be implemented by TaskMetrics to count consumed
+// messages by the decoder which decoded them (see the Decoders
+// configuration option), e.g. to follow a serialization format migration
+type DecoderMetrics interface {
+	IncDecoded(decoder string)
+}
+
+// LatencyMetrics can be implemented by TaskMetrics to observe how long
+// tasks took from being published until they were processed, labeled by
+// the queue they were consumed from, e.g. to update a Prometheus summary
+// with p50, p95 and p99 objectives per queue
+type LatencyMetrics interface {
+	ObserveLatency(queue string, latency time.Duration)
+}
+
+// Returns the metrics label of a task. Only registered (or whitelisted)
+// task names are used, so that arbitrary names in messages can't blow up
+// the number of label values.
+func (worker *Worker) metricsLabel(signature *signatures.TaskSignature) string {
+	if whitelist := worker.server.GetConfig().MetricsTasks; len(whitelist) > 0 {
+		for _, name := range whitelist {
+			if name == signature.Name {
+				return name
+			}
+		}
+		return OtherTaskLabel
+	}
+
+	if worker.server.GetRegisteredTask(signature.Name) == nil {
+		return OtherTaskLabel
+	}
+	return signature.Name
+}
+
+// Records the outcome of a task call
+func (worker *Worker) recordMetrics(signature *signatures.TaskSignature, duration time.Duration, err error) {
+	if worker.metrics == nil {
+		return
+	}
+
+	label := worker.metricsLabel(signature)
+	exemplarMetrics, ok := worker.metrics.(ExemplarMetrics)
+	if traceID := signature.GetTraceID(); ok && traceID != "" {
+		exemplarMetrics.ObserveDurationWithExemplar(label, duration, traceID)
+	} else {
+		worker.metrics.ObserveDuration(label, duration)
+	}
+	if err != nil {
+		worker.metrics.IncFailure(label)
+	} else {
+		worker.metrics.IncSuccess(label)
+	}
+}
+
+// Records a task which failed before it could be called
+func (worker *Worker) recordFailure(signature *signatures.TaskSignature) {
+	if worker.metrics != nil {
+		worker.metrics.IncFailure(worker.metricsLabel(signature))
+	}
+}
@@ -0,0 +1,94 @@
+package machinery
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// Longest CPU profile captured of a slow task
+const maxProfileDuration = 30 * time.Second
+
+// Path separators of task names and UUIDs, which come from messages
+var profileNameReplacer = strings.NewReplacer("/", "_", "\\", "_")
+
+// Only one CPU profile can be captured at a time per process, slow tasks
+// running while another one is profiled aren't profiled
+var profiling = make(chan struct{}, 1)
+
+// Starts profiling a task which exceeded ProfileThreshold. Goroutines are
+// dumped right away, the CPU is profiled until the returned function is
+// called once the task returns, or for at most maxProfileDuration. Profiles
+// are written to ProfileDir, named after the task and its UUID.
+func (worker *Worker) startProfile(signature *signatures.TaskSignature) func() {
+	select {
+	case profiling <- struct{}{}:
+	default:
+		log.Printf("Not profiling slow task %s (%s), another task is profiled", signature.UUID, signature.Name)
+		return func() {}
+	}
+
+	dir := worker.server.GetConfig().ProfileDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	prefix := filepath.Join(dir, profileName(signature))
+
+	if err := writeProfile(prefix+".goroutine.pprof", func(file *os.File) error {
+		return pprof.Lookup("goroutine").WriteTo(file, 0)
+	}); err != nil {
+		log.Printf("Failed writing goroutine profile of %s. Error = %v", signature.UUID, err)
+	}
+
+	cpuFile, err := os.Create(prefix + ".cpu.pprof")
+	if err != nil {
+		log.Printf("Failed creating CPU profile of %s. Error = %v", signature.UUID, err)
+		<-profiling
+		return func() {}
+	}
+	if err := pprof.StartCPUProfile(cpuFile); err != nil {
+		// e.g. the application profiles the CPU itself
+		log.Printf("Failed starting CPU profile of %s. Error = %v", signature.UUID, err)
+		cpuFile.Close()
+		os.Remove(cpuFile.Name())
+		<-profiling
+		return func() {}
+	}
+	log.Printf("Profiling slow task %s (%s) to %s", signature.UUID, signature.Name, cpuFile.Name())
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+			<-profiling
+		})
+	}
+	time.AfterFunc(maxProfileDuration, stop)
+
+	return stop
+}
+
+// Writes a profile to a new file
+func writeProfile(path string, write func(file *os.File) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return write(file)
+}
+
+// Returns the task's profile name, which stays within ProfileDir whatever
+// the task name and UUID contain
+func profileName(signature *signatures.TaskSignature) string {
+	return profileNameReplacer.Replace(fmt.Sprintf("%s-%s", signature.Name, signature.UUID))
+}
@@ -0,0 +1,207 @@
+package machinery
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// TaskDefinition describes a registered task by the Go types of its
+// params and results, as used in TaskArg.Type
+type TaskDefinition struct {
+	Name     string   `json:"name"`
+	Args     []string `json:"args"`
+	Variadic bool     `json:"variadic,omitempty"`
+	Results  []string `json:"results"`
+}
+
+// ArgSpec declares a positional arg of a registered task. Missing required
+// args fail the task, missing optional args are filled with Default, given
+// as it would be sent, e.g. float64 for numbers. Args of another Type than
+// declared fail the task too, unless Type is empty.
+type ArgSpec struct {
+	Name     string
+	Type     string
+	Required bool
+	Default  interface{}
+}
+
+// Validates args of the signature against the specs of its task
+// and fills in defaults of missing optional args
+func (server *Server) applyArgSpecs(signature *signatures.TaskSignature) error {
+	for i, spec := range server.argSpecs[signature.Name] {
+		if i < len(signature.Args) {
+			if spec.Type != "" && signature.Args[i].Type != spec.Type {
+				return fmt.Errorf(
+					"Task '%s' arg '%s' is %s, want %s",
+					signature.Name,
+					spec.Name,
+					signature.Args[i].Type,
+					spec.Type,
+				)
+			}
+			continue
+		}
+
+		if spec.Required {
+			return fmt.Errorf("Task '%s' missing required arg '%s'", signature.Name, spec.Name)
+		}
+
+		signature.Args = append(signature.Args, signatures.TaskArg{
+			Type:  spec.Type,
+			Value: spec.Default,
+		})
+	}
+
+	return nil
+}
+
+// GetTaskDefinitions describes registered tasks sorted by name
+func (server *Server) GetTaskDefinitions() ([]*TaskDefinition, error) {
+	names := make([]string, 0, len(server.registeredTasks))
+	for name := range server.registeredTasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]*TaskDefinition, len(names))
+	for i, name := range names {
+		taskType := reflect.TypeOf(server.registeredTasks[name])
+		if taskType == nil || taskType.Kind() != reflect.Func {
+			return nil, fmt.Errorf("Task '%s' is not a function", name)
+		}
+
+		// The context is passed by the worker, producers don't send it
+		first := 0
+		if takesContext(taskType) {
+			first = 1
+		}
+
+		definition := &TaskDefinition{
+			Name:     name,
+			Args:     make([]string, taskType.NumIn()-first),
+			Variadic: taskType.IsVariadic(),
+			Results:  make([]string, taskType.NumOut()),
+		}
+		for j := range definition.Args {
+			definition.Args[j] = taskType.In(first + j).String()
+		}
+		// Variadic args are listed by their element type
+		if definition.Variadic {
+			last := len(definition.Args) - 1
+			definition.Args[last] = taskType.In(first + last).Elem().String()
+		}
+		for j := range definition.Results {
+			definition.Results[j] = taskType.Out(j).String()
+		}
+
+		definitions[i] = definition
+	}
+
+	return definitions, nil
+}
+
+// ExportRegistry serializes registered tasks and their param and result
+// types to JSON, so producers can check they send correctly shaped tasks
+func (server *Server) ExportRegistry() ([]byte, error) {
+	definitions, err := server.GetTaskDefinitions()
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(definitions)
+}
+
+// ExportRegistrySchema exports registered tasks as an OpenAPI document
+// with a schema of the task signature expected by each task. Args are
+// described positionally using JSON Schema's tuple form of items.
+func (server *Server) ExportRegistrySchema() ([]byte, error) {
+	definitions, err := server.GetTaskDefinitions()
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := make(map[string]interface{}, len(definitions))
+	for _, definition := range definitions {
+		schemas[definition.Name] = signatureSchema(definition)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Machinery tasks",
+			"version": "1.0.0",
+		},
+		"paths": map[string]interface{}{},
+		"components": map[string]interface{}{
+			"schemas": schemas,
+		},
+	})
+}
+
+func signatureSchema(definition *TaskDefinition) map[string]interface{} {
+	items := make([]interface{}, len(definition.Args))
+	for i, argType := range definition.Args {
+		items[i] = argSchema(argType)
+	}
+
+	args := map[string]interface{}{
+		"type":  "array",
+		"items": items,
+	}
+	if definition.Variadic {
+		last := len(items) - 1
+		args["items"] = items[:last]
+		args["minItems"] = last
+		args["additionalItems"] = items[last]
+	} else {
+		args["minItems"] = len(items)
+		args["maxItems"] = len(items)
+		args["additionalItems"] = false
+	}
+
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"Name", "Args"},
+		"properties": map[string]interface{}{
+			"Name": map[string]interface{}{
+				"type": "string",
+				"enum": []string{definition.Name},
+			},
+			"Args": args,
+		},
+	}
+}
+
+func argSchema(argType string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":     "object",
+		"required": []string{"Type", "Value"},
+		"properties": map[string]interface{}{
+			"Type": map[string]interface{}{
+				"type": "string",
+				"enum": []string{argType},
+			},
+			"Value": valueSchema(argType),
+		},
+	}
+}
+
+// Values of custom types (see utils.RegisterArgCodec) are not constrained
+func valueSchema(argType string) map[string]interface{} {
+	switch argType {
+	case "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64":
+		return map[string]interface{}{"type": "integer"}
+	case "float32", "float64":
+		return map[string]interface{}{"type": "number"}
+	case "string":
+		return map[string]interface{}{"type": "string"}
+	case "bool":
+		return map[string]interface{}{"type": "boolean"}
+	}
+	return map[string]interface{}{}
+}
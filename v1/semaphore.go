@@ -0,0 +1,98 @@
+package machinery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/brokers"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// ErrConcurrencyLimit is returned for tasks requeued because all slots
+// of their fleet-wide concurrency limit are taken (see TaskConcurrency)
+var ErrConcurrencyLimit = errors.New("Task concurrency limit reached")
+
+// Acquires a slot of the task's fleet-wide concurrency limit, if it has
+// one, and returns a function releasing it. The slot's lease is renewed
+// until it is released. Returns false if no slot is free.
+func (worker *Worker) acquireSlot(signature *signatures.TaskSignature) (func(), bool, error) {
+	limit := worker.server.GetConfig().TaskConcurrency[signature.Name]
+	if limit == 0 {
+		return func() {}, true, nil
+	}
+
+	semaphore, ok := worker.server.GetBackend().(backends.Semaphore)
+	if !ok {
+		return nil, false, errors.New("Result backend does not support task concurrency limits")
+	}
+
+	return worker.acquireSemaphore(semaphore, signature, signature.Name, limit)
+}
+
+// Acquires a slot of the named semaphore for the task and returns a
+// function releasing it. The slot's lease is renewed until it is released.
+// Returns false if no slot is free.
+func (worker *Worker) acquireSemaphore(semaphore backends.Semaphore, signature *signatures.TaskSignature, name string, limit int) (func(), bool, error) {
+	lease := worker.server.GetConfig().SemaphoreLease
+	if lease == 0 {
+		lease = 30 // lease slots for 30 seconds by default
+	}
+
+	slot, err := semaphore.AcquireSlot(name, limit, lease)
+	if err != nil || slot == nil {
+		return nil, false, err
+	}
+
+	// Renew the lease well before it expires
+	stopRenewing := make(chan int)
+	go func() {
+		ticker := time.NewTicker(time.Duration(lease) * time.Second / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopRenewing:
+				return
+			case <-ticker.C:
+				if err := semaphore.RenewSlot(slot, lease); err != nil {
+					log.Printf("Failed renewing semaphore slot of %s. Error = %v", signature.UUID, err)
+				}
+			}
+		}
+	}()
+
+	release := func() {
+		close(stopRenewing)
+		if err := semaphore.ReleaseSlot(slot); err != nil {
+			log.Printf("Failed releasing semaphore slot of %s. Error = %v", signature.UUID, err)
+		}
+	}
+	return release, true, nil
+}
+
+// Waits a moment and hands a task over to run once a slot is free,
+// requeueing its message with AckAfterResult or publishing it again.
+// Returns a DeferredError with the reason, so the broker tells deferred
+// tasks from processed ones.
+func (worker *Worker) deferTask(signature *signatures.TaskSignature, reason error) error {
+	cnf := worker.server.GetConfig()
+
+	delay := time.Duration(cnf.ConcurrencyRetryDelay) * time.Millisecond
+	if delay == 0 {
+		delay = time.Second // wait a second by default
+	}
+	time.Sleep(delay)
+
+	deferredError := &brokers.DeferredError{Reason: reason}
+	if cnf.AckAfterResult {
+		return brokers.NewActionError(brokers.ActionRequeue, deferredError)
+	}
+
+	if err := worker.server.GetBroker().Publish(signature); err != nil {
+		return worker.finalizeError(signature, fmt.Errorf("Requeue Publish: %v", err))
+	}
+	return deferredError
+}
@@ -1,28 +1,43 @@
 package machinery
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/RichardKnop/machinery/v1/backends"
 	"github.com/RichardKnop/machinery/v1/brokers"
 	"github.com/RichardKnop/machinery/v1/config"
 	"github.com/RichardKnop/machinery/v1/signatures"
+	"github.com/RichardKnop/machinery/v1/utils"
 )
 
+// ErrDuplicateTask is returned from SendTask when a task with the same
+// DedupKey has already been sent within its DedupWindow
+var ErrDuplicateTask = errors.New("Duplicate task")
+
 // Server is the main Machinery object and stores all configuration
 // All the tasks workers process are registered against the server
 type Server struct {
 	config          *config.Config
 	registeredTasks map[string]interface{}
+	argSpecs        map[string][]ArgSpec
 	broker          brokers.Broker
 	backend         backends.Backend
 }
 
 // NewServer creates Server instance
 func NewServer(cnf *config.Config) (*Server, error) {
-	broker, err := BrokerFactory(cnf, make(chan int))
+	if err := cnf.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Buffered so stopping a worker which has not started consuming yet
+	// doesn't block
+	broker, err := BrokerFactory(cnf, make(chan int, 1))
 	if err != nil {
 		return nil, err
 	}
@@ -33,6 +48,7 @@ func NewServer(cnf *config.Config) (*Server, error) {
 	return &Server{
 		config:          cnf,
 		registeredTasks: make(map[string]interface{}),
+		argSpecs:        make(map[string][]ArgSpec),
 		broker:          broker,
 		backend:         backend,
 	}, nil
@@ -40,10 +56,27 @@ func NewServer(cnf *config.Config) (*Server, error) {
 
 // NewWorker creates Worker instance
 func (server *Server) NewWorker(consumerTag string) *Worker {
-	return &Worker{
+	webhookConcurrency := server.config.WebhookConcurrency
+	if webhookConcurrency == 0 {
+		webhookConcurrency = 100 // post up to 100 webhooks at once by default
+	}
+
+	worker := &Worker{
 		server:      server,
 		ConsumerTag: consumerTag,
+		webhooks:    make(chan struct{}, webhookConcurrency),
+	}
+
+	if server.config.BloomFilterWindow > 0 {
+		size := server.config.BloomFilterSize
+		if size == 0 {
+			size = 1 << 20 // 1 million bits by default
+		}
+		window := time.Duration(server.config.BloomFilterWindow) * time.Second
+		worker.completed = utils.NewBloomFilter(size, window)
 	}
+
+	return worker
 }
 
 // GetBroker returns broker
@@ -79,11 +112,18 @@ func (server *Server) SetConfig(cnf *config.Config) {
 // RegisterTasks registers all tasks at once
 func (server *Server) RegisterTasks(tasks map[string]interface{}) {
 	server.registeredTasks = tasks
+	server.argSpecs = make(map[string][]ArgSpec)
 }
 
-// RegisterTask registers a single task
-func (server *Server) RegisterTask(name string, task interface{}) {
+// RegisterTask registers a single task, optionally with specs of its args
+// which incoming args are validated against (see ArgSpec)
+func (server *Server) RegisterTask(name string, task interface{}, argSpecs ...ArgSpec) {
 	server.registeredTasks[name] = task
+	if len(argSpecs) > 0 {
+		server.argSpecs[name] = argSpecs
+	} else {
+		delete(server.argSpecs, name)
+	}
 }
 
 // GetRegisteredTask returns registered task by name
@@ -98,7 +138,29 @@ func (server *Server) SendTask(signature *signatures.TaskSignature) (*backends.A
 		signature.UUID = uuid.New()
 	}
 
+	// Only publish the task once per deduplication window
+	deduplicator, dedup := server.backend.(backends.Deduplicator)
+	if signature.DedupKey != "" {
+		if !dedup {
+			return nil, errors.New("Result backend does not support task deduplication")
+		}
+
+		claimed, err := deduplicator.ClaimKey(signature.DedupKey, signature.DedupWindow)
+		if err != nil {
+			return nil, fmt.Errorf("Claim Dedup Key: %v", err)
+		}
+		if !claimed {
+			return nil, ErrDuplicateTask
+		}
+	}
+
 	if err := server.broker.Publish(signature); err != nil {
+		// Release the key so the task can be sent again
+		if signature.DedupKey != "" {
+			if err := deduplicator.ReleaseKey(signature.DedupKey); err != nil {
+				log.Print(err)
+			}
+		}
 		return nil, fmt.Errorf("Publish Message: %v", err)
 	}
 
@@ -113,6 +175,10 @@ func (server *Server) SendTask(signature *signatures.TaskSignature) (*backends.A
 
 // SendChain triggers a chain of tasks
 func (server *Server) SendChain(chain *Chain) (*backends.ChainAsyncResult, error) {
+	if err := chain.validate(); err != nil {
+		return nil, err
+	}
+
 	if err := server.broker.Publish(chain.Tasks[0]); err != nil {
 		return nil, fmt.Errorf("Publish Message: %v", err)
 	}
@@ -126,11 +192,49 @@ func (server *Server) SendChain(chain *Chain) (*backends.ChainAsyncResult, error
 	return backends.NewChainAsyncResult(chain.GetUUIDs(), server.backend), nil
 }
 
+// CommitTaskState stores the final state of a task unless another delivery
+// of the task has already committed one (see ExactlyOnce)
+func (server *Server) CommitTaskState(taskState *backends.TaskState) error {
+	committer, ok := server.backend.(backends.Committer)
+	if !ok {
+		return errors.New("Result backend does not support exactly-once delivery")
+	}
+	return committer.CommitState(taskState)
+}
+
 // UpdateTaskState updates a task state
 // If no result backend has been configured, does nothing
+// Failed writes are retried with exponential backoff so a brief backend
+// outage doesn't lose the state. If all retries fail, the state is logged.
 func (server *Server) UpdateTaskState(taskState *backends.TaskState) error {
 	if server.backend == nil {
 		return nil
 	}
-	return server.backend.UpdateState(taskState)
+
+	backoff := server.config.ResultBackendBackoff
+	if backoff == nil {
+		delay := time.Duration(server.config.ResultBackendRetryDelay) * time.Millisecond
+		if delay == 0 {
+			// wait 100 milliseconds before the first retry by default
+			delay = 100 * time.Millisecond
+		}
+		backoff = &utils.ExponentialBackoff{Initial: delay}
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = server.backend.UpdateState(taskState)
+		if err == nil || attempt >= server.config.ResultBackendRetries {
+			break
+		}
+
+		time.Sleep(backoff.NextDelay(attempt + 1))
+	}
+
+	if err != nil {
+		encoded, _ := json.Marshal(taskState)
+		log.Printf("Failed storing task state: %s. Error = %v", encoded, err)
+	}
+
+	return err
 }
@@ -0,0 +1,118 @@
+package signatures
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/RichardKnop/machinery/v1/utils"
+)
+
+// EncryptArgs returns a copy of the signature with values of sensitive
+// args encrypted, including args of success / error callbacks so they
+// don't travel in plaintext inside this signature either
+func (taskSignature *TaskSignature) EncryptArgs(encryptor utils.Encryptor) (*TaskSignature, error) {
+	encrypted := *taskSignature
+
+	var err error
+	if encrypted.Args, err = encryptArgs(taskSignature.Args, encryptor); err != nil {
+		return nil, err
+	}
+	if encrypted.OnSuccess, err = encryptCallbacks(taskSignature.OnSuccess, encryptor); err != nil {
+		return nil, err
+	}
+	if encrypted.OnError, err = encryptCallbacks(taskSignature.OnError, encryptor); err != nil {
+		return nil, err
+	}
+
+	return &encrypted, nil
+}
+
+// DecryptArgs decrypts values of sensitive args in place. Args of callbacks
+// stay encrypted until the callbacks themselves are consumed.
+func (taskSignature *TaskSignature) DecryptArgs(encryptor utils.Encryptor) error {
+	for i, arg := range taskSignature.Args {
+		if !arg.Encrypted {
+			continue
+		}
+
+		if encryptor == nil {
+			return errors.New("Encrypted arg but no encryptor configured")
+		}
+
+		encoded, ok := arg.Value.(string)
+		if !ok {
+			return fmt.Errorf("Encrypted arg %d is %T, want string", i, arg.Value)
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("Decode Arg %d: %v", i, err)
+		}
+
+		plaintext, err := encryptor.Decrypt(ciphertext)
+		if err != nil {
+			return fmt.Errorf("Decrypt Arg %d: %v", i, err)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(plaintext, &value); err != nil {
+			return fmt.Errorf("JSON Decode Arg %d: %v", i, err)
+		}
+
+		taskSignature.Args[i].Value = value
+		taskSignature.Args[i].Encrypted = false
+	}
+
+	return nil
+}
+
+func encryptArgs(args []TaskArg, encryptor utils.Encryptor) ([]TaskArg, error) {
+	if args == nil {
+		return nil, nil
+	}
+
+	encrypted := make([]TaskArg, len(args))
+	for i, arg := range args {
+		encrypted[i] = arg
+		if !arg.Sensitive || arg.Encrypted {
+			continue
+		}
+
+		if encryptor == nil {
+			return nil, errors.New("Sensitive arg but no encryptor configured")
+		}
+
+		plaintext, err := json.Marshal(arg.Value)
+		if err != nil {
+			return nil, fmt.Errorf("JSON Encode Arg %d: %v", i, err)
+		}
+
+		ciphertext, err := encryptor.Encrypt(plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("Encrypt Arg %d: %v", i, err)
+		}
+
+		encrypted[i].Value = base64.StdEncoding.EncodeToString(ciphertext)
+		encrypted[i].Encrypted = true
+	}
+
+	return encrypted, nil
+}
+
+func encryptCallbacks(callbacks []*TaskSignature, encryptor utils.Encryptor) ([]*TaskSignature, error) {
+	if callbacks == nil {
+		return nil, nil
+	}
+
+	encrypted := make([]*TaskSignature, len(callbacks))
+	for i, callback := range callbacks {
+		var err error
+		if encrypted[i], err = callback.EncryptArgs(encryptor); err != nil {
+			return nil, err
+		}
+	}
+
+	return encrypted, nil
+}
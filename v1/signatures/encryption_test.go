@@ -0,0 +1,64 @@
+package signatures
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/RichardKnop/machinery/v1/utils"
+)
+
+func TestEncryptArgs(t *testing.T) {
+	encryptor, err := utils.NewAESEncryptor([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature := &TaskSignature{
+		Name: "verify",
+		Args: []TaskArg{
+			TaskArg{Type: "string", Value: "123-45-6789", Sensitive: true},
+			TaskArg{Type: "int64", Value: 1},
+		},
+		OnSuccess: []*TaskSignature{&TaskSignature{
+			Name: "notify",
+			Args: []TaskArg{TaskArg{Type: "string", Value: "123-45-6789", Sensitive: true}},
+		}},
+	}
+
+	encrypted, err := signature.EncryptArgs(encryptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signature.Args[0].Value != "123-45-6789" || signature.Args[0].Encrypted {
+		t.Error("original signature should not be modified")
+	}
+
+	if !encrypted.Args[0].Encrypted || strings.Contains(encrypted.Args[0].Value.(string), "6789") {
+		t.Errorf("encrypted.Args[0] = %+v, want encrypted value", encrypted.Args[0])
+	}
+
+	if encrypted.Args[1].Encrypted || encrypted.Args[1].Value != 1 {
+		t.Errorf("encrypted.Args[1] = %+v, want plaintext value", encrypted.Args[1])
+	}
+
+	if !encrypted.OnSuccess[0].Args[0].Encrypted {
+		t.Error("sensitive args of callbacks should be encrypted")
+	}
+
+	if err := encrypted.DecryptArgs(encryptor); err != nil {
+		t.Fatal(err)
+	}
+
+	if encrypted.Args[0].Value != "123-45-6789" || encrypted.Args[0].Encrypted {
+		t.Errorf("encrypted.Args[0] = %+v, want decrypted value", encrypted.Args[0])
+	}
+
+	if !encrypted.OnSuccess[0].Args[0].Encrypted {
+		t.Error("args of callbacks should stay encrypted")
+	}
+
+	if _, err := signature.EncryptArgs(nil); err == nil {
+		t.Error("sensitive args without encryptor should return error")
+	}
+}
@@ -1,20 +1,76 @@
 package signatures
 
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// AttemptHeader - number of failed attempts so far
+	AttemptHeader = "x-attempt"
+	// LastErrorHeader - error of the last failed attempt
+	LastErrorHeader = "x-last-error"
+	// FirstFailureHeader - time of the first failed attempt (RFC 3339)
+	FirstFailureHeader = "x-first-failure"
+	// WorkerHeader - ID of the worker which republished the task
+	WorkerHeader = "x-worker-id"
+	// DeliveryCountHeader - number of previous deliveries (quorum queues)
+	DeliveryCountHeader = "x-delivery-count"
+	// SchemaVersionHeader - version of the schema the task conforms to
+	SchemaVersionHeader = "x-schema-version"
+	// FormatVersionHeader - version of the message format
+	FormatVersionHeader = "x-format-version"
+	// MaxQueueWaitHeader - time in milliseconds the task may wait in the queue
+	MaxQueueWaitHeader = "x-max-queue-wait"
+	// TraceParentHeader - W3C trace context of the trace the task belongs to
+	TraceParentHeader = "traceparent"
+	// RetryAtHeader - time a retry waiting in the retry queue is due (RFC 3339)
+	RetryAtHeader = "x-retry-at"
+	// SequenceHeader - publish order of the task among tasks of its routing key
+	SequenceHeader = "x-sequence"
+	// OperationHeader - ID of the business operation which enqueued the task
+	OperationHeader = "x-operation-id"
+	// RetryBudgetHeader - retries left to all remaining steps of a workflow
+	RetryBudgetHeader = "x-retry-budget"
+	// WorkflowPathHeader - UUIDs of the workflow tasks run before the task
+	WorkflowPathHeader = "x-workflow-path"
+	// MessageSignatureHeader - signature of the message body by its publisher
+	MessageSignatureHeader = "x-message-signature"
+)
+
 // TaskArg represents a single argument passed to invocation fo a task
 type TaskArg struct {
-	Type  string
-	Value interface{}
+	Type      string
+	Value     interface{}
+	Sensitive bool
+	Encrypted bool
 }
 
 // TaskSignature represents a single task invocation
 type TaskSignature struct {
-	UUID       string
-	Name       string
-	RoutingKey string
-	Args       []TaskArg
-	Immutable  bool
-	OnSuccess  []*TaskSignature
-	OnError    []*TaskSignature
+	UUID          string
+	Name          string
+	RoutingKey    string
+	Args          []TaskArg
+	Immutable     bool
+	OnSuccess     []*TaskSignature
+	OnError       []*TaskSignature
+	CallbackURL   string
+	RetryCount    int
+	Headers       map[string]interface{}
+	DedupKey      string
+	DedupWindow   int
+	ValidUntil    time.Time
+	MaxQueueWait  time.Duration
+	SlowThreshold time.Duration
+	HungThreshold time.Duration
+	AffinityKey   string
+	Priority      uint8
+	CoalescingKey string
+	TenantID      string
+	ReplyTo       string
+	ContentType   string
+	Redelivered   bool
 }
 
 // AdjustRoutingKey makes sure the routing key is correct.
@@ -33,3 +89,126 @@ func (taskSignature *TaskSignature) AdjustRoutingKey(exchangeType, bindingKey, q
 
 	taskSignature.RoutingKey = queueName
 }
+
+// IsExpired returns true if the task's ValidUntil deadline has passed
+func (taskSignature *TaskSignature) IsExpired() bool {
+	return !taskSignature.ValidUntil.IsZero() && time.Now().After(taskSignature.ValidUntil)
+}
+
+// WithMaxQueueWait limits the time the task may wait in the queue, tasks
+// not consumed in time expire and get dead lettered (if configured)
+func (taskSignature *TaskSignature) WithMaxQueueWait(maxQueueWait time.Duration) *TaskSignature {
+	taskSignature.MaxQueueWait = maxQueueWait
+	return taskSignature
+}
+
+// GetAttempt returns number of failed attempts recorded in headers
+func (taskSignature *TaskSignature) GetAttempt() int {
+	return taskSignature.getIntHeader(AttemptHeader)
+}
+
+// GetRetryBudget returns the retries left to the workflow the task is a
+// step of, if the workflow has a retry budget
+func (taskSignature *TaskSignature) GetRetryBudget() (int, bool) {
+	if _, ok := taskSignature.Headers[RetryBudgetHeader]; !ok {
+		return 0, false
+	}
+	return taskSignature.getIntHeader(RetryBudgetHeader), true
+}
+
+// GetDeliveryCount returns number of previous deliveries of the message,
+// either counted by the broker (quorum queues) or recorded in retry headers
+func (taskSignature *TaskSignature) GetDeliveryCount() int {
+	deliveryCount := taskSignature.getIntHeader(DeliveryCountHeader)
+	if attempt := taskSignature.GetAttempt(); attempt > deliveryCount {
+		return attempt
+	}
+	return deliveryCount
+}
+
+// GetFormatVersion returns version of the message format declared in
+// headers, messages of producers which don't declare it are version 1
+func (taskSignature *TaskSignature) GetFormatVersion() int {
+	if version := taskSignature.getIntHeader(FormatVersionHeader); version > 0 {
+		return version
+	}
+	return 1
+}
+
+// GetSequence returns the publish order of the task among tasks of its
+// routing key, if the publisher stamped it
+func (taskSignature *TaskSignature) GetSequence() (int64, bool) {
+	// Numbers are float64 when decoded from JSON
+	switch value := taskSignature.Headers[SequenceHeader].(type) {
+	case int:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case float64:
+		return int64(value), true
+	}
+	return 0, false
+}
+
+// GetWorkflowPath returns UUIDs of the tasks of the workflow which ran
+// before the task, in order, i.e. the tasks whose callback it is
+func (taskSignature *TaskSignature) GetWorkflowPath() []string {
+	// Arrays are []interface{} when decoded from JSON or AMQP tables
+	switch value := taskSignature.Headers[WorkflowPathHeader].(type) {
+	case []string:
+		return value
+	case []interface{}:
+		path := make([]string, 0, len(value))
+		for _, taskUUID := range value {
+			if taskUUID, ok := taskUUID.(string); ok {
+				path = append(path, taskUUID)
+			}
+		}
+		return path
+	}
+	return nil
+}
+
+// GetTraceID returns the trace ID from the W3C trace context header,
+// set when the task was published within a trace, or an empty string
+func (taskSignature *TaskSignature) GetTraceID() string {
+	// version-trace_id-parent_id-flags, e.g.
+	// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+	traceParent, _ := taskSignature.Headers[TraceParentHeader].(string)
+	parts := strings.Split(traceParent, "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || parts[1] == strings.Repeat("0", 32) {
+		return ""
+	}
+	return parts[1]
+}
+
+func (taskSignature *TaskSignature) getIntHeader(name string) int {
+	// Numbers are float64 when decoded from JSON
+	switch value := taskSignature.Headers[name].(type) {
+	case int:
+		return value
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case float64:
+		return int(value)
+	}
+	return 0
+}
+
+// StampRetry records a failed attempt in headers so the retry
+// history survives republishing of the task
+func (taskSignature *TaskSignature) StampRetry(err error) {
+	if taskSignature.Headers == nil {
+		taskSignature.Headers = make(map[string]interface{})
+	}
+
+	taskSignature.Headers[AttemptHeader] = taskSignature.GetAttempt() + 1
+	taskSignature.Headers[LastErrorHeader] = err.Error()
+	if _, ok := taskSignature.Headers[FirstFailureHeader]; !ok {
+		taskSignature.Headers[FirstFailureHeader] = time.Now().UTC().Format(time.RFC3339)
+	}
+}
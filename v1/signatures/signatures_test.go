@@ -1,6 +1,10 @@
 package signatures
 
-import "testing"
+import (
+	"errors"
+	"testing"
+	"time"
+)
 
 func TestAdjustRoutingKey(t *testing.T) {
 	var signature TaskSignature
@@ -41,3 +45,106 @@ func TestAdjustRoutingKey(t *testing.T) {
 		)
 	}
 }
+
+func TestStampRetry(t *testing.T) {
+	signature := TaskSignature{}
+
+	if signature.GetAttempt() != 0 {
+		t.Errorf("signature.GetAttempt() = %v, want 0", signature.GetAttempt())
+	}
+
+	signature.StampRetry(errors.New("first error"))
+	firstFailure := signature.Headers[FirstFailureHeader]
+
+	signature.StampRetry(errors.New("second error"))
+
+	if signature.GetAttempt() != 2 {
+		t.Errorf("signature.GetAttempt() = %v, want 2", signature.GetAttempt())
+	}
+
+	if signature.Headers[LastErrorHeader] != "second error" {
+		t.Errorf(
+			"signature.Headers[LastErrorHeader] = %v, want second error",
+			signature.Headers[LastErrorHeader],
+		)
+	}
+
+	if signature.Headers[FirstFailureHeader] != firstFailure {
+		t.Errorf(
+			"signature.Headers[FirstFailureHeader] = %v, want %v",
+			signature.Headers[FirstFailureHeader],
+			firstFailure,
+		)
+	}
+
+	// Headers decoded from JSON hold float64 numbers
+	signature.Headers[AttemptHeader] = float64(5)
+	if signature.GetAttempt() != 5 {
+		t.Errorf("signature.GetAttempt() = %v, want 5", signature.GetAttempt())
+	}
+}
+
+func TestGetDeliveryCount(t *testing.T) {
+	signature := TaskSignature{}
+	if signature.GetDeliveryCount() != 0 {
+		t.Errorf("signature.GetDeliveryCount() = %v, want 0", signature.GetDeliveryCount())
+	}
+
+	signature.Headers = map[string]interface{}{DeliveryCountHeader: int64(3)}
+	if signature.GetDeliveryCount() != 3 {
+		t.Errorf("signature.GetDeliveryCount() = %v, want 3", signature.GetDeliveryCount())
+	}
+
+	signature.Headers[AttemptHeader] = 4
+	if signature.GetDeliveryCount() != 4 {
+		t.Errorf("signature.GetDeliveryCount() = %v, want 4", signature.GetDeliveryCount())
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	signature := TaskSignature{}
+	if signature.IsExpired() {
+		t.Error("signature without ValidUntil should not expire")
+	}
+
+	signature.ValidUntil = time.Now().Add(time.Hour)
+	if signature.IsExpired() {
+		t.Error("signature valid for another hour should not be expired")
+	}
+
+	signature.ValidUntil = time.Now().Add(-time.Second)
+	if !signature.IsExpired() {
+		t.Error("signature past ValidUntil should be expired")
+	}
+}
+
+func TestGetFormatVersion(t *testing.T) {
+	signature := TaskSignature{}
+	if version := signature.GetFormatVersion(); version != 1 {
+		t.Errorf("signature.GetFormatVersion() = %v, want 1", version)
+	}
+
+	signature.Headers = map[string]interface{}{FormatVersionHeader: int32(3)}
+	if version := signature.GetFormatVersion(); version != 3 {
+		t.Errorf("signature.GetFormatVersion() = %v, want 3", version)
+	}
+}
+
+func TestGetTraceID(t *testing.T) {
+	testCases := []struct {
+		traceParent interface{}
+		want        string
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""},
+		{"garbage", ""},
+		{nil, ""},
+	}
+
+	for _, testCase := range testCases {
+		signature := TaskSignature{Headers: map[string]interface{}{TraceParentHeader: testCase.traceParent}}
+		if traceID := signature.GetTraceID(); traceID != testCase.want {
+			t.Errorf("signature.GetTraceID() = %v, want %v", traceID, testCase.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package machinery
+
+import (
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// ErrTenantQuota is returned for tasks requeued because their tenant is
+// over its quota (see TenantConcurrency and TenantRateLimit)
+var ErrTenantQuota = errors.New("Tenant quota exceeded")
+
+// TenantStats describes the usage of a tenant in the worker: how many of
+// its tasks are running, how many started and how many were deferred
+// because the tenant was over its quota
+type TenantStats struct {
+	InFlight int
+	Started  int64
+	Deferred int64
+}
+
+// tenantUsage tracks usage of each tenant in the worker
+type tenantUsage struct {
+	tenants map[string]*TenantStats
+	mutex   sync.Mutex
+}
+
+// Returns the stats of the tenant, must be called with the mutex held
+func (usage *tenantUsage) get(tenantID string) *TenantStats {
+	if usage.tenants == nil {
+		usage.tenants = make(map[string]*TenantStats)
+	}
+	stats, ok := usage.tenants[tenantID]
+	if !ok {
+		stats = new(TenantStats)
+		usage.tenants[tenantID] = stats
+	}
+	return stats
+}
+
+func (usage *tenantUsage) start(tenantID string) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	stats := usage.get(tenantID)
+	stats.InFlight++
+	stats.Started++
+}
+
+func (usage *tenantUsage) finish(tenantID string) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	usage.get(tenantID).InFlight--
+}
+
+func (usage *tenantUsage) deferred(tenantID string) {
+	usage.mutex.Lock()
+	defer usage.mutex.Unlock()
+
+	usage.get(tenantID).Deferred++
+}
+
+// WorkerStats describes the usage of the worker by tenant (see TenantID of
+// TaskSignature), to watch for noisy tenants
+type WorkerStats struct {
+	Tenants map[string]TenantStats
+}
+
+// Stats returns the usage of the worker, by tenant whose tasks it consumed
+func (worker *Worker) Stats() WorkerStats {
+	worker.tenants.mutex.Lock()
+	defer worker.tenants.mutex.Unlock()
+
+	tenants := make(map[string]TenantStats, len(worker.tenants.tenants))
+	for tenantID, tenantStats := range worker.tenants.tenants {
+		tenants[tenantID] = *tenantStats
+	}
+	return WorkerStats{Tenants: tenants}
+}
+
+// Keeps the task's tenant, if it has one, within its quota: the rate of
+// its tasks started fleet-wide (see TenantRateLimit) and its concurrently
+// running tasks fleet-wide (see TenantConcurrency). Returns a function
+// releasing the tenant's concurrency slot, or false if the tenant is over
+// its quota. Only tasks within the quota count towards the rate, so a
+// deferred backlog doesn't keep the tenant over it.
+func (worker *Worker) acquireQuota(signature *signatures.TaskSignature) (func(), bool, error) {
+	cnf := worker.server.GetConfig()
+	tenantID := signature.TenantID
+	if tenantID == "" || (cnf.TenantRateLimit == 0 && cnf.TenantConcurrency == 0) {
+		return func() {}, true, nil
+	}
+
+	// Count the task towards the rate first, so tasks over it don't take
+	// a slot, and take the count back if the task is deferred after all
+	uncount := func() {}
+	if cnf.TenantRateLimit > 0 {
+		counter, ok := worker.server.GetBackend().(backends.RateCounter)
+		if !ok {
+			return nil, false, errors.New("Result backend does not support tenant rate limits")
+		}
+
+		window := cnf.TenantRateWindow
+		if window == 0 {
+			window = 1 // limit the rate per second by default
+		}
+		key := "tenant:" + tenantID
+		count, err := counter.IncrementCounter(key, window)
+		if err != nil {
+			return nil, false, err
+		}
+		uncount = func() {
+			if err := counter.DecrementCounter(key, window); err != nil {
+				log.Printf("Failed uncounting deferred %s of tenant %s. Error = %v", signature.UUID, tenantID, err)
+			}
+		}
+
+		if count > int64(cnf.TenantRateLimit) {
+			uncount()
+			worker.tenants.deferred(tenantID)
+			return nil, false, nil
+		}
+	}
+
+	release := func() {}
+	if cnf.TenantConcurrency > 0 {
+		semaphore, ok := worker.server.GetBackend().(backends.Semaphore)
+		if !ok {
+			uncount()
+			return nil, false, errors.New("Result backend does not support tenant concurrency limits")
+		}
+
+		var acquired bool
+		var err error
+		release, acquired, err = worker.acquireSemaphore(semaphore, signature, "tenant:"+tenantID, cnf.TenantConcurrency)
+		if err != nil {
+			uncount()
+			return nil, false, err
+		}
+		if !acquired {
+			uncount()
+			worker.tenants.deferred(tenantID)
+			return nil, false, nil
+		}
+	}
+
+	worker.tenants.start(tenantID)
+	return func() {
+		worker.tenants.finish(tenantID)
+		release()
+	}, true, nil
+}
@@ -0,0 +1,138 @@
+package machinery
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/signatures"
+)
+
+// ErrTaskHung is returned for tasks given up on after running longer
+// than their hung threshold (see HungThreshold)
+var ErrTaskHung = errors.New("Task hung")
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
+// Tells whether the task takes a context.Context as its first parameter,
+// passed by the worker rather than among the signature's args
+func takesContext(taskType reflect.Type) bool {
+	return taskType.NumIn() > 0 && taskType.In(0) == contextType
+}
+
+// Returns the slow and hung thresholds of the task, the signature's
+// override the configured ones
+func (worker *Worker) thresholds(signature *signatures.TaskSignature) (time.Duration, time.Duration) {
+	cnf := worker.server.GetConfig()
+
+	slow := signature.SlowThreshold
+	if slow == 0 {
+		slow = time.Duration(cnf.SlowThreshold) * time.Second
+	}
+
+	hung := signature.HungThreshold
+	if hung == 0 {
+		hung = time.Duration(cnf.HungThreshold) * time.Second
+	}
+
+	return slow, hung
+}
+
+// Calls the task, warning once it is slow and giving up on it once it is
+// hung or the heap grew by more than MaxTaskHeapDelta. Tasks taking a
+// context.Context as their first parameter are passed one, cancelled once
+// they are given up on. A task given up on keeps running in the background
+// until it returns, e.g. ignoring its context, but its results are
+// discarded; the returned channel is closed once it returns. Tasks running
+// longer than ProfileThreshold are profiled. Panics are recovered as a
+// *brokers.PanicError, so panicking tasks fail like any other, with their
+// state stored and their error callbacks called.
+func (worker *Worker) callTask(signature *signatures.TaskSignature, task reflect.Value, args []reflect.Value) ([]reflect.Value, <-chan struct{}, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if takesContext(task.Type()) {
+		args = append([]reflect.Value{reflect.ValueOf(ctx)}, args...)
+	}
+
+	slow, hung := worker.thresholds(signature)
+	maxHeapDelta := uint64(worker.server.GetConfig().MaxTaskHeapDelta)
+	profileThreshold := time.Duration(worker.server.GetConfig().ProfileThreshold) * time.Second
+	call := func() ([]reflect.Value, error) {
+		return task.Call(args), nil
+	}
+	if slow == 0 && hung == 0 && maxHeapDelta == 0 && profileThreshold == 0 {
+		results, err := safeCall(call)
+		return results, nil, err
+	}
+
+	// The heap is shared by tasks processed concurrently, its growth
+	// is only attributed to the task approximately
+	var heapBase uint64
+	if maxHeapDelta > 0 {
+		heapBase = worker.heap.start()
+		defer worker.heap.stop()
+	}
+
+	done := make(chan []reflect.Value, 1)
+	panicked := make(chan error, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+
+		results, err := safeCall(call)
+		if err != nil {
+			panicked <- err
+			return
+		}
+		done <- results
+	}()
+
+	var slowTimeout, hungTimeout <-chan time.Time
+	if slow > 0 {
+		timer := time.NewTimer(slow)
+		defer timer.Stop()
+		slowTimeout = timer.C
+	}
+	if hung > 0 {
+		timer := time.NewTimer(hung)
+		defer timer.Stop()
+		hungTimeout = timer.C
+	}
+
+	var profileTimeout <-chan time.Time
+	if profileThreshold > 0 {
+		timer := time.NewTimer(profileThreshold)
+		defer timer.Stop()
+		profileTimeout = timer.C
+	}
+	stopProfile := func() {}
+	defer func() { stopProfile() }()
+
+	for {
+		var heapSampled <-chan struct{}
+		if maxHeapDelta > 0 {
+			heapSampled = worker.heap.next()
+		}
+
+		select {
+		case results := <-done:
+			return results, nil, nil
+		case err := <-panicked:
+			return nil, nil, err
+		case <-slowTimeout:
+			log.Printf("Task %s (%s) is slow, running for more than %v", signature.UUID, signature.Name, slow)
+			slowTimeout = nil
+		case <-profileTimeout:
+			stopProfile = worker.startProfile(signature)
+			profileTimeout = nil
+		case <-hungTimeout:
+			return nil, returned, ErrTaskHung
+		case <-heapSampled:
+			if heap := worker.heap.current(); heap > heapBase && heap-heapBase > maxHeapDelta {
+				return nil, returned, &HeapDeltaError{Delta: heap - heapBase, Limit: maxHeapDelta}
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy computes delays before retries. Attempt is the number
+// of the retry starting from 1. Reset is called before a new sequence of
+// retries starts. Strategies must be safe for concurrent use.
+type BackoffStrategy interface {
+	NextDelay(attempt int) time.Duration
+	Reset()
+}
+
+// ConstantBackoff waits the same delay before every retry
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// NextDelay implements the BackoffStrategy interface
+func (backoff *ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return backoff.Delay
+}
+
+// Reset implements the BackoffStrategy interface
+func (backoff *ConstantBackoff) Reset() {}
+
+// LinearBackoff increases the delay by Delay with every retry, up to Max
+// (if not zero)
+type LinearBackoff struct {
+	Delay time.Duration
+	Max   time.Duration
+}
+
+// NextDelay implements the BackoffStrategy interface
+func (backoff *LinearBackoff) NextDelay(attempt int) time.Duration {
+	return capDelay(backoff.Delay*time.Duration(attempt), backoff.Max)
+}
+
+// Reset implements the BackoffStrategy interface
+func (backoff *LinearBackoff) Reset() {}
+
+// ExponentialBackoff doubles the delay with every retry starting
+// from Initial, up to Max (if not zero)
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// NextDelay implements the BackoffStrategy interface
+func (backoff *ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	delay := backoff.Initial
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if backoff.Max > 0 && delay >= backoff.Max {
+			return backoff.Max
+		}
+	}
+	return capDelay(delay, backoff.Max)
+}
+
+// Reset implements the BackoffStrategy interface
+func (backoff *ExponentialBackoff) Reset() {}
+
+// JitteredExponentialBackoff waits a random delay between zero and
+// the exponential delay, so that many clients retrying at the same time
+// don't overwhelm the server all at once
+type JitteredExponentialBackoff struct {
+	ExponentialBackoff
+}
+
+// NextDelay implements the BackoffStrategy interface
+func (backoff *JitteredExponentialBackoff) NextDelay(attempt int) time.Duration {
+	delay := backoff.ExponentialBackoff.NextDelay(attempt)
+	if delay <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(delay) + 1))
+}
+
+// FibonacciBackoff spaces out retries using Fibonacci sequence
+// multiplied by Unit, up to Max (if not zero)
+type FibonacciBackoff struct {
+	Unit time.Duration
+	Max  time.Duration
+}
+
+// NextDelay implements the BackoffStrategy interface
+func (backoff *FibonacciBackoff) NextDelay(attempt int) time.Duration {
+	fibonacci := Fibonacci()
+	n := 0
+	for i := 0; i < attempt; i++ {
+		n = fibonacci()
+		if backoff.Max > 0 && backoff.Unit*time.Duration(n) >= backoff.Max {
+			return backoff.Max
+		}
+	}
+	return backoff.Unit * time.Duration(n)
+}
+
+// Reset implements the BackoffStrategy interface
+func (backoff *FibonacciBackoff) Reset() {}
+
+func capDelay(delay, max time.Duration) time.Duration {
+	if max > 0 && delay > max {
+		return max
+	}
+	return delay
+}
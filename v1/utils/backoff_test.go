@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func delays(backoff BackoffStrategy) []time.Duration {
+	backoff.Reset()
+	sequence := make([]time.Duration, 5)
+	for i := range sequence {
+		sequence[i] = backoff.NextDelay(i + 1)
+	}
+	return sequence
+}
+
+func TestBackoffStrategies(t *testing.T) {
+	testCases := []struct {
+		backoff BackoffStrategy
+		want    []time.Duration
+	}{
+		{
+			&ConstantBackoff{Delay: time.Second},
+			[]time.Duration{1, 1, 1, 1, 1},
+		},
+		{
+			&LinearBackoff{Delay: time.Second, Max: 4 * time.Second},
+			[]time.Duration{1, 2, 3, 4, 4},
+		},
+		{
+			&ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second},
+			[]time.Duration{1, 2, 4, 8, 10},
+		},
+		{
+			&FibonacciBackoff{Unit: time.Second},
+			[]time.Duration{1, 1, 2, 3, 5},
+		},
+	}
+
+	for _, testCase := range testCases {
+		want := make([]time.Duration, len(testCase.want))
+		for i, seconds := range testCase.want {
+			want[i] = seconds * time.Second
+		}
+
+		if sequence := delays(testCase.backoff); !reflect.DeepEqual(sequence, want) {
+			t.Errorf("%T: sequence = %v, want %v", testCase.backoff, sequence, want)
+		}
+	}
+}
+
+func TestJitteredExponentialBackoff(t *testing.T) {
+	backoff := &JitteredExponentialBackoff{
+		ExponentialBackoff{Initial: time.Second, Max: 10 * time.Second},
+	}
+
+	for i, max := range []time.Duration{1, 2, 4, 8, 10} {
+		delay := backoff.NextDelay(i + 1)
+		if delay < 0 || delay > max*time.Second {
+			t.Errorf("backoff.NextDelay(%d) = %v, want between 0 and %v", i+1, delay, max*time.Second)
+		}
+	}
+}
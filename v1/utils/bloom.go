@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Number of bits set per key
+const bloomHashes = 4
+
+// BloomFilter is a rotating bloom filter remembering keys added within
+// the last one to two windows. Test can return false positives but never
+// false negatives for keys added within the last window.
+type BloomFilter struct {
+	mutex     sync.Mutex
+	size      uint32
+	window    time.Duration
+	current   []uint64
+	previous  []uint64
+	rotatedAt time.Time
+}
+
+// NewBloomFilter creates BloomFilter instance with size bits per window
+func NewBloomFilter(size int, window time.Duration) *BloomFilter {
+	if size < 64 {
+		size = 64
+	}
+
+	return &BloomFilter{
+		size:      uint32(size),
+		window:    window,
+		current:   make([]uint64, (size+63)/64),
+		previous:  make([]uint64, (size+63)/64),
+		rotatedAt: time.Now(),
+	}
+}
+
+// Add adds the key to the filter
+func (bloomFilter *BloomFilter) Add(key string) {
+	bloomFilter.mutex.Lock()
+	defer bloomFilter.mutex.Unlock()
+
+	bloomFilter.rotate()
+	for _, bit := range bloomFilter.bits(key) {
+		bloomFilter.current[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Test returns false if the key has definitely not been added
+func (bloomFilter *BloomFilter) Test(key string) bool {
+	bloomFilter.mutex.Lock()
+	defer bloomFilter.mutex.Unlock()
+
+	bloomFilter.rotate()
+	return isSet(bloomFilter.current, bloomFilter.bits(key)) ||
+		isSet(bloomFilter.previous, bloomFilter.bits(key))
+}
+
+// Starts a new window once the current one is over, keys from
+// the previous window are still remembered during the new one
+func (bloomFilter *BloomFilter) rotate() {
+	elapsed := time.Since(bloomFilter.rotatedAt)
+	if elapsed < bloomFilter.window {
+		return
+	}
+
+	bloomFilter.previous, bloomFilter.current = bloomFilter.current, bloomFilter.previous
+	for i := range bloomFilter.current {
+		bloomFilter.current[i] = 0
+	}
+
+	// Nothing was added for a whole window, forget everything
+	if elapsed >= 2*bloomFilter.window {
+		for i := range bloomFilter.previous {
+			bloomFilter.previous[i] = 0
+		}
+	}
+
+	bloomFilter.rotatedAt = time.Now()
+}
+
+// Derives bit positions from two halves of a 64 bit hash
+func (bloomFilter *BloomFilter) bits(key string) []uint32 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	sum := hash.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+
+	bits := make([]uint32, bloomHashes)
+	for i := range bits {
+		bits[i] = (h1 + uint32(i)*h2) % bloomFilter.size
+	}
+	return bits
+}
+
+func isSet(filter []uint64, bits []uint32) bool {
+	for _, bit := range bits {
+		if filter[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
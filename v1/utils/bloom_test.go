@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBloomFilter(t *testing.T) {
+	bloomFilter := NewBloomFilter(1<<16, time.Hour)
+
+	for i := 0; i < 100; i++ {
+		bloomFilter.Add(fmt.Sprintf("task_%d", i))
+	}
+
+	for i := 0; i < 100; i++ {
+		if !bloomFilter.Test(fmt.Sprintf("task_%d", i)) {
+			t.Errorf("bloomFilter.Test(task_%d) = false, want true", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 100; i < 1100; i++ {
+		if bloomFilter.Test(fmt.Sprintf("task_%d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 10 {
+		t.Errorf("falsePositives = %v, want at most 10", falsePositives)
+	}
+}
+
+func TestBloomFilterRotation(t *testing.T) {
+	bloomFilter := NewBloomFilter(1<<16, 20*time.Millisecond)
+	bloomFilter.Add("task")
+
+	// Still remembered during the next window
+	time.Sleep(25 * time.Millisecond)
+	if !bloomFilter.Test("task") {
+		t.Error("key should be remembered during the next window")
+	}
+
+	time.Sleep(25 * time.Millisecond)
+	if bloomFilter.Test("task") {
+		t.Error("key should be forgotten after two windows")
+	}
+}
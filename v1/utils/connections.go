@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrTooManyConnections is returned when opening another connection
+// would exceed the configured maximum
+var ErrTooManyConnections = errors.New("Too many open connections")
+
+// ConnectionGuard keeps track of open connections and caps their number
+// as a safety net against exhausting the broker's connection limit
+type ConnectionGuard struct {
+	mutex sync.Mutex
+	open  int
+}
+
+// Connections guards all broker connections opened by this process
+var Connections = new(ConnectionGuard)
+
+// Acquire reserves a slot for a new connection, max of 0 means no limit
+func (guard *ConnectionGuard) Acquire(max int) error {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	if max > 0 && guard.open >= max {
+		return ErrTooManyConnections
+	}
+	guard.open++
+	return nil
+}
+
+// Release frees a slot of a closed connection
+func (guard *ConnectionGuard) Release() {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	if guard.open > 0 {
+		guard.open--
+	}
+}
+
+// Open returns the number of currently open connections
+func (guard *ConnectionGuard) Open() int {
+	guard.mutex.Lock()
+	defer guard.mutex.Unlock()
+
+	return guard.open
+}
+
+// DialAMQP connects to the AMQP server, over connections opened by
+// the dialer if not nil, e.g. to connect through a proxy
+func DialAMQP(url string, dialer func(network, addr string) (net.Conn, error)) (*amqp.Connection, error) {
+	if dialer == nil {
+		return amqp.Dial(url)
+	}
+
+	return amqp.DialConfig(url, amqp.Config{
+		Heartbeat: 10 * time.Second, // same as amqp.Dial
+		Dial:      dialer,
+	})
+}
@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestConnectionGuard(t *testing.T) {
+	guard := new(ConnectionGuard)
+
+	if err := guard.Acquire(2); err != nil {
+		t.Error(err)
+	}
+
+	if err := guard.Acquire(2); err != nil {
+		t.Error(err)
+	}
+
+	if err := guard.Acquire(2); err != ErrTooManyConnections {
+		t.Errorf("err = %v, want %v", err, ErrTooManyConnections)
+	}
+
+	if guard.Open() != 2 {
+		t.Errorf("guard.Open() = %v, want 2", guard.Open())
+	}
+
+	guard.Release()
+
+	if err := guard.Acquire(2); err != nil {
+		t.Error(err)
+	}
+
+	// No limit
+	if err := guard.Acquire(0); err != nil {
+		t.Error(err)
+	}
+
+	if guard.Open() != 3 {
+		t.Errorf("guard.Open() = %v, want 3", guard.Open())
+	}
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Encryptor encrypts and decrypts sensitive data, e.g. task args
+type Encryptor interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// AESEncryptor encrypts data with AES-GCM, the random nonce
+// is prepended to the ciphertext
+type AESEncryptor struct {
+	aead cipher.AEAD
+}
+
+// NewAESEncryptor creates AESEncryptor instance, the key must be 16, 24
+// or 32 bytes long to select AES-128, AES-192 or AES-256
+func NewAESEncryptor(key []byte) (*AESEncryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AESEncryptor{aead: aead}, nil
+}
+
+// Encrypt implements the Encryptor interface
+func (aesEncryptor *AESEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aesEncryptor.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aesEncryptor.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt implements the Encryptor interface
+func (aesEncryptor *AESEncryptor) Decrypt(ciphertext []byte) ([]byte, error) {
+	nonceSize := aesEncryptor.aead.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return nil, errors.New("Ciphertext too short")
+	}
+
+	return aesEncryptor.aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], nil)
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAESEncryptor(t *testing.T) {
+	encryptor, err := NewAESEncryptor([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := encryptor.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(ciphertext, []byte("secret")) {
+		t.Error("ciphertext should not contain the plaintext")
+	}
+
+	plaintext, err := encryptor.Decrypt(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(plaintext) != "secret" {
+		t.Errorf("plaintext = %s, want secret", plaintext)
+	}
+
+	ciphertext[len(ciphertext)-1] ^= 1
+	if _, err := encryptor.Decrypt(ciphertext); err == nil {
+		t.Error("decrypting tampered ciphertext should return error")
+	}
+
+	if _, err := NewAESEncryptor([]byte("short")); err == nil {
+		t.Error("invalid key size should return error")
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
 )
 
+// ArgDecoder converts a value decoded from the wire into a custom type
+type ArgDecoder func(value interface{}) (reflect.Value, error)
+
 var (
 	typesMap = map[string]reflect.Type{
 		"int":     reflect.TypeOf(int(1)),
@@ -23,15 +27,41 @@ var (
 		"string":  reflect.TypeOf(string("")),
 	}
 
+	argCodecs      = map[string]ArgDecoder{}
+	argCodecsMutex sync.RWMutex
+
 	typeConversionError = func(argValue interface{}, argTypeStr string) error {
 		return fmt.Errorf("%v is not %v", argValue, argTypeStr)
 	}
 )
 
+// RegisterArgCodec teaches ReflectValue how to convert values of a custom
+// type, e.g. "time.Time", into the type expected by tasks
+func RegisterArgCodec(typeName string, decode ArgDecoder) {
+	argCodecsMutex.Lock()
+	defer argCodecsMutex.Unlock()
+
+	argCodecs[typeName] = decode
+}
+
 // ReflectValue converts interface{} to reflect.Value based on string type
 func ReflectValue(theType string, value interface{}) (reflect.Value, error) {
 	var reflectedValue reflect.Value
 
+	argCodecsMutex.RLock()
+	decode, ok := argCodecs[theType]
+	argCodecsMutex.RUnlock()
+	if ok {
+		return decode(value)
+	}
+
+	if _, ok := typesMap[theType]; !ok {
+		return reflectedValue, fmt.Errorf(
+			"%v is not one of supported types, register a codec for it",
+			theType,
+		)
+	}
+
 	theType = typesMap[theType].String()
 	theValue := reflect.New(typesMap[theType])
 
@@ -1,6 +1,11 @@
 package utils
 
-import "testing"
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
 
 func TestReflectValue(t *testing.T) {
 	value, err := ReflectValue("int", interface{}(float64(1)))
@@ -107,3 +112,38 @@ func TestReflectValue(t *testing.T) {
 		t.Errorf("type is %v, want string", value.Type().String())
 	}
 }
+
+func TestRegisterArgCodec(t *testing.T) {
+	_, err := ReflectValue("time.Time", interface{}("2015-06-01T10:00:00Z"))
+	if err == nil {
+		t.Error("err should not be nil for unregistered type")
+	}
+
+	RegisterArgCodec("time.Time", func(value interface{}) (reflect.Value, error) {
+		s, ok := value.(string)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("%v is not time.Time", value)
+		}
+		parsed, err := time.Parse(time.RFC3339, s)
+		return reflect.ValueOf(parsed), err
+	})
+	defer func() {
+		argCodecsMutex.Lock()
+		defer argCodecsMutex.Unlock()
+
+		delete(argCodecs, "time.Time")
+	}()
+
+	value, err := ReflectValue("time.Time", interface{}("2015-06-01T10:00:00Z"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	if value.Type().String() != "time.Time" {
+		t.Errorf("type is %v, want time.Time", value.Type().String())
+	}
+
+	if value.Interface().(time.Time).Year() != 2015 {
+		t.Errorf("year is %v, want 2015", value.Interface().(time.Time).Year())
+	}
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"fmt"
 	"log"
 	"time"
 )
@@ -9,16 +8,20 @@ import (
 // A useful closure we can use when there is a problem connecting to the broker
 // It uses Fibonacci sequence to space out retry attempts
 var RetryClosure = func() func() {
-	retryIn := 0
-	fibonacci := Fibonacci()
-	return func() {
-		if retryIn > 0 {
-			durationString := fmt.Sprintf("%vs", retryIn)
-			duration, _ := time.ParseDuration(durationString)
+	return NewRetryClosure(&FibonacciBackoff{Unit: time.Second})
+}
 
-			log.Printf("Retrying in %v seconds", retryIn)
-			time.Sleep(duration)
+// NewRetryClosure returns a closure which sleeps according to the backoff
+// strategy every time it is called, except for the first time
+func NewRetryClosure(backoff BackoffStrategy) func() {
+	backoff.Reset()
+	attempt := 0
+	return func() {
+		if attempt > 0 {
+			retryIn := backoff.NextDelay(attempt)
+			log.Printf("Retrying in %v", retryIn)
+			time.Sleep(retryIn)
 		}
-		retryIn = fibonacci()
+		attempt++
 	}
 }
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrMissingSignature - the message is not signed
+	ErrMissingSignature = errors.New("Message is not signed")
+	// ErrInvalidSignature - the signature doesn't match the message
+	ErrInvalidSignature = errors.New("Invalid message signature")
+)
+
+// Signer signs messages so consumers can verify they were published by an
+// authorized publisher and not tampered with
+type Signer interface {
+	Sign(message []byte) (string, error)
+}
+
+// Verifier verifies signatures of messages made by a Signer
+type Verifier interface {
+	Verify(message []byte, signature string) error
+}
+
+// HMACSigner signs messages with HMAC-SHA256. Signatures are prefixed with
+// the ID of the key, so keys can be rotated: sign with the new key once
+// every consumer verifies with both, then drop the old one.
+type HMACSigner struct {
+	keyID string
+	keys  map[string][]byte
+}
+
+// NewHMACSigner creates HMACSigner instance signing with the key of keyID
+// and verifying with any of the keys by ID
+func NewHMACSigner(keyID string, keys map[string][]byte) (*HMACSigner, error) {
+	if _, ok := keys[keyID]; !ok {
+		return nil, fmt.Errorf("Signing key %s not found", keyID)
+	}
+	for id := range keys {
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("Key ID %s must not contain a colon", id)
+		}
+	}
+
+	return &HMACSigner{keyID: keyID, keys: keys}, nil
+}
+
+// Sign implements the Signer interface
+func (hmacSigner *HMACSigner) Sign(message []byte) (string, error) {
+	return hmacSigner.keyID + ":" + base64.StdEncoding.EncodeToString(hmacSigner.sum(hmacSigner.keys[hmacSigner.keyID], message)), nil
+}
+
+// Verify implements the Verifier interface
+func (hmacSigner *HMACSigner) Verify(message []byte, signature string) error {
+	if signature == "" {
+		return ErrMissingSignature
+	}
+
+	parts := strings.SplitN(signature, ":", 2)
+	if len(parts) != 2 {
+		return ErrInvalidSignature
+	}
+	key, ok := hmacSigner.keys[parts[0]]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	mac, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal(mac, hmacSigner.sum(key, message)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (hmacSigner *HMACSigner) sum(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestHMACSigner(t *testing.T) {
+	oldSigner, err := NewHMACSigner("2023", map[string][]byte{"2023": []byte("old key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewHMACSigner("2024", map[string][]byte{"2023": []byte("old key"), "2024": []byte("new key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte(`{"Name":"add"}`)
+	signature, err := signer.Sign(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Verify(message, signature); err != nil {
+		t.Errorf("Verify() = %v, want nil", err)
+	}
+
+	// Messages signed with the old key still verify during rotation
+	oldSignature, _ := oldSigner.Sign(message)
+	if err := signer.Verify(message, oldSignature); err != nil {
+		t.Errorf("Verify() = %v, want nil with the old key", err)
+	}
+
+	testCases := []struct {
+		message   []byte
+		signature string
+		err       error
+	}{
+		{[]byte(`{"Name":"delete"}`), signature, ErrInvalidSignature},
+		{message, "", ErrMissingSignature},
+		{message, "2025" + signature[4:], ErrInvalidSignature},
+		{message, "2024:not base64", ErrInvalidSignature},
+		{message, "unsigned", ErrInvalidSignature},
+	}
+	for _, testCase := range testCases {
+		if err := signer.Verify(testCase.message, testCase.signature); err != testCase.err {
+			t.Errorf("Verify(%s, %q) = %v, want %v", testCase.message, testCase.signature, err, testCase.err)
+		}
+	}
+
+	// Tasks published by the old signer fail once its key is dropped
+	if err := oldSigner.Verify(message, signature); err != ErrInvalidSignature {
+		t.Errorf("Verify() = %v, want %v with an unknown key", err, ErrInvalidSignature)
+	}
+
+	if _, err := NewHMACSigner("2025", map[string][]byte{"2024": []byte("new key")}); err == nil {
+		t.Error("missing signing key should return error")
+	}
+}
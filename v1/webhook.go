@@ -0,0 +1,82 @@
+package machinery
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/config"
+	"github.com/RichardKnop/machinery/v1/utils"
+)
+
+// WebhookSignatureHeader carries HMAC-SHA256 of the webhook payload
+// when WebhookSecret is configured
+const WebhookSignatureHeader = "X-Machinery-Signature"
+
+// PostWebhook POSTs the task state as JSON to the callback URL.
+// Failed requests are retried WebhookRetries times.
+func PostWebhook(cnf *config.Config, callbackURL string, taskState *backends.TaskState) error {
+	payload, err := json.Marshal(taskState)
+	if err != nil {
+		return fmt.Errorf("JSON Encode Webhook: %v", err)
+	}
+
+	timeout := cnf.WebhookTimeout
+	if timeout == 0 {
+		// time out webhook requests after 10 seconds by default
+		timeout = 10
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+
+	backoff := cnf.WebhookBackoff
+	if backoff == nil {
+		backoff = &utils.FibonacciBackoff{Unit: time.Second}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = postWebhookOnce(client, cnf.WebhookSecret, callbackURL, payload)
+		if err == nil || attempt >= cnf.WebhookRetries {
+			return err
+		}
+
+		retryIn := backoff.NextDelay(attempt + 1)
+		log.Printf("Webhook %s failed: %v. Retrying in %v", callbackURL, err, retryIn)
+		time.Sleep(retryIn)
+	}
+}
+
+// SignWebhookPayload returns hex encoded HMAC-SHA256 of the payload
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhookOnce(client *http.Client, secret, callbackURL string, payload []byte) error {
+	req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(secret, payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook Response: %s", resp.Status)
+	}
+	return nil
+}
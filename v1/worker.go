@@ -2,18 +2,38 @@ package machinery
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
 	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/RichardKnop/machinery/v1/backends"
+	"github.com/RichardKnop/machinery/v1/brokers"
 	"github.com/RichardKnop/machinery/v1/signatures"
 	"github.com/RichardKnop/machinery/v1/utils"
 )
 
+// ErrWorkerAborted is returned for tasks which finished after the worker
+// stopped hard, their messages have been requeued to run again
+var ErrWorkerAborted = errors.New("Worker aborted")
+
 // Worker represents a single worker process
 type Worker struct {
 	server      *Server
 	ConsumerTag string
+	completed   *utils.BloomFilter
+	metrics     TaskMetrics
+	aborted     int32
+	coalescer   coalescer
+	outcomes    brokers.OutcomeRecorder
+	tenants     tenantUsage
+	webhooks    chan struct{}
+	posting     sync.WaitGroup
+	heap        heapSampler
 }
 
 // Launch starts a new worker process. The worker subscribes
@@ -29,11 +49,47 @@ func (worker *Worker) Launch() error {
 	log.Printf("- ExchangeType: %s", cnf.ExchangeType)
 	log.Printf("- DefaultQueue: %s", cnf.DefaultQueue)
 	log.Printf("- BindingKey: %s", cnf.BindingKey)
+	log.Printf("- WorkerID: %s", worker.getWorkerID())
+
+	if _, ok := worker.server.GetBackend().(backends.Committer); cnf.ExactlyOnce && !ok {
+		return errors.New("Result backend does not support exactly-once delivery")
+	}
+	if _, ok := worker.server.GetBackend().(backends.StatePeeker); cnf.SkipCompletedTasks && !ok {
+		return errors.New("Result backend does not support skipping completed tasks")
+	}
+
+	// Resume streams where the consumer group left off
+	if positionStore, ok := worker.server.GetBackend().(backends.PositionStore); ok {
+		if hookedBroker, ok := broker.(brokers.HookedBroker); ok {
+			hookedBroker.SetPositionStore(positionStore)
+		}
+	}
+
+	// Count messages by serialization format
+	if decoderMetrics, ok := worker.metrics.(DecoderMetrics); ok {
+		if hookedBroker, ok := broker.(brokers.HookedBroker); ok {
+			hookedBroker.SetOnDecoded(decoderMetrics.IncDecoded)
+		}
+	}
+
+	// Keep a structured record of every consumed task
+	if worker.outcomes != nil {
+		if hookedBroker, ok := broker.(brokers.HookedBroker); ok {
+			hookedBroker.SetOutcomeRecorder(worker.outcomes, worker.getWorkerID())
+		}
+	}
+
+	// Observe latencies by queue
+	if latencyMetrics, ok := worker.metrics.(LatencyMetrics); ok {
+		if hookedBroker, ok := broker.(brokers.HookedBroker); ok {
+			hookedBroker.SetOnLatency(latencyMetrics.ObserveLatency)
+		}
+	}
 
 	errChan := make(chan error)
 
 	go func() {
-		retryFunc := utils.RetryClosure()
+		retryFunc := worker.newRetryClosure()
 		for {
 			retryFunc()
 			retry, err := broker.StartConsuming(worker.ConsumerTag, worker)
@@ -44,55 +100,370 @@ func (worker *Worker) Launch() error {
 			}
 
 			log.Print(err)
+
+			// Rolling reconnect, no need to back off
+			if err == brokers.ErrConsumerLifetimeExceeded {
+				retryFunc = worker.newRetryClosure()
+			}
 		}
 	}()
 
 	return <-errChan
 }
 
-// Quit tears down the running worker process
+// Backs off reconnecting to the broker
+func (worker *Worker) newRetryClosure() func() {
+	if backoff := worker.server.GetConfig().ReconnectBackoff; backoff != nil {
+		return utils.NewRetryClosure(backoff)
+	}
+	return utils.RetryClosure()
+}
+
+// Drain processes all tasks waiting in the default queue and returns
+// once the queue is empty. Useful for batch jobs.
+func (worker *Worker) Drain() error {
+	return worker.server.GetBroker().Drain(worker)
+}
+
+// Quit tears down the running worker process, once webhooks being posted
+// are done
 func (worker *Worker) Quit() {
 	worker.server.GetBroker().StopConsuming()
+	worker.posting.Wait()
+}
+
+// Shutdown stops the worker for good, e.g. during a rolling deploy. With
+// WarmShutdownTimeout, tasks being processed finish their current step and
+// publish their workflow's next step, so the workflow continues on another
+// worker, and Shutdown returns once they have. Otherwise, or once the
+// timeout passes, the worker stops hard: messages of tasks being processed
+// are requeued to run again on another worker and their outcome is
+// discarded. Shutdown returns once webhooks being posted are done.
+func (worker *Worker) Shutdown() {
+	defer worker.posting.Wait()
+
+	broker := worker.server.GetBroker()
+	gracefulBroker, ok := broker.(brokers.GracefulBroker)
+	if !ok {
+		broker.StopConsuming()
+		return
+	}
+
+	if timeout := worker.server.GetConfig().WarmShutdownTimeout; timeout > 0 {
+		broker.StopConsuming()
+		if gracefulBroker.WaitConsuming(time.Duration(timeout) * time.Second) {
+			return
+		}
+		log.Printf("Stopping hard after waiting %vs for tasks to finish", timeout)
+	}
+
+	atomic.StoreInt32(&worker.aborted, 1)
+	gracefulBroker.AbortConsuming()
+}
+
+// SetMetrics sets a collector of per task execution metrics
+func (worker *Worker) SetMetrics(metrics TaskMetrics) {
+	worker.metrics = metrics
+}
+
+// SetOutcomeRecorder sets a recorder receiving a structured record of
+// every consumed task, e.g. a brokers.JSONLinesRecorder
+func (worker *Worker) SetOutcomeRecorder(recorder brokers.OutcomeRecorder) {
+	worker.outcomes = recorder
 }
 
 // Process handles received tasks and triggers success/error callbacks
-func (worker *Worker) Process(signature *signatures.TaskSignature) {
+func (worker *Worker) Process(signature *signatures.TaskSignature) error {
 	task := worker.server.GetRegisteredTask(signature.Name)
 	if task == nil {
-		log.Printf("Task with a name '%s' not registered", signature.Name)
-		return
+		err := fmt.Errorf("Task with a name '%s' not registered", signature.Name)
+		worker.recordFailure(signature)
+		return err
+	}
+
+	// Skip tasks which have already been processed, e.g. redelivered
+	// after a worker died before acknowledging them
+	if worker.isCompleted(signature) {
+		log.Printf("Skipping already completed task %s", signature.UUID)
+		return nil
+	}
+
+	// Skip tasks the application's idempotency store has already seen
+	if processed, err := worker.isProcessed(signature); err != nil {
+		return brokers.NewActionError(brokers.ActionRequeue, err)
+	} else if processed {
+		log.Printf("Skipping already processed task %s", signature.UUID)
+		return nil
 	}
 
+	// Malformed invocations would fail the same way again, dead letter them
+	if err := worker.server.applyArgSpecs(signature); err != nil {
+		worker.recordFailure(signature)
+		return worker.finalizeAction(signature, brokers.NewActionError(brokers.ActionDeadLetter, err))
+	}
+
+	// Respect the task's fleet-wide concurrency limit
+	release, acquired, err := worker.acquireSlot(signature)
+	if err != nil {
+		worker.recordFailure(signature)
+		return worker.finalizeError(signature, err)
+	}
+	if !acquired {
+		return worker.deferTask(signature, ErrConcurrencyLimit)
+	}
+
+	// Keep the tenant within its quota, so it can't starve other tenants.
+	// The task's slot is released before deferring, over-quota tenants
+	// must not hold it while they wait.
+	releaseQuota, withinQuota, err := worker.acquireQuota(signature)
+	if err != nil {
+		release()
+		worker.recordFailure(signature)
+		return worker.finalizeError(signature, err)
+	}
+	if !withinQuota {
+		release()
+		return worker.deferTask(signature, ErrTenantQuota)
+	}
+	// A task given up on, e.g. hung, may still be running, it holds its slot
+	// and quota until it returns so the concurrency limits aren't exceeded
+	var running <-chan struct{}
+	defer func() {
+		if running == nil {
+			releaseQuota()
+			release()
+			return
+		}
+		go func() {
+			<-running
+			releaseQuota()
+			release()
+		}()
+	}()
+
 	// Update task state to RECEIVED
 	receivedState := backends.NewReceivedTaskState(signature.UUID)
-	if err := worker.server.UpdateTaskState(receivedState); err != nil {
-		worker.finalizeError(signature, err)
-		return
+	if err := worker.updateTaskState(signature, receivedState); err != nil {
+		return worker.finalizeError(signature, err)
 	}
 
 	// Get task args and convert them to proper types
 	reflectedTask := reflect.ValueOf(task)
 	relfectedArgs, err := worker.reflectArgs(signature.Args)
 	if err != nil {
-		worker.finalizeError(signature, err)
-		return
+		worker.recordFailure(signature)
+		return worker.finalizeError(signature, err)
 	}
 
 	// Update task state to STARTED
 	startedState := backends.NewStartedTaskState(signature.UUID)
-	if err := worker.server.UpdateTaskState(startedState); err != nil {
-		worker.finalizeError(signature, err)
-		return
+	if err := worker.updateTaskState(signature, startedState); err != nil {
+		return worker.finalizeError(signature, err)
 	}
 
 	// Call the task passing in the correct arguments
-	results := reflectedTask.Call(relfectedArgs)
+	start := time.Now()
+	results, err := worker.coalesce(signature, func() ([]reflect.Value, error) {
+		results, stillRunning, err := worker.callTask(signature, reflectedTask, relfectedArgs)
+		running = stillRunning
+		return results, err
+	})
+	duration := time.Since(start)
+
+	// The message has been requeued by a hard stop, the task runs again
+	if atomic.LoadInt32(&worker.aborted) == 1 {
+		log.Printf("Discarding outcome of %s, the worker stopped hard", signature.UUID)
+		return ErrWorkerAborted
+	}
+
+	if err != nil {
+		worker.recordMetrics(signature, duration, err)
+
+		// Stuck tasks would most likely hang again and memory hungry
+		// ones blow up the heap again, dead letter them
+		if _, ok := err.(*HeapDeltaError); ok || err == ErrTaskHung {
+			return worker.finalizeAction(signature, brokers.NewActionError(brokers.ActionDeadLetter, err))
+		}
+		return worker.finalizeError(signature, err)
+	}
+
 	if !results[1].IsNil() {
-		worker.finalizeError(signature, errors.New(results[1].String()))
+		err, ok := results[1].Interface().(error)
+		if !ok {
+			err = errors.New(results[1].String())
+		}
+		worker.recordMetrics(signature, duration, err)
+
+		if canceledError, ok := err.(*CanceledError); ok {
+			return worker.finalizeCanceled(signature, canceledError)
+		}
+		if actionError, ok := err.(*brokers.ActionError); ok {
+			return worker.finalizeAction(signature, actionError)
+		}
+		if worker.canRetry(signature) {
+			worker.retryTask(signature, err)
+			return err
+		}
+		return worker.finalizeError(signature, err)
+	}
+
+	worker.recordMetrics(signature, duration, nil)
+	if err := worker.finalizeSuccess(signature, results[0]); err != nil {
+		return err
+	}
+
+	worker.recordProcessed(signature)
+	return nil
+}
+
+// Validate checks the task can be dispatched, i.e. it is registered
+// and the signature's args, with defaults filled in, can be passed to it
+func (worker *Worker) Validate(signature *signatures.TaskSignature) error {
+	task := worker.server.GetRegisteredTask(signature.Name)
+	if task == nil {
+		return fmt.Errorf("Task with a name '%s' not registered", signature.Name)
+	}
+
+	if err := worker.server.applyArgSpecs(signature); err != nil {
+		return err
+	}
+
+	taskType := reflect.TypeOf(task)
+	if taskType.Kind() != reflect.Func {
+		return fmt.Errorf("Task '%s' is not a function", signature.Name)
+	}
+
+	reflectedArgs, err := worker.reflectArgs(signature.Args)
+	if err != nil {
+		return err
+	}
+
+	// The context is passed by the worker, not among the args
+	first := 0
+	if takesContext(taskType) {
+		first = 1
+	}
+
+	numIn := taskType.NumIn()
+	if (taskType.IsVariadic() && len(reflectedArgs) < numIn-first-1) ||
+		(!taskType.IsVariadic() && len(reflectedArgs) != numIn-first) {
+		return fmt.Errorf(
+			"Task '%s' called with %d args, want %d",
+			signature.Name,
+			len(reflectedArgs),
+			numIn-first,
+		)
+	}
+
+	for i, arg := range reflectedArgs {
+		var paramType reflect.Type
+		if taskType.IsVariadic() && first+i >= numIn-1 {
+			paramType = taskType.In(numIn - 1).Elem()
+		} else {
+			paramType = taskType.In(first + i)
+		}
+
+		if !arg.Type().AssignableTo(paramType) {
+			return fmt.Errorf(
+				"Task '%s' arg %d is %v, want %v",
+				signature.Name,
+				i,
+				arg.Type(),
+				paramType,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Updates the task state and publishes a matching audit event
+func (worker *Worker) updateTaskState(signature *signatures.TaskSignature, taskState *backends.TaskState) error {
+	taskState.WorkerID = worker.getWorkerID()
+
+	if worker.completed != nil && taskState.IsCompleted() {
+		worker.completed.Add(signature.UUID)
+	}
+
+	if worker.server.GetConfig().AuditExchange != "" {
+		event := NewAuditEvent(signature, taskState)
+		if err := worker.server.GetBroker().PublishAuditEvent(taskState.State, event); err != nil {
+			log.Printf("Failed publishing audit event for %s. Error = %v", signature.UUID, err)
+		}
+	}
+
+	// Only one delivery of the task commits its outcome
+	if worker.server.GetConfig().ExactlyOnce && taskState.IsCompleted() {
+		return worker.server.CommitTaskState(taskState)
+	}
+
+	return worker.server.UpdateTaskState(taskState)
+}
+
+// Asks the configured idempotency check whether the task has already
+// been processed
+func (worker *Worker) isProcessed(signature *signatures.TaskSignature) (bool, error) {
+	check := worker.server.GetConfig().IdempotencyCheck
+	if check == nil {
+		return false, nil
+	}
+
+	processed, err := check(signature)
+	if err != nil {
+		return false, fmt.Errorf("Idempotency Check: %v", err)
+	}
+	return processed, nil
+}
+
+// Records the successfully processed task with the configured idempotency
+// record callback
+func (worker *Worker) recordProcessed(signature *signatures.TaskSignature) {
+	record := worker.server.GetConfig().IdempotencyRecord
+	if record == nil {
 		return
 	}
 
-	worker.finalizeSuccess(signature, results[0])
+	if err := record(signature); err != nil {
+		log.Printf("Failed recording %s as processed. Error = %v", signature.UUID, err)
+	}
+}
+
+// Checks the result backend whether the task has already completed.
+// With the bloom filter, only first deliveries this worker has most likely
+// completed recently are looked up, saving a round trip for the rest.
+// Redeliveries are always looked up. States are peeked at so the lookup
+// doesn't consume them.
+func (worker *Worker) isCompleted(signature *signatures.TaskSignature) bool {
+	cnf := worker.server.GetConfig()
+	backend, ok := worker.server.GetBackend().(backends.StatePeeker)
+	if !(cnf.SkipCompletedTasks || cnf.ExactlyOnce) || !ok {
+		return false
+	}
+
+	// Redeliveries may have been completed by another worker or before a
+	// restart, which this worker's bloom filter doesn't know about
+	if !cnf.ExactlyOnce && !signature.Redelivered && worker.completed != nil && !worker.completed.Test(signature.UUID) {
+		return false
+	}
+
+	taskState, err := backend.PeekState(signature.UUID)
+	if err != nil {
+		return false
+	}
+	return taskState.IsCompleted()
+}
+
+// Returns configured worker ID, hostname-pid by default
+func (worker *Worker) getWorkerID() string {
+	if workerID := worker.server.GetConfig().WorkerID; workerID != "" {
+		return workerID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
 }
 
 // Converts []TaskArg to []reflect.Value
@@ -110,23 +481,160 @@ func (worker *Worker) reflectArgs(args []signatures.TaskArg) ([]reflect.Value, e
 	return argValues, nil
 }
 
-// Task succeeded, update state and trigger success callbacks
-func (worker *Worker) finalizeSuccess(signature *signatures.TaskSignature, result reflect.Value) {
-	// Update task state to SUCCESS
-	successState := backends.NewSuccessTaskState(
+// Returns whether the failed task may be retried. Tasks of a workflow with
+// a retry budget also draw from the budget shared by all its steps.
+func (worker *Worker) canRetry(signature *signatures.TaskSignature) bool {
+	if signature.RetryCount <= 0 {
+		return false
+	}
+
+	budget, ok := signature.GetRetryBudget()
+	if !ok {
+		return true
+	}
+	if budget <= 0 {
+		log.Printf("Not retrying %s, the retry budget of its workflow is exhausted", signature.UUID)
+		return false
+	}
+
+	signature.Headers[signatures.RetryBudgetHeader] = budget - 1
+	return true
+}
+
+// Task failed but can be retried, republish it with retry metadata
+func (worker *Worker) retryTask(signature *signatures.TaskSignature, err error) {
+	if signature.RetryCount > 0 {
+		signature.RetryCount--
+	}
+	signature.StampRetry(err)
+	signature.Headers[signatures.WorkerHeader] = worker.getWorkerID()
+
+	// With a retry queue the task is retried after a backoff,
+	// otherwise it is republished right away
+	retryPublisher, delayed := worker.server.GetBroker().(brokers.RetryPublisher)
+	delayed = delayed && worker.server.GetConfig().RetryQueue != ""
+	var delay time.Duration
+	if delayed {
+		delay = worker.retryDelay(signature)
+	}
+
+	// Update task state to RETRY
+	retryState := backends.NewRetryTaskState(
+		signature.UUID,
+		err.Error(),
+		signature.RetryCount,
+		time.Now().Add(delay).UTC(),
+	)
+	if err := worker.updateTaskState(signature, retryState); err != nil {
+		log.Printf("Failed updating status to RETRY. Error = %v", err)
+	}
+
+	log.Printf(
+		"Failed processing %s (attempt %d). Retrying. Error = %v",
 		signature.UUID,
-		&backends.TaskResult{
-			Type:  result.Type().String(),
-			Value: result.Interface(),
-		},
+		signature.GetAttempt(),
+		err,
 	)
-	if err := worker.server.UpdateTaskState(successState); err != nil {
+
+	if delayed {
+		if err := retryPublisher.PublishRetry(signature, delay); err != nil {
+			worker.finalizeError(signature, fmt.Errorf("Retry Publish: %v", err))
+		}
+		return
+	}
+
+	if err := worker.server.GetBroker().Publish(signature); err != nil {
+		worker.finalizeError(signature, fmt.Errorf("Retry Publish: %v", err))
+	}
+}
+
+// Returns how long the task waits in the retry queue, growing with
+// every failed attempt
+func (worker *Worker) retryDelay(signature *signatures.TaskSignature) time.Duration {
+	backoff := worker.server.GetConfig().RetryBackoff
+	if backoff == nil {
+		// Wait 1 second, doubled with every attempt, by default
+		backoff = &utils.ExponentialBackoff{Initial: time.Second}
+	}
+	return backoff.NextDelay(signature.GetAttempt())
+}
+
+// Task explicitly requested what to do with its message
+func (worker *Worker) finalizeAction(signature *signatures.TaskSignature, actionError *brokers.ActionError) error {
+	err := actionError.Err
+	if err == nil {
+		err = errors.New(actionError.Action.String())
+	}
+
+	switch actionError.Action {
+	case brokers.ActionRequeue:
+		// The task will run again, keep its current state
+		log.Printf("Requeueing %s. Error = %v", signature.UUID, err)
+		return actionError
+	case brokers.ActionRetryLater:
+		worker.retryTask(signature, err)
+		return actionError
+	case brokers.ActionDeadLetter:
+		if finalErr := worker.finalizeError(signature, err); finalErr != err {
+			return finalErr
+		}
+		return actionError
+	}
+
+	return worker.finalizeError(signature, err)
+}
+
+// Task succeeded, update state and trigger success callbacks
+// With AckAfterResult, returns StateNotStoredError if the result
+// could not be stored so the task gets requeued
+func (worker *Worker) finalizeSuccess(signature *signatures.TaskSignature, result reflect.Value) error {
+	taskResult := &backends.TaskResult{
+		Type:  result.Type().String(),
+		Value: result.Interface(),
+	}
+
+	// Readers are streamed to the backend in chunks rather than stored whole,
+	// success callbacks get the key to read the stream with
+	if reader, ok := result.Interface().(io.Reader); ok {
+		if err := worker.streamResult(signature, reader); err != nil {
+			if worker.server.GetConfig().AckAfterResult {
+				return &brokers.StateNotStoredError{Err: err}
+			}
+			return worker.finalizeError(signature, err)
+		}
+		taskResult = &backends.TaskResult{
+			Type:  backends.StreamResultType,
+			Value: signature.UUID,
+		}
+		result = reflect.ValueOf(signature.UUID)
+	}
+
+	// Update task state to SUCCESS
+	successState := backends.NewSuccessTaskState(signature.UUID, taskResult)
+	if err := worker.updateTaskState(signature, successState); err != nil {
+		if err == backends.ErrAlreadyCommitted {
+			log.Printf("Discarding outcome of %s, another delivery committed it", signature.UUID)
+			return nil
+		}
+		if worker.server.GetConfig().AckAfterResult {
+			return &brokers.StateNotStoredError{Err: err}
+		}
 		log.Print(err)
 	}
+	worker.notifyWebhook(signature, successState)
+	worker.sendReply(signature, successState)
 
 	log.Printf("Processed %s. Result = %v", signature.UUID, result.Interface())
 
+	maxDepth := worker.server.GetConfig().MaxWorkflowDepth
 	for _, successTask := range signature.OnSuccess {
+		// Abort workflows looping back to a task or growing too deep, rather
+		// than flooding the queue with their tasks. The task itself succeeded.
+		if err := continueWorkflow(signature, successTask, maxDepth); err != nil {
+			log.Printf("Not calling success callback %s of %s. Error = %v", successTask.UUID, signature.UUID, err)
+			continue
+		}
+
 		if signature.Immutable == false {
 			// Pass results of the task to success callbacks
 			args := append([]signatures.TaskArg{signatures.TaskArg{
@@ -136,27 +644,145 @@ func (worker *Worker) finalizeSuccess(signature *signatures.TaskSignature, resul
 			successTask.Args = args
 		}
 
+		// The next steps of the workflow share what's left of the budget
+		if budget, ok := signature.GetRetryBudget(); ok {
+			if successTask.Headers == nil {
+				successTask.Headers = make(map[string]interface{})
+			}
+			successTask.Headers[signatures.RetryBudgetHeader] = budget
+		}
+		inheritQoS(signature, successTask)
+
 		worker.server.SendTask(successTask)
 	}
+
+	return nil
+}
+
+// Stores the result read from the reader as a stream keyed by the task UUID
+func (worker *Worker) streamResult(signature *signatures.TaskSignature, reader io.Reader) error {
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	streamStore, ok := worker.server.GetBackend().(backends.StreamStore)
+	if !ok {
+		return errors.New("Result backend does not support streamed results")
+	}
+
+	if err := streamStore.WriteStream(signature.UUID, reader); err != nil {
+		return fmt.Errorf("Write Stream: %v", err)
+	}
+	return nil
+}
+
+// Task was canceled, store its partial result along with the reason
+// With AckAfterResult, returns StateNotStoredError if the state could
+// not be stored so the task gets requeued
+func (worker *Worker) finalizeCanceled(signature *signatures.TaskSignature, canceledError *CanceledError) error {
+	var partial *backends.TaskResult
+	if canceledError.Partial != nil {
+		partial = &backends.TaskResult{
+			Type:  reflect.TypeOf(canceledError.Partial).String(),
+			Value: canceledError.Partial,
+		}
+	}
+
+	// Update task state to CANCELED
+	canceledState := backends.NewCanceledTaskState(signature.UUID, partial, canceledError.Reason)
+	if err := worker.updateTaskState(signature, canceledState); err != nil {
+		if err == backends.ErrAlreadyCommitted {
+			log.Printf("Discarding outcome of %s, another delivery committed it", signature.UUID)
+			return nil
+		}
+		if worker.server.GetConfig().AckAfterResult {
+			return &brokers.StateNotStoredError{Err: err}
+		}
+		log.Printf("Failed updating status to CANCELED. Error = %v", err)
+	}
+	worker.notifyWebhook(signature, canceledState)
+	worker.sendReply(signature, canceledState)
+
+	log.Printf("Canceled %s. Reason = %s, partial result = %v", signature.UUID, canceledError.Reason, canceledError.Partial)
+
+	return nil
 }
 
 // Task failed, update state and trigger error callbacks
-func (worker *Worker) finalizeError(signature *signatures.TaskSignature, err error) {
+// Returns the error to be reported for the task, with AckAfterResult
+// StateNotStoredError if the failure could not be stored
+func (worker *Worker) finalizeError(signature *signatures.TaskSignature, err error) error {
 	// Update task state to FAILURE
 	failureState := backends.NewFailureTaskState(signature.UUID, err.Error())
-	if err := worker.server.UpdateTaskState(failureState); err != nil {
+	if err := worker.updateTaskState(signature, failureState); err != nil {
+		if err == backends.ErrAlreadyCommitted {
+			log.Printf("Discarding outcome of %s, another delivery committed it", signature.UUID)
+			return nil
+		}
+		if worker.server.GetConfig().AckAfterResult {
+			return &brokers.StateNotStoredError{Err: err}
+		}
 		log.Printf("Failed updating status to FAILURE. Error = %v", err)
 	}
+	worker.notifyWebhook(signature, failureState)
+	worker.sendReply(signature, failureState)
 
 	log.Printf("Failed processing %s. Error = %v", signature.UUID, err)
 
+	maxDepth := worker.server.GetConfig().MaxWorkflowDepth
 	for _, errorTask := range signature.OnError {
+		if err := continueWorkflow(signature, errorTask, maxDepth); err != nil {
+			log.Printf("Not calling error callback %s of %s. Error = %v", errorTask.UUID, signature.UUID, err)
+			continue
+		}
+
 		// Pass error as a first argument to error callbacks
 		args := append([]signatures.TaskArg{signatures.TaskArg{
 			Type:  reflect.TypeOf(err).String(),
 			Value: reflect.ValueOf(err).Interface(),
 		}}, errorTask.Args...)
 		errorTask.Args = args
+		inheritQoS(signature, errorTask)
 		worker.server.SendTask(errorTask)
 	}
+
+	return err
+}
+
+// Posts the final task state to the signature's callback URL, if any, in
+// the background so retries don't hold up processing. Once WebhookConcurrency
+// webhooks are being posted, it waits for one of them to finish.
+func (worker *Worker) notifyWebhook(signature *signatures.TaskSignature, taskState *backends.TaskState) {
+	if signature.CallbackURL == "" {
+		return
+	}
+
+	worker.webhooks <- struct{}{}
+	worker.posting.Add(1)
+	go func() {
+		defer worker.posting.Done()
+		defer func() { <-worker.webhooks }()
+
+		err := PostWebhook(worker.server.GetConfig(), signature.CallbackURL, taskState)
+		if err != nil {
+			log.Printf("Failed notifying %s about %s. Error = %v", signature.CallbackURL, signature.UUID, err)
+		}
+	}()
+}
+
+// Replies with the final task state to the requester waiting for it
+func (worker *Worker) sendReply(signature *signatures.TaskSignature, taskState *backends.TaskState) {
+	if signature.ReplyTo == "" {
+		return
+	}
+
+	err := worker.server.GetBroker().PublishReply(
+		signature.ReplyTo,
+		signature.UUID,
+		signature.ContentType,
+		taskState,
+	)
+	if err != nil {
+		log.Printf("Failed replying to %s about %s. Error = %v", signature.ReplyTo, signature.UUID, err)
+	}
 }
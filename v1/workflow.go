@@ -1,10 +1,21 @@
 package machinery
 
 import (
+	"errors"
+
 	"code.google.com/p/go-uuid/uuid"
 	"github.com/RichardKnop/machinery/v1/signatures"
 )
 
+var (
+	// ErrWorkflowCycle is returned when a workflow loops back to a task it
+	// has already run
+	ErrWorkflowCycle = errors.New("Workflow cycle")
+	// ErrWorkflowTooDeep is returned when a workflow runs more tasks one
+	// after another than MaxWorkflowDepth
+	ErrWorkflowTooDeep = errors.New("Workflow too deep")
+)
+
 // Chain creates a chain of tasks to be executed one after another
 type Chain struct {
 	Tasks []*signatures.TaskSignature
@@ -28,6 +39,19 @@ func NewChain(tasks ...*signatures.TaskSignature) *Chain {
 	return chain
 }
 
+// WithRetryBudget caps the retries of all tasks of the chain together. Each
+// retry of any task draws from the budget, once it is exhausted failing
+// tasks aren't retried anymore, even with RetryCount left, and fail with
+// their error callbacks called.
+func (chain *Chain) WithRetryBudget(budget int) *Chain {
+	first := chain.Tasks[0]
+	if first.Headers == nil {
+		first.Headers = make(map[string]interface{})
+	}
+	first.Headers[signatures.RetryBudgetHeader] = budget
+	return chain
+}
+
 // GetUUIDs returns []string of task UUIDs
 func (chain *Chain) GetUUIDs() []string {
 	UUIDs := make([]string, len(chain.Tasks))
@@ -36,3 +60,60 @@ func (chain *Chain) GetUUIDs() []string {
 	}
 	return UUIDs
 }
+
+// Checks the chain doesn't contain a task twice, which would link the task
+// to itself and run the chain forever
+func (chain *Chain) validate() error {
+	seen := make(map[*signatures.TaskSignature]bool, len(chain.Tasks))
+	for _, task := range chain.Tasks {
+		if seen[task] {
+			return ErrWorkflowCycle
+		}
+		seen[task] = true
+	}
+	return nil
+}
+
+// Records the task in the workflow path of its callback. Fails if the
+// callback has already run within the workflow or if running it would
+// exceed maxDepth tasks one after another (unlimited if 0).
+func continueWorkflow(signature, callback *signatures.TaskSignature, maxDepth int) error {
+	path := append(signature.GetWorkflowPath(), signature.UUID)
+	for _, taskUUID := range path {
+		if taskUUID == callback.UUID {
+			return ErrWorkflowCycle
+		}
+	}
+	if maxDepth > 0 && len(path)+1 > maxDepth {
+		return ErrWorkflowTooDeep
+	}
+
+	if callback.Headers == nil {
+		callback.Headers = make(map[string]interface{})
+	}
+	callback.Headers[signatures.WorkflowPathHeader] = path
+	return nil
+}
+
+// Passes the task's priority, trace context and deadline on to a callback
+// continuing its workflow, so the workflow keeps its QoS end-to-end. The
+// callback's own priority, trace context or deadline take precedence.
+func inheritQoS(signature, callback *signatures.TaskSignature) {
+	if callback.Priority == 0 {
+		callback.Priority = signature.Priority
+	}
+	if callback.ValidUntil.IsZero() {
+		callback.ValidUntil = signature.ValidUntil
+	}
+
+	traceParent, ok := signature.Headers[signatures.TraceParentHeader]
+	if !ok {
+		return
+	}
+	if _, ok := callback.Headers[signatures.TraceParentHeader]; !ok {
+		if callback.Headers == nil {
+			callback.Headers = make(map[string]interface{})
+		}
+		callback.Headers[signatures.TraceParentHeader] = traceParent
+	}
+}
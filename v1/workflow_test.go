@@ -2,6 +2,7 @@ package machinery
 
 import (
 	"testing"
+	"time"
 
 	"github.com/RichardKnop/machinery/v1/signatures"
 )
@@ -67,3 +68,78 @@ func TestNewChain(t *testing.T) {
 		)
 	}
 }
+
+func TestContinueWorkflow(t *testing.T) {
+	first := &signatures.TaskSignature{UUID: "first"}
+	second := &signatures.TaskSignature{UUID: "second"}
+	third := &signatures.TaskSignature{UUID: "third"}
+
+	if err := continueWorkflow(first, second, 2); err != nil {
+		t.Fatalf("continueWorkflow() error = %v", err)
+	}
+	if path := second.GetWorkflowPath(); len(path) != 1 || path[0] != "first" {
+		t.Errorf("second.GetWorkflowPath() = %v, want [first]", path)
+	}
+
+	// Looping back to a task which already ran
+	if err := continueWorkflow(second, first, 0); err != ErrWorkflowCycle {
+		t.Errorf("continueWorkflow() error = %v, want %v", err, ErrWorkflowCycle)
+	}
+
+	if err := continueWorkflow(second, third, 2); err != ErrWorkflowTooDeep {
+		t.Errorf("continueWorkflow() error = %v, want %v", err, ErrWorkflowTooDeep)
+	}
+	if err := continueWorkflow(second, third, 0); err != nil {
+		t.Errorf("continueWorkflow() error = %v, want nil without a depth limit", err)
+	}
+
+	// Paths decoded from JSON or AMQP tables
+	decoded := &signatures.TaskSignature{
+		UUID:    "third",
+		Headers: map[string]interface{}{signatures.WorkflowPathHeader: []interface{}{"first", "second"}},
+	}
+	if err := continueWorkflow(decoded, &signatures.TaskSignature{UUID: "second"}, 0); err != ErrWorkflowCycle {
+		t.Errorf("continueWorkflow() error = %v, want %v", err, ErrWorkflowCycle)
+	}
+}
+
+func TestChainValidate(t *testing.T) {
+	task1 := &signatures.TaskSignature{Name: "foo"}
+	task2 := &signatures.TaskSignature{Name: "bar"}
+
+	if err := NewChain(task1, task2).validate(); err != nil {
+		t.Errorf("chain.validate() error = %v", err)
+	}
+
+	chain := &Chain{Tasks: []*signatures.TaskSignature{task1, task2, task1}}
+	if err := chain.validate(); err != ErrWorkflowCycle {
+		t.Errorf("chain.validate() error = %v, want %v", err, ErrWorkflowCycle)
+	}
+}
+
+func TestInheritQoS(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	signature := &signatures.TaskSignature{
+		Priority:   9,
+		ValidUntil: deadline,
+		Headers: map[string]interface{}{
+			signatures.TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+	}
+
+	inherited := &signatures.TaskSignature{}
+	inheritQoS(signature, inherited)
+	if inherited.Priority != 9 || !inherited.ValidUntil.Equal(deadline) {
+		t.Errorf("inherited = %v, %v, want 9, %v", inherited.Priority, inherited.ValidUntil, deadline)
+	}
+	if traceID := inherited.GetTraceID(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("inherited.GetTraceID() = %v, want 4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	}
+
+	// Callbacks setting their own keep them
+	override := &signatures.TaskSignature{Priority: 1}
+	inheritQoS(signature, override)
+	if override.Priority != 1 {
+		t.Errorf("override.Priority = %v, want 1", override.Priority)
+	}
+}